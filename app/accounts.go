@@ -0,0 +1,528 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type User struct {
+	Username     string `json:"Username"`
+	PasswordHash []byte `json:"-"`
+	Created      string `json:"Created"`
+}
+
+// APIKey lets scripts and services authenticate as a user. Only a hash of
+// the secret is kept, the full key is returned once when it is created.
+type APIKey struct {
+	Id         string   `json:"Id"`
+	Name       string   `json:"Name"`
+	Username   string   `json:"Username"`
+	Scopes     []string `json:"Scopes"`
+	SecretHash []byte   `json:"-"`
+	Created    string   `json:"Created"`
+	LastUsed   string   `json:"LastUsed,omitempty"`
+	Revoked    bool     `json:"Revoked"`
+}
+
+// NewAPIKey is a key as returned when it is created, the only time the
+// full key is shown
+type NewAPIKey struct {
+	APIKey
+	Key string `json:"Key"`
+}
+
+// API key scopes, read allows GET requests, write everything else and keys
+// managing the API keys of the user
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+	ScopeKeys  = "keys"
+)
+
+var allScopes = []string{ScopeRead, ScopeWrite, ScopeKeys}
+
+// scopes of a key created with a password or session token without Scopes
+var defaultKeyScopes = []string{ScopeRead, ScopeWrite}
+
+// Admins are the usernames allowed to use admin endpoints like the audit log,
+// configured with NEVERNOTE_ADMINS
+var Admins = map[string]bool{}
+
+const apiKeyPrefix = "nn"
+
+const minPasswordLength = 8
+
+type accountStore struct {
+	mu    sync.Mutex
+	users map[string]*User
+	keys  map[string]*APIKey
+}
+
+// Accounts holds every user and their API keys
+var Accounts = newAccountStore()
+
+var (
+	errInvalidCredentials = errors.New("unauthorized: invalid credentials")
+	errUserExists         = errors.New("user already exists")
+)
+
+func newAccountStore() *accountStore {
+	return &accountStore{
+		users: make(map[string]*User),
+		keys:  make(map[string]*APIKey),
+	}
+}
+
+func parseAdmins(config string) map[string]bool {
+	/**
+	Function: parseAdmins
+	Description: Parse a comma separated list of admin usernames
+	*/
+	admins := make(map[string]bool)
+	for _, username := range strings.Split(config, ",") {
+		if username = strings.TrimSpace(username); username != "" {
+			admins[username] = true
+		}
+	}
+	return admins
+}
+
+func (store *accountStore) createUser(username string, password string) (User, error) {
+	/**
+	Function: createUser
+	Description: Add a user with a bcrypt hashed password
+	*/
+	if username == "" || strings.ContainsAny(username, ": /") {
+		return User{}, errors.New("Username must not be empty or contain spaces, slashes or colons")
+	}
+	if len(password) < minPasswordLength {
+		return User{}, errors.New("Password must be at least 8 characters")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return User{}, err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.users[username] != nil {
+		return User{}, errUserExists
+	}
+	user := &User{
+		Username:     username,
+		PasswordHash: hash,
+		Created:      time.Now().Format("2006.01.02 15:04:05"),
+	}
+	store.users[username] = user
+	return *user, nil
+}
+
+func (store *accountStore) checkPassword(username string, password string) (User, error) {
+	/**
+	Function: checkPassword
+	Description: Find a user by username and password
+	*/
+	store.mu.Lock()
+	user := store.users[username]
+	store.mu.Unlock()
+
+	if user == nil {
+		// spend the same time as a wrong password so usernames can't be probed
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return User{}, errInvalidCredentials
+	}
+	if bcrypt.CompareHashAndPassword(user.PasswordHash, []byte(password)) != nil {
+		return User{}, errInvalidCredentials
+	}
+	return *user, nil
+}
+
+func (store *accountStore) user(username string) (User, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	user := store.users[username]
+	if user == nil {
+		return User{}, false
+	}
+	return *user, true
+}
+
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("nevernote"), bcrypt.DefaultCost)
+
+func hashSecret(secret string) []byte {
+	sum := sha256.Sum256([]byte(secret))
+	return sum[:]
+}
+
+func (store *accountStore) createKey(username string, name string, scopes []string) (APIKey, string, error) {
+	/**
+	Function: createKey
+	Description: Issue an API key for a user, returning the metadata and the full key
+	*/
+	for _, scope := range scopes {
+		if !isSubset([]string{scope}, allScopes) {
+			return APIKey{}, "", errors.New("Unsupported scope \"" + scope + "\"")
+		}
+	}
+	if len(scopes) == 0 {
+		scopes = defaultKeyScopes
+	}
+
+	id := make([]byte, 6)
+	secret := make([]byte, 24)
+	if _, err := rand.Read(id); err != nil {
+		return APIKey{}, "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return APIKey{}, "", err
+	}
+	keyId := hex.EncodeToString(id)
+	secretString := base64.RawURLEncoding.EncodeToString(secret)
+
+	key := &APIKey{
+		Id:         keyId,
+		Name:       name,
+		Username:   username,
+		Scopes:     uniqueTags(scopes),
+		SecretHash: hashSecret(secretString),
+		Created:    time.Now().Format("2006.01.02 15:04:05"),
+	}
+
+	store.mu.Lock()
+	store.keys[keyId] = key
+	store.mu.Unlock()
+
+	return *key, apiKeyPrefix + "_" + keyId + "_" + secretString, nil
+}
+
+func (store *accountStore) checkKey(token string) (User, APIKey, error) {
+	/**
+	Function: checkKey
+	Description: Find the user and key for a full API key
+	*/
+	parts := strings.SplitN(token, "_", 3)
+	if len(parts) != 3 || parts[0] != apiKeyPrefix {
+		return User{}, APIKey{}, errInvalidCredentials
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	key := store.keys[parts[1]]
+	if key == nil || key.Revoked || subtle.ConstantTimeCompare(key.SecretHash, hashSecret(parts[2])) != 1 {
+		return User{}, APIKey{}, errInvalidCredentials
+	}
+	user := store.users[key.Username]
+	if user == nil {
+		return User{}, APIKey{}, errInvalidCredentials
+	}
+	key.LastUsed = time.Now().Format("2006.01.02 15:04:05")
+	return *user, *key, nil
+}
+
+func (store *accountStore) listKeys(username string) []APIKey {
+	/**
+	Function: listKeys
+	Description: API keys of a user, oldest first
+	*/
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	keys := []APIKey{}
+	for _, key := range store.keys {
+		if key.Username == username {
+			keys = append(keys, *key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Created != keys[j].Created {
+			return keys[i].Created < keys[j].Created
+		}
+		return keys[i].Id < keys[j].Id
+	})
+	return keys
+}
+
+func (store *accountStore) revokeKey(username string, keyId string) (APIKey, bool) {
+	/**
+	Function: revokeKey
+	Description: Revoke an API key of a user
+	*/
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	key := store.keys[keyId]
+	if key == nil || key.Username != username {
+		return APIKey{}, false
+	}
+	key.Revoked = true
+	return *key, true
+}
+
+// Principal is who a request was authenticated as
+type Principal struct {
+	User User
+	// Key is set when the request used an API key
+	Key *APIKey
+	// Session is set when the request used a session access token
+	Session *sessionClaims
+}
+
+func (p Principal) hasScope(scope string) bool {
+	if p.Key == nil {
+		return true
+	}
+	return isSubset([]string{scope}, p.Key.Scopes)
+}
+
+type contextKey string
+
+const principalContextKey = contextKey("principal")
+
+func currentPrincipal(r *http.Request) (Principal, bool) {
+	/**
+	Function: currentPrincipal
+	Description: Who the request was authenticated as
+	*/
+	principal, ok := r.Context().Value(principalContextKey).(Principal)
+	return principal, ok
+}
+
+func withPrincipal(r *http.Request, principal Principal) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalContextKey, principal))
+}
+
+// routes that can be used without credentials
+var publicRoutes = map[string]bool{
+	"/healthcheck": true,
+	"/livez":       true,
+	"/readyz":      true,
+	"/metrics":     true,
+	"/createUser":  true,
+	"/login":       true,
+	"/refresh":     true,
+	// the documentation of the API
+	"/openapi.json": true,
+	"/docs":         true,
+	// public links carry their own signed token
+	"/public/{token}": true,
+}
+
+func requiredScope(r *http.Request) string {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return ScopeRead
+	}
+	return ScopeWrite
+}
+
+func authenticateRequest(r *http.Request) (Principal, error) {
+	/**
+	Function: authenticateRequest
+	Description: Check the API key (Authorization: Bearer or X-API-Key), session
+	             access token (Authorization: Bearer), password (Authorization: Basic)
+	             or TLS client certificate of a request
+	*/
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		user, apiKey, err := Accounts.checkKey(key)
+		return Principal{User: user, Key: &apiKey}, err
+	}
+
+	authorization := r.Header.Get("Authorization")
+	if token, found := strings.CutPrefix(authorization, "Bearer "); found {
+		token = strings.TrimSpace(token)
+		if strings.HasPrefix(token, apiKeyPrefix+"_") {
+			user, apiKey, err := Accounts.checkKey(token)
+			return Principal{User: user, Key: &apiKey}, err
+		}
+		return authenticateToken(token)
+	}
+	if username, password, ok := r.BasicAuth(); ok {
+		user, err := Accounts.checkPassword(username, password)
+		return Principal{User: user}, err
+	}
+	if user, found, err := clientCertificateUser(r); found {
+		return Principal{User: user}, err
+	}
+	return Principal{}, errors.New("unauthorized: credentials required")
+}
+
+func returnUnauthorized(w http.ResponseWriter, err string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="nevernote", Basic realm="nevernote"`)
+	returnStatusError(w, http.StatusUnauthorized, err)
+}
+
+func authenticate(next http.Handler) http.Handler {
+	/**
+	Function: authenticate
+	Description: Middleware rejecting requests without valid credentials (401) or
+	             with an API key missing the scope for the request (403)
+	*/
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil {
+			if template, err := route.GetPathTemplate(); err == nil && publicRoutes[template] {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		// clients sending wrong credentials again and again are slowed down
+		failedAuth := failedAuthKey(r)
+		if failedAuthLimited(w, failedAuth) {
+			return
+		}
+
+		principal, err := authenticateRequest(r)
+		if err != nil {
+			if r.Header.Get("Authorization") != "" || r.Header.Get("X-API-Key") != "" {
+				recordFailedAuth(failedAuth)
+			}
+			returnUnauthorized(w, err.Error())
+			return
+		}
+		logRequestUser(r, principal.User.Username)
+		if scope := requiredScope(r); !principal.hasScope(scope) {
+			returnStatusError(w, http.StatusForbidden, "forbidden: API key is missing the \""+scope+"\" scope")
+			return
+		}
+
+		next.ServeHTTP(w, withPrincipal(r, principal))
+	})
+}
+
+func createUser(w http.ResponseWriter, r *http.Request) {
+	/**
+	Function: createUser
+	Description: Register a new user account
+	*/
+	reqBody, _ := ioutil.ReadAll(r.Body)
+	var request struct {
+		Username string `json:"Username"`
+		Password string `json:"Password"`
+	}
+	json.Unmarshal(reqBody, &request)
+
+	user, err := Accounts.createUser(request.Username, request.Password)
+	if err == errUserExists {
+		returnStatusError(w, http.StatusConflict, "User \""+request.Username+"\" already exists")
+		return
+	}
+	if err != nil {
+		returnStatusError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	audit(r, AuditEvent{Actor: user.Username, Action: AuditUserCreate, Target: user.Username}, nil, user)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(user)
+}
+
+func keyManager(w http.ResponseWriter, r *http.Request) (Principal, bool) {
+	/**
+	Function: keyManager
+	Description: The principal of a request allowed to manage API keys
+	*/
+	principal, ok := currentPrincipal(r)
+	if !ok {
+		returnUnauthorized(w, "unauthorized: credentials required")
+		return Principal{}, false
+	}
+	if !principal.hasScope(ScopeKeys) {
+		returnStatusError(w, http.StatusForbidden, "forbidden: API key is missing the \""+ScopeKeys+"\" scope")
+		return Principal{}, false
+	}
+	return principal, true
+}
+
+func createApiKey(w http.ResponseWriter, r *http.Request) {
+	/**
+	Function: createApiKey
+	Description: Issue a new API key for the current user, the key is only shown once
+	*/
+	principal, ok := keyManager(w, r)
+	if !ok {
+		return
+	}
+
+	reqBody, _ := ioutil.ReadAll(r.Body)
+	var request struct {
+		Name   string   `json:"Name"`
+		Scopes []string `json:"Scopes"`
+	}
+	json.Unmarshal(reqBody, &request)
+	if request.Name == "" {
+		returnStatusError(w, http.StatusBadRequest, "Need Name to create API key")
+		return
+	}
+	// without Scopes a key gets the scopes of the key used to create it, and
+	// never more than those
+	if len(request.Scopes) == 0 {
+		request.Scopes = defaultKeyScopes
+		if principal.Key != nil {
+			request.Scopes = principal.Key.Scopes
+		}
+	}
+	if principal.Key != nil && !isSubset(request.Scopes, principal.Key.Scopes) {
+		returnStatusError(w, http.StatusForbidden, "forbidden: cannot grant scopes the current API key does not have")
+		return
+	}
+
+	key, token, err := Accounts.createKey(principal.User.Username, request.Name, request.Scopes)
+	if err != nil {
+		returnStatusError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	audit(r, AuditEvent{Action: AuditApiKeyCreate, Target: key.Id}, nil, key)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(NewAPIKey{key, token})
+}
+
+func listApiKeys(w http.ResponseWriter, r *http.Request) {
+	/**
+	Function: listApiKeys
+	Description: List the API keys of the current user
+	*/
+	principal, ok := keyManager(w, r)
+	if !ok {
+		return
+	}
+	json.NewEncoder(w).Encode(Accounts.listKeys(principal.User.Username))
+}
+
+func revokeApiKey(w http.ResponseWriter, r *http.Request) {
+	/**
+	Function: revokeApiKey
+	Description: Revoke an API key of the current user
+	*/
+	principal, ok := keyManager(w, r)
+	if !ok {
+		return
+	}
+
+	keyId := mux.Vars(r)["keyId"]
+	key, found := Accounts.revokeKey(principal.User.Username, keyId)
+	if !found {
+		returnStatusError(w, http.StatusNotFound, "API key with id \""+keyId+"\" does not exist")
+		return
+	}
+	audit(r, AuditEvent{Action: AuditApiKeyRevoke, Target: key.Id}, nil, key)
+
+	json.NewEncoder(w).Encode(key)
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type Attachment struct {
+	Id           string            `json:"Id"`
+	Filename     string            `json:"Filename"`
+	ContentType  string            `json:"ContentType"`
+	DetectedType string            `json:"DetectedType,omitempty"`
+	Size         int64             `json:"Size"`
+	SHA256       string            `json:"SHA256"`
+	Width        int               `json:"Width,omitempty"`
+	Height       int               `json:"Height,omitempty"`
+	Thumbnails   map[string]string `json:"Thumbnails,omitempty"`
+	Created      string            `json:"Created"`
+}
+
+// attachmentIdCounter is only used with notebooksMu held for writing
+var attachmentIdCounter int
+
+// BlobCollection is the result of a garbage collection of the blob store
+type BlobCollection struct {
+	Removed    int   `json:"Removed"`
+	FreedBytes int64 `json:"FreedBytes"`
+}
+
+// blobs younger than this are never garbage collected, they may belong to
+// an upload that has not been added to its note yet
+const blobGracePeriod = time.Hour
+
+func findNoteIndex(notebooks map[string][]Note, title string, noteId string) (int, bool) {
+	/**
+	Function: findNoteIndex
+	Description: Position of a note (based on id) in a notebook
+	*/
+	for i, note := range notebooks[title] {
+		if note.Id == noteId {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func newAttachment(ctx context.Context, filename string, contentType string, sum string, size int64) Attachment {
+	/**
+	Function: newAttachment
+	Description: Attachment metadata for a stored blob, with thumbnails for images. The
+	             id is given by nextAttachmentId once the note is locked
+	*/
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(filename))
+	}
+
+	attachment := Attachment{
+		Filename:    filename,
+		ContentType: contentType,
+		Size:        size,
+		SHA256:      sum,
+		Created:     time.Now().Format("2006.01.02 15:04:05"),
+	}
+
+	// the attachment is still usable without thumbnails
+	if err := inspectAttachment(ctx, &attachment); err != nil {
+		Logger.Warn("could not inspect attachment", "filename", attachment.Filename, "error", err)
+	}
+	if attachment.ContentType == "" {
+		attachment.ContentType = "application/octet-stream"
+	}
+	return attachment
+}
+
+func nextAttachmentId() string {
+	/**
+	Function: nextAttachmentId
+	Description: A new attachment id, the caller holds notebooksMu for writing
+	*/
+	id := strconv.Itoa(attachmentIdCounter)
+	attachmentIdCounter++
+	return id
+}
+
+func addAttachments(w http.ResponseWriter, r *http.Request) {
+	/**
+	Function: addAttachments
+	Description: Attach the files of a multipart upload to a note (based on id) in a notebook
+	*/
+	vars := mux.Vars(r)
+	title := vars["title"]
+	noteId := vars["noteId"]
+
+	// the notebooks are only locked before and after the files are streamed
+	owner, remaining, ok := attachmentTarget(w, r, title, noteId)
+	if !ok {
+		return
+	}
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		returnError(w, "Need multipart/form-data to add attachments")
+		return
+	}
+
+	// stream every file part straight into the blob store, stopping once
+	// the attachment quota of the owner is used up
+	var attachments []Attachment
+	limited := &quotaReader{remaining: remaining}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			returnError(w, "Could not read upload: "+err.Error())
+			return
+		}
+		if part.FileName() == "" {
+			continue
+		}
+
+		limited.r = part
+		sum, size, err := Blobs.put(r.Context(), limited)
+		if errors.Is(err, errQuotaExceeded) {
+			returnAttachmentQuotaExceeded(w)
+			return
+		}
+		if err != nil {
+			returnError(w, "Could not store \""+part.FileName()+"\": "+err.Error())
+			return
+		}
+		attachments = append(attachments, newAttachment(r.Context(), filepath.Base(part.FileName()), part.Header.Get("Content-Type"), sum, size))
+	}
+
+	if len(attachments) == 0 {
+		returnError(w, "Need at least one file to add attachments")
+		return
+	}
+
+	// the notebook may have changed while the upload was streaming
+	notebooksMu.Lock()
+	defer notebooksMu.Unlock()
+	notebooks := Notebooks[owner]
+	i, found := findNoteIndex(notebooks, title, noteId)
+	if !found {
+		returnError(w, "Note with id \""+noteId+"\" does not exist")
+		return
+	}
+	// other uploads to the owner may have used up the quota in the meantime
+	var size int64
+	for _, attachment := range attachments {
+		size += attachment.Size
+	}
+	if !fitsAttachmentQuota(owner, size) {
+		returnAttachmentQuotaExceeded(w)
+		return
+	}
+	for j := range attachments {
+		attachments[j].Id = nextAttachmentId()
+	}
+	note := &notebooks[title][i]
+	before := *note
+	note.Attachments = append(note.Attachments, attachments...)
+	note.LastModified = time.Now().Format("2006.01.02 15:04:05")
+	for _, attachment := range attachments {
+		audit(r, AuditEvent{Action: AuditAttachmentAdd, Owner: owner, Notebook: title, NoteId: noteId, Target: attachment.Id}, before, *note)
+	}
+
+	json.NewEncoder(w).Encode(note)
+}
+
+func attachmentTarget(w http.ResponseWriter, r *http.Request, title string, noteId string) (string, int64, bool) {
+	/**
+	Function: attachmentTarget
+	Description: Check that the note attachments are added to exists, returning its owner
+	             and how many attachment bytes the owner can still store
+	*/
+	notebooksMu.Lock()
+	defer notebooksMu.Unlock()
+	owner, notebooks, ok := ownerNotebooks(w, r, RoleEditor)
+	if !ok {
+		return "", 0, false
+	}
+	if notebooks[title] == nil {
+		returnError(w, "Notebook \""+title+"\" does not exist")
+		return "", 0, false
+	}
+	if _, found := findNoteIndex(notebooks, title, noteId); !found {
+		returnError(w, "Note with id \""+noteId+"\" does not exist")
+		return "", 0, false
+	}
+	return owner, remainingAttachmentBytes(owner), true
+}
+
+func downloadAttachment(w http.ResponseWriter, r *http.Request) {
+	/**
+	Function: downloadAttachment
+	Description: Stream an attachment of a note, supporting Range requests
+	*/
+	vars := mux.Vars(r)
+	attachmentId := vars["attachmentId"]
+
+	attachment, ok := readAttachment(w, r, vars["title"], vars["noteId"], attachmentId)
+	if !ok {
+		return
+	}
+
+	blob, err := Blobs.open(r.Context(), attachment.SHA256)
+	if err != nil {
+		returnError(w, "Could not open attachment \""+attachmentId+"\": "+err.Error())
+		return
+	}
+	defer blob.Close()
+
+	info, err := blob.Stat()
+	if err != nil {
+		returnError(w, "Could not open attachment \""+attachmentId+"\": "+err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", attachment.ContentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename}))
+	w.Header().Set("ETag", "\""+attachment.SHA256+"\"")
+	http.ServeContent(w, r, attachment.Filename, info.ModTime(), blob)
+}
+
+func deleteAttachment(w http.ResponseWriter, r *http.Request) {
+	/**
+	Function: deleteAttachment
+	Description: Remove an attachment from a note, its contents are garbage collected later
+	*/
+	owner, notebooks, ok := ownerNotebooks(w, r, RoleEditor)
+	if !ok {
+		return
+	}
+
+	vars := mux.Vars(r)
+	title := vars["title"]
+	noteId := vars["noteId"]
+	attachmentId := vars["attachmentId"]
+
+	if _, ok := lookupAttachment(w, notebooks, title, noteId, attachmentId); !ok {
+		return
+	}
+
+	i, _ := findNoteIndex(notebooks, title, noteId)
+	note := &notebooks[title][i]
+	before := *note
+	for j, attachment := range note.Attachments {
+		if attachment.Id == attachmentId {
+			// copy so the audited note before the change keeps its attachments
+			note.Attachments = append(append([]Attachment(nil), note.Attachments[:j]...), note.Attachments[j+1:]...)
+			break
+		}
+	}
+	note.LastModified = time.Now().Format("2006.01.02 15:04:05")
+	audit(r, AuditEvent{Action: AuditAttachmentDelete, Owner: owner, Notebook: title, NoteId: noteId, Target: attachmentId}, before, *note)
+
+	json.NewEncoder(w).Encode(note)
+}
+
+func readAttachment(w http.ResponseWriter, r *http.Request, title string, noteId string, attachmentId string) (Attachment, bool) {
+	/**
+	Function: readAttachment
+	Description: Find an attachment the user may read, holding the read lock of the
+	             notebooks only while looking it up
+	*/
+	notebooksMu.RLock()
+	defer notebooksMu.RUnlock()
+	_, notebooks, ok := ownerNotebooks(w, r, RoleViewer)
+	if !ok {
+		return Attachment{}, false
+	}
+	return lookupAttachment(w, notebooks, title, noteId, attachmentId)
+}
+
+func lookupAttachment(w http.ResponseWriter, notebooks map[string][]Note, title string, noteId string, attachmentId string) (Attachment, bool) {
+	/**
+	Function: lookupAttachment
+	Description: Find an attachment of a note, writing an error if it does not exist
+	*/
+	if notebooks[title] == nil {
+		returnError(w, "Notebook \""+title+"\" does not exist")
+		return Attachment{}, false
+	}
+	i, found := findNoteIndex(notebooks, title, noteId)
+	if !found {
+		returnError(w, "Note with id \""+noteId+"\" does not exist")
+		return Attachment{}, false
+	}
+	for _, attachment := range notebooks[title][i].Attachments {
+		if attachment.Id == attachmentId {
+			return attachment, true
+		}
+	}
+	returnError(w, "Attachment with id \""+attachmentId+"\" does not exist")
+	return Attachment{}, false
+}
+
+func referencedBlobs() map[string]bool {
+	/**
+	Function: referencedBlobs
+	Description: Checksums of every blob attached to a note of any user
+	*/
+	referenced := make(map[string]bool)
+	for _, notebooks := range Notebooks {
+		for _, notebook := range notebooks {
+			for _, note := range notebook {
+				for _, attachment := range note.Attachments {
+					referenced[attachment.SHA256] = true
+					for _, sum := range attachment.Thumbnails {
+						referenced[sum] = true
+					}
+				}
+			}
+		}
+	}
+	return referenced
+}
+
+func collectBlobs(w http.ResponseWriter, r *http.Request) {
+	/**
+	Function: collectBlobs
+	Description: Delete stored blobs that are no longer attached to any note (admins only)
+	*/
+	if !Admins[requestUsername(r)] {
+		returnError(w, "forbidden: only admins can collect blobs")
+		return
+	}
+
+	removed, freed, err := Blobs.collect(referencedBlobs(), blobGracePeriod)
+	if err != nil {
+		returnError(w, "Could not collect blobs: "+err.Error())
+		return
+	}
+	audit(r, AuditEvent{Action: AuditBlobsCollect, Target: strconv.Itoa(removed) + " blobs"}, nil, nil)
+
+	json.NewEncoder(w).Encode(BlobCollection{removed, freed})
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// AuditEvent records one change made through the API. Events are chained:
+// the Hash of every event covers the event and the Hash of the event before
+// it, so removing or editing events in the log file can be detected.
+type AuditEvent struct {
+	Id         int64  `json:"Id"`
+	Time       string `json:"Time"`
+	Actor      string `json:"Actor"`
+	Action     string `json:"Action"`
+	Owner      string `json:"Owner,omitempty"`
+	Notebook   string `json:"Notebook,omitempty"`
+	NoteId     string `json:"NoteId,omitempty"`
+	Target     string `json:"Target,omitempty"`
+	BeforeHash string `json:"BeforeHash,omitempty"`
+	AfterHash  string `json:"AfterHash,omitempty"`
+	ClientIP   string `json:"ClientIP"`
+	RequestId  string `json:"RequestId,omitempty"`
+	Hash       string `json:"Hash"`
+}
+
+// audited actions
+const (
+	AuditNotebookCreate   = "notebook.create"
+	AuditNotebookDelete   = "notebook.delete"
+	AuditNoteCreate       = "note.create"
+	AuditNoteUpdate       = "note.update"
+	AuditNoteDelete       = "note.delete"
+	AuditNoteRewriteLinks = "note.rewriteLinks"
+	AuditAttachmentAdd    = "attachment.add"
+	AuditAttachmentDelete = "attachment.delete"
+	AuditCommentAdd       = "comment.add"
+	AuditShareCreate      = "share.create"
+	AuditShareUpdate      = "share.update"
+	AuditShareRevoke      = "share.revoke"
+	AuditPublicLinkCreate = "publicLink.create"
+	AuditPublicLinkRevoke = "publicLink.revoke"
+	AuditUserCreate       = "user.create"
+	AuditApiKeyCreate     = "apiKey.create"
+	AuditApiKeyRevoke     = "apiKey.revoke"
+	AuditBlobsCollect     = "blobs.collect"
+)
+
+const defaultAuditQueryLimit = 100
+
+type auditLog struct {
+	mu     sync.Mutex
+	events []AuditEvent
+	file   *os.File
+	// error of the last write to file, cleared by the next successful one
+	writeErr error
+}
+
+// Audit is the append only log of every change, kept in memory and, when
+// opened with openAuditLog, in a JSON Lines file
+var Audit = &auditLog{}
+
+// the audit log is kept in this file of the storage path
+const auditPath = "audit.log"
+
+func openAuditLog(path string) (*auditLog, error) {
+	/**
+	Function: openAuditLog
+	Description: Load the events of an audit log file and append new events to it
+	*/
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &auditLog{file: file}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var event AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			file.Close()
+			return nil, errors.New("audit log " + path + " is corrupt at event " + strconv.Itoa(len(store.events)+1) + ": " + err.Error())
+		}
+		store.events = append(store.events, event)
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := store.verify(); err != nil {
+		file.Close()
+		return nil, errors.New("audit log " + path + ": " + err.Error())
+	}
+	return store, nil
+}
+
+func auditEventHash(previous string, event AuditEvent) string {
+	event.Hash = ""
+	encoded, _ := json.Marshal(event)
+	sum := sha256.Sum256(append([]byte(previous), encoded...))
+	return hex.EncodeToString(sum[:])
+}
+
+func (store *auditLog) verify() error {
+	/**
+	Function: verify
+	Description: Check that no event was changed, removed or reordered
+	*/
+	previous := ""
+	for i, event := range store.events {
+		if event.Hash != auditEventHash(previous, event) {
+			return errors.New("hash chain is broken at event " + strconv.FormatInt(event.Id, 10) + " (line " + strconv.Itoa(i+1) + ")")
+		}
+		previous = event.Hash
+	}
+	return nil
+}
+
+func (store *auditLog) append(event AuditEvent) error {
+	/**
+	Function: append
+	Description: Number, chain and store a new event
+	*/
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	previous := ""
+	if len(store.events) > 0 {
+		last := store.events[len(store.events)-1]
+		event.Id = last.Id + 1
+		previous = last.Hash
+	} else {
+		event.Id = 1
+	}
+	event.Hash = auditEventHash(previous, event)
+
+	if store.file != nil {
+		encoded, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if _, err := store.file.Write(append(encoded, '\n')); err != nil {
+			store.writeErr = err
+			return err
+		}
+		store.writeErr = nil
+	}
+	store.events = append(store.events, event)
+	return nil
+}
+
+func (store *auditLog) close() error {
+	/**
+	Function: close
+	Description: Flush the log file to disk and close it, events are only kept in memory afterwards
+	*/
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.file == nil {
+		return nil
+	}
+	file := store.file
+	store.file = nil
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (store *auditLog) length() int {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return len(store.events)
+}
+
+func (store *auditLog) writable() error {
+	/**
+	Function: writable
+	Description: Check that the last event was written and that the open file can still be
+	             synced, a file removed or on a failing disk still answers Stat
+	*/
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.file == nil {
+		return errors.New("audit log file is not open")
+	}
+	if store.writeErr != nil {
+		return errors.New("last write failed: " + store.writeErr.Error())
+	}
+	return store.file.Sync()
+}
+
+// AuditFilter selects events, empty fields match everything
+type AuditFilter struct {
+	Actor    string
+	Action   string
+	Owner    string
+	Notebook string
+	NoteId   string
+	Since    string
+	Until    string
+}
+
+func (filter AuditFilter) matches(event AuditEvent) bool {
+	return (filter.Actor == "" || event.Actor == filter.Actor) &&
+		(filter.Action == "" || event.Action == filter.Action) &&
+		(filter.Owner == "" || event.Owner == filter.Owner) &&
+		(filter.Notebook == "" || event.Notebook == filter.Notebook) &&
+		(filter.NoteId == "" || event.NoteId == filter.NoteId) &&
+		(filter.Since == "" || event.Time >= filter.Since) &&
+		(filter.Until == "" || event.Time <= filter.Until)
+}
+
+func (store *auditLog) query(filter AuditFilter, limit int) []AuditEvent {
+	/**
+	Function: query
+	Description: The most recent matching events, oldest first, all of them when limit is 0
+	*/
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	events := []AuditEvent{}
+	for i := len(store.events) - 1; i >= 0 && (limit == 0 || len(events) < limit); i-- {
+		if filter.matches(store.events[i]) {
+			events = append(events, store.events[i])
+		}
+	}
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	return events
+}
+
+func auditHash(value interface{}) string {
+	/**
+	Function: auditHash
+	Description: SHA-256 of the JSON of a note, notebook or other audited value, "" for nil
+	*/
+	if value == nil {
+		return ""
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:])
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func audit(r *http.Request, event AuditEvent, before interface{}, after interface{}) {
+	/**
+	Function: audit
+	Description: Record a change made by a request. The actor, time, client and
+	             request id come from the request, before and after are hashed
+	*/
+	if event.Actor == "" {
+		event.Actor = requestUsername(r)
+	}
+	event.Time = time.Now().Format("2006.01.02 15:04:05")
+	event.ClientIP = clientIP(r)
+	event.RequestId = r.Header.Get(requestIdHeader)
+	event.BeforeHash = auditHash(before)
+	event.AfterHash = auditHash(after)
+
+	_, span := startSpan(r.Context(), "store.audit.append", attribute.String("nevernote.audit_action", event.Action))
+	err := Audit.append(event)
+	endSpan(span, err)
+	// the change already happened, losing the event must not fail the request
+	if err != nil {
+		requestLogger(r).Error("could not write audit event", "action", event.Action, "error", err)
+	}
+}
+
+func auditLogEvents(w http.ResponseWriter, r *http.Request) {
+	/**
+	Function: auditLogEvents
+	Description: Query the audit log (admins only), as JSON or ?format=jsonl to export it
+	*/
+	username := requestUsername(r)
+	if !Admins[username] {
+		returnError(w, "forbidden: only admins can read the audit log")
+		return
+	}
+
+	query := r.URL.Query()
+	filter := AuditFilter{
+		Actor:    query.Get("actor"),
+		Action:   query.Get("action"),
+		Owner:    query.Get("owner"),
+		Notebook: query.Get("notebook"),
+		NoteId:   query.Get("noteId"),
+		Since:    query.Get("since"),
+		Until:    query.Get("until"),
+	}
+
+	format := query.Get("format")
+	if format != "" && format != "json" && format != "jsonl" {
+		returnStatusError(w, http.StatusBadRequest, "Unsupported format \""+format+"\", use json or jsonl")
+		return
+	}
+
+	// exports contain every matching event unless a limit is given
+	limit := defaultAuditQueryLimit
+	if format == "jsonl" {
+		limit = 0
+	}
+	if query.Get("limit") != "" {
+		parsed, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || parsed <= 0 {
+			returnStatusError(w, http.StatusBadRequest, "Invalid limit \""+query.Get("limit")+"\"")
+			return
+		}
+		limit = parsed
+	}
+
+	events := Audit.query(filter, limit)
+	if format == "jsonl" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"audit-"+strings.ReplaceAll(time.Now().Format("2006.01.02"), ".", "-")+".jsonl\"")
+		encoder := json.NewEncoder(w)
+		for _, event := range events {
+			encoder.Encode(event)
+		}
+		return
+	}
+	json.NewEncoder(w).Encode(events)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// blobStore keeps attachment contents on disk addressed by their SHA-256,
+// so uploading the same file twice only stores it once
+type blobStore struct {
+	dir string
+}
+
+// Blobs is where attachment contents are stored
+var Blobs *blobStore
+
+// blobs are kept in this directory of the storage path
+const blobDir = "blobs"
+
+var errInvalidBlobSum = errors.New("invalid blob checksum")
+
+func newBlobStore(dir string) (*blobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &blobStore{dir: dir}, nil
+}
+
+func (store *blobStore) close() error {
+	/**
+	Function: close
+	Description: Remove the temporary files of puts cut off before they were stored
+	*/
+	temporary, err := filepath.Glob(filepath.Join(store.dir, ".upload-*"))
+	if err != nil {
+		return err
+	}
+	for _, path := range temporary {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func validBlobSum(sum string) bool {
+	if len(sum) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(sum)
+	return err == nil
+}
+
+func (store *blobStore) path(sum string) string {
+	// spread blobs over subdirectories so no directory gets too large
+	return filepath.Join(store.dir, sum[:2], sum)
+}
+
+func (store *blobStore) put(ctx context.Context, r io.Reader) (sum string, size int64, err error) {
+	/**
+	Function: put
+	Description: Store the contents of r, returning their SHA-256 and size
+	*/
+	_, span := startSpan(ctx, "blobs.put")
+	defer func() {
+		span.SetAttributes(attribute.String("blob.sha256", sum), attribute.Int64("blob.size", size))
+		endSpan(span, err)
+	}()
+
+	tmp, err := ioutil.TempFile(store.dir, ".upload-")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	size, err = io.Copy(io.MultiWriter(tmp, hash), r)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", 0, err
+	}
+
+	sum = hex.EncodeToString(hash.Sum(nil))
+	return sum, size, store.link(tmp.Name(), sum)
+}
+
+func (store *blobStore) adopt(ctx context.Context, path string, expectedSum string) (_ string, err error) {
+	/**
+	Function: adopt
+	Description: Move a file into the store if its SHA-256 matches expectedSum
+	*/
+	_, span := startSpan(ctx, "blobs.adopt", attribute.String("blob.sha256", expectedSum))
+	defer func() { endSpan(span, err) }()
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	file.Close()
+	if err != nil {
+		return "", err
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if sum != expectedSum {
+		return "", errors.New("checksum mismatch, got " + sum)
+	}
+	return sum, store.link(path, sum)
+}
+
+func (store *blobStore) link(tmpPath string, sum string) error {
+	/**
+	Function: link
+	Description: Move a fully written file into the store under its checksum
+	*/
+	path := store.path(sum)
+	if _, err := os.Stat(path); err == nil {
+		// already stored, refresh the timestamp so garbage collection
+		// does not remove it before the new reference is saved
+		now := time.Now()
+		return os.Chtimes(path, now, now)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func (store *blobStore) open(ctx context.Context, sum string) (_ *os.File, err error) {
+	/**
+	Function: open
+	Description: Open a stored blob for reading
+	*/
+	_, span := startSpan(ctx, "blobs.open", attribute.String("blob.sha256", sum))
+	defer func() { endSpan(span, err) }()
+
+	if !validBlobSum(sum) {
+		return nil, errInvalidBlobSum
+	}
+	return os.Open(store.path(sum))
+}
+
+func (store *blobStore) exists(sum string) bool {
+	if !validBlobSum(sum) {
+		return false
+	}
+	_, err := os.Stat(store.path(sum))
+	return err == nil
+}
+
+func (store *blobStore) collect(referenced map[string]bool, minAge time.Duration) (int, int64, error) {
+	/**
+	Function: collect
+	Description: Delete blobs that are not referenced and older than minAge,
+	             returning the number of blobs removed and bytes freed
+	*/
+	removed := 0
+	var freed int64
+	cutoff := time.Now().Add(-minAge)
+
+	err := filepath.Walk(store.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !validBlobSum(info.Name()) {
+			return nil
+		}
+		if referenced[info.Name()] || info.ModTime().After(cutoff) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removed++
+		freed += info.Size()
+		return nil
+	})
+	return removed, freed, err
+}
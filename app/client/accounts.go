@@ -0,0 +1,101 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+func (c *Client) CreateUser(ctx context.Context, username string, password string) (User, error) {
+	/**
+	Function: CreateUser
+	Description: Register a user, needs no credentials unless the server restricts registration
+	*/
+	var user User
+	err := c.do(ctx, request{method: http.MethodPost, path: []string{"createUser"}, body: map[string]string{"Username": username, "Password": password}}, &user)
+	return user, err
+}
+
+func (c *Client) CreateAPIKey(ctx context.Context, name string, scopes ...string) (NewAPIKey, error) {
+	/**
+	Function: CreateAPIKey
+	Description: Issue an API key with scopes (every scope when none), the key is only returned once
+	*/
+	body := map[string]interface{}{"Name": name}
+	if len(scopes) > 0 {
+		body["Scopes"] = scopes
+	}
+	var key NewAPIKey
+	err := c.do(ctx, request{method: http.MethodPost, path: []string{"createApiKey"}, body: body}, &key)
+	return key, err
+}
+
+func (c *Client) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	var keys []APIKey
+	err := c.do(ctx, request{method: http.MethodGet, path: []string{"listApiKeys"}}, &keys)
+	return keys, err
+}
+
+func (c *Client) RevokeAPIKey(ctx context.Context, keyId string) (APIKey, error) {
+	var key APIKey
+	err := c.do(ctx, request{method: http.MethodDelete, path: []string{"revokeApiKey", keyId}}, &key)
+	return key, err
+}
+
+func (c *Client) Quota(ctx context.Context) (QuotaReport, error) {
+	var report QuotaReport
+	err := c.do(ctx, request{method: http.MethodGet, path: []string{"quota"}}, &report)
+	return report, err
+}
+
+func (c *Client) AuditLog(ctx context.Context, filter AuditFilter) ([]AuditEvent, error) {
+	/**
+	Function: AuditLog
+	Description: Query the audit log, admins only
+	*/
+	values := url.Values{}
+	for key, value := range map[string]string{
+		"actor": filter.Actor, "action": filter.Action, "owner": filter.Owner, "notebook": filter.Notebook,
+		"noteId": filter.NoteId, "since": filter.Since, "until": filter.Until,
+	} {
+		if value != "" {
+			values.Set(key, value)
+		}
+	}
+	if filter.Limit > 0 {
+		values.Set("limit", strconv.Itoa(filter.Limit))
+	}
+	var events []AuditEvent
+	err := c.do(ctx, request{method: http.MethodGet, path: []string{"auditLog"}, query: values}, &events)
+	return events, err
+}
+
+func (c *Client) Login(ctx context.Context, username string, password string) (SessionTokens, error) {
+	/**
+	Function: Login
+	Description: Exchange a username and password for session tokens, use the access token
+	             with WithToken
+	*/
+	var tokens SessionTokens
+	err := c.do(ctx, request{method: http.MethodPost, path: []string{"login"}, body: map[string]string{"Username": username, "Password": password}}, &tokens)
+	return tokens, err
+}
+
+func (c *Client) Refresh(ctx context.Context, refreshToken string) (SessionTokens, error) {
+	var tokens SessionTokens
+	err := c.do(ctx, request{method: http.MethodPost, path: []string{"refresh"}, body: map[string]string{"RefreshToken": refreshToken}}, &tokens)
+	return tokens, err
+}
+
+func (c *Client) Logout(ctx context.Context, refreshToken string) error {
+	/**
+	Function: Logout
+	Description: Revoke the access token of the client and refreshToken if not empty
+	*/
+	body := map[string]string{}
+	if refreshToken != "" {
+		body["RefreshToken"] = refreshToken
+	}
+	return c.do(ctx, request{method: http.MethodPost, path: []string{"logout"}, body: body}, nil)
+}
@@ -0,0 +1,252 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// tus protocol version of the /uploads routes
+const tusVersion = "1.0.0"
+
+// DefaultChunkSize is the size of the chunks UploadAttachment sends
+const DefaultChunkSize = 4 << 20
+
+// File is one file for AddAttachments
+type File struct {
+	Filename string
+	// detected by the server when empty
+	ContentType string
+	Content     io.Reader
+}
+
+func (c *Client) AddAttachments(ctx context.Context, notebook string, id string, files ...File) (Note, error) {
+	/**
+	Function: AddAttachments
+	Description: Attach files to a note with one multipart upload, streamed without
+	             buffering. The request is not retried, use UploadAttachment for large files
+	*/
+	body, writer := io.Pipe()
+	form := multipart.NewWriter(writer)
+	go func() {
+		for _, file := range files {
+			header := textproto.MIMEHeader{}
+			header.Set("Content-Disposition", `form-data; name="files"; filename="`+escapeQuotes(file.Filename)+`"`)
+			if file.ContentType != "" {
+				header.Set("Content-Type", file.ContentType)
+			} else {
+				header.Set("Content-Type", "application/octet-stream")
+			}
+			part, err := form.CreatePart(header)
+			if err == nil {
+				_, err = io.Copy(part, file.Content)
+			}
+			if err != nil {
+				writer.CloseWithError(err)
+				return
+			}
+		}
+		writer.CloseWithError(form.Close())
+	}()
+
+	var note Note
+	err := c.do(ctx, request{method: http.MethodPost, path: []string{"addAttachments", notebook, id}, owner: true, rawBody: body, contentType: form.FormDataContentType()}, &note)
+	// stop the writer if the server answered before reading every file
+	body.Close()
+	return note, err
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+func escapeQuotes(s string) string {
+	return quoteEscaper.Replace(s)
+}
+
+func (c *Client) DownloadAttachment(ctx context.Context, notebook string, id string, attachmentId string) (io.ReadCloser, error) {
+	/**
+	Function: DownloadAttachment
+	Description: The content of an attachment, the caller closes it
+	*/
+	response, err := c.send(ctx, request{method: http.MethodGet, path: []string{"downloadAttachment", notebook, id, attachmentId}, owner: true, accept: "*/*"})
+	if err != nil {
+		return nil, err
+	}
+	return response.Body, nil
+}
+
+func (c *Client) AttachmentThumbnail(ctx context.Context, notebook string, id string, attachmentId string, size string) (io.ReadCloser, error) {
+	/**
+	Function: AttachmentThumbnail
+	Description: A thumbnail of an image attachment, size is small, medium or large
+	             (medium when empty). The caller closes it
+	*/
+	call := request{method: http.MethodGet, path: []string{"attachmentThumbnail", notebook, id, attachmentId}, owner: true, accept: "image/*"}
+	if size != "" {
+		call.query = url.Values{"size": {size}}
+	}
+	response, err := c.send(ctx, call)
+	if err != nil {
+		return nil, err
+	}
+	return response.Body, nil
+}
+
+func (c *Client) DeleteAttachment(ctx context.Context, notebook string, id string, attachmentId string) (Note, error) {
+	var note Note
+	err := c.do(ctx, request{method: http.MethodDelete, path: []string{"deleteAttachment", notebook, id, attachmentId}, owner: true}, &note)
+	return note, err
+}
+
+func (c *Client) CollectBlobs(ctx context.Context) (BlobCollection, error) {
+	var collection BlobCollection
+	err := c.do(ctx, request{method: http.MethodPost, path: []string{"collectBlobs"}}, &collection)
+	return collection, err
+}
+
+func (c *Client) CreateUpload(ctx context.Context, length int64, filename string, contentType string) (string, error) {
+	/**
+	Function: CreateUpload
+	Description: Start a resumable upload of length bytes, returning its id
+	*/
+	metadata := []string{"filename " + base64.StdEncoding.EncodeToString([]byte(filename))}
+	if contentType != "" {
+		metadata = append(metadata, "filetype "+base64.StdEncoding.EncodeToString([]byte(contentType)))
+	}
+	header := http.Header{}
+	header.Set("Tus-Resumable", tusVersion)
+	header.Set("Upload-Length", strconv.FormatInt(length, 10))
+	header.Set("Upload-Metadata", strings.Join(metadata, ","))
+
+	response, err := c.send(ctx, request{method: http.MethodPost, path: []string{"uploads"}, header: header})
+	if err != nil {
+		return "", err
+	}
+	response.Body.Close()
+	location := response.Header.Get("Location")
+	if location == "" {
+		return "", errors.New("nevernote: the server did not return the location of the upload")
+	}
+	return path.Base(location), nil
+}
+
+func (c *Client) UploadOffset(ctx context.Context, uploadId string) (int64, error) {
+	/**
+	Function: UploadOffset
+	Description: How many bytes of an upload the server has, where to resume from
+	*/
+	header := http.Header{}
+	header.Set("Tus-Resumable", tusVersion)
+	response, err := c.send(ctx, request{method: http.MethodHead, path: []string{"uploads", uploadId}, header: header})
+	if err != nil {
+		return 0, err
+	}
+	response.Body.Close()
+	return strconv.ParseInt(response.Header.Get("Upload-Offset"), 10, 64)
+}
+
+func (c *Client) UploadChunk(ctx context.Context, uploadId string, offset int64, chunk []byte) (int64, error) {
+	/**
+	Function: UploadChunk
+	Description: Send a chunk of an upload starting at offset, returning the new offset.
+	             The server checks the chunk against its SHA-256
+	*/
+	sum := sha256.Sum256(chunk)
+	header := http.Header{}
+	header.Set("Tus-Resumable", tusVersion)
+	header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	header.Set("Upload-Checksum", "sha256 "+base64.StdEncoding.EncodeToString(sum[:]))
+
+	response, err := c.send(ctx, request{method: http.MethodPatch, path: []string{"uploads", uploadId}, header: header, rawBody: bytes.NewReader(chunk), contentType: "application/offset+octet-stream"})
+	if err != nil {
+		return offset, err
+	}
+	response.Body.Close()
+	return strconv.ParseInt(response.Header.Get("Upload-Offset"), 10, 64)
+}
+
+func (c *Client) DeleteUpload(ctx context.Context, uploadId string) error {
+	header := http.Header{}
+	header.Set("Tus-Resumable", tusVersion)
+	return c.do(ctx, request{method: http.MethodDelete, path: []string{"uploads", uploadId}, header: header}, nil)
+}
+
+func (c *Client) AttachUpload(ctx context.Context, notebook string, id string, uploadId string, checksum string) (Note, error) {
+	/**
+	Function: AttachUpload
+	Description: Attach a finished upload to a note, checksum is the hex SHA-256 of the whole file
+	*/
+	var note Note
+	err := c.do(ctx, request{method: http.MethodPost, path: []string{"attachUpload", notebook, id, uploadId}, owner: true, body: map[string]string{"SHA256": checksum}}, &note)
+	return note, err
+}
+
+func (c *Client) UploadAttachment(ctx context.Context, notebook string, id string, filename string, contentType string, content io.ReadSeeker) (Note, error) {
+	/**
+	Function: UploadAttachment
+	Description: Attach a file of any size with a resumable upload. Chunks that fail are
+	             resumed from the offset the server reports after the backoff of the client
+	             (or the Retry-After of the server), up to the retries of the client
+	*/
+	length, err := content.Seek(0, io.SeekEnd)
+	if err != nil {
+		return Note{}, err
+	}
+	uploadId, err := c.CreateUpload(ctx, length, filename, contentType)
+	if err != nil {
+		return Note{}, err
+	}
+
+	digest := sha256.New()
+	chunk := make([]byte, DefaultChunkSize)
+	offset, failures := int64(0), 0
+	for offset < length {
+		if _, err := content.Seek(offset, io.SeekStart); err != nil {
+			return Note{}, err
+		}
+		n, err := io.ReadFull(content, chunk)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return Note{}, err
+		}
+		next, err := c.UploadChunk(ctx, uploadId, offset, chunk[:n])
+		if err != nil {
+			var serverError *Error
+			failures++
+			if failures > c.maxRetries || ctx.Err() != nil || (errors.As(err, &serverError) && !retryable(serverError.StatusCode) && serverError.StatusCode != http.StatusConflict) {
+				return Note{}, err
+			}
+			retryAfter := ""
+			if serverError != nil {
+				retryAfter = serverError.retryAfter
+			}
+			if err := wait(ctx, c.backoff(failures, retryAfter)); err != nil {
+				return Note{}, err
+			}
+			if resumed, err := c.UploadOffset(ctx, uploadId); err == nil {
+				offset = resumed
+			}
+			continue
+		}
+		failures = 0
+		offset = next
+	}
+
+	// the digest is computed after the upload so a resumed chunk is not counted twice
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return Note{}, err
+	}
+	if _, err := io.Copy(digest, content); err != nil {
+		return Note{}, err
+	}
+	return c.AttachUpload(ctx, notebook, id, uploadId, hex.EncodeToString(digest.Sum(nil)))
+}
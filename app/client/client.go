@@ -0,0 +1,293 @@
+// Package client is a Go client for the Nevernote API.
+//
+//	c := client.New("http://localhost:5000", client.WithAPIKey(os.Getenv("NEVERNOTE_API_KEY")))
+//	notes, err := c.ListNotes(ctx, "Work", "Herbs")
+//
+// Every method takes a context. Idempotent requests (GET, HEAD, PUT, DELETE)
+// are retried with exponential backoff when the server is unavailable or
+// rate limits the client, errors returned by the server are *Error values
+// that can be checked with errors.Is against ErrNotFound, ErrUnauthorized
+// and the other sentinel errors.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client calls the API of one Nevernote server. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	authorize  func(req *http.Request)
+	userAgent  string
+	owner      string
+
+	maxRetries int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+// Option configures a Client
+type Option func(c *Client)
+
+// WithBasicAuth authenticates with a username and password
+func WithBasicAuth(username string, password string) Option {
+	return func(c *Client) {
+		c.authorize = func(req *http.Request) { req.SetBasicAuth(username, password) }
+	}
+}
+
+// WithAPIKey authenticates with an API key
+func WithAPIKey(key string) Option {
+	return func(c *Client) {
+		c.authorize = func(req *http.Request) { req.Header.Set("X-API-Key", key) }
+	}
+}
+
+// WithToken authenticates with a session access token from Login
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.authorize = func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+token) }
+	}
+}
+
+// WithHTTPClient sends the requests with httpClient instead of http.DefaultClient
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) { c.httpClient = httpClient }
+}
+
+// WithRetries sets how often an idempotent request is retried and the
+// backoff before the first retry, doubled for every following one
+func WithRetries(maxRetries int, minBackoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = maxRetries
+		c.minBackoff = minBackoff
+	}
+}
+
+// WithUserAgent sets the User-Agent header of the requests
+func WithUserAgent(userAgent string) Option {
+	return func(c *Client) { c.userAgent = userAgent }
+}
+
+// New returns a client of the server at baseURL (ex. http://localhost:5000)
+func New(baseURL string, options ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: http.DefaultClient,
+		authorize:  func(*http.Request) {},
+		userAgent:  "nevernote-go-client",
+		maxRetries: 3,
+		minBackoff: 100 * time.Millisecond,
+		maxBackoff: 5 * time.Second,
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
+
+// ForOwner returns a client working on the notebooks owner shared with the
+// current user instead of the notebooks of the current user
+func (c *Client) ForOwner(owner string) *Client {
+	shared := *c
+	shared.owner = owner
+	return &shared
+}
+
+// request is one call of the API
+type request struct {
+	method string
+	// path segments are escaped, ex. []string{"readNote", title, id}
+	path  []string
+	query url.Values
+	// owner adds ?owner= for the routes of notebooks that can be shared
+	owner bool
+	// JSON body, or a raw body with its content type
+	body        interface{}
+	rawBody     io.Reader
+	contentType string
+	header      http.Header
+	accept      string
+	// return error responses as they are instead of an *Error, without retrying
+	anyStatus bool
+}
+
+func (c *Client) url(call request) string {
+	segments := make([]string, len(call.path))
+	for i, segment := range call.path {
+		segments[i] = url.PathEscape(segment)
+	}
+	query := url.Values{}
+	for key, values := range call.query {
+		query[key] = values
+	}
+	if call.owner && c.owner != "" {
+		query.Set("owner", c.owner)
+	}
+	address := c.baseURL + "/" + strings.Join(segments, "/")
+	if len(query) > 0 {
+		address += "?" + query.Encode()
+	}
+	return address
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+func retryable(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func (c *Client) backoff(attempt int, retryAfter string) time.Duration {
+	/**
+	Function: backoff
+	Description: How long to wait before retry number attempt (from 1), the Retry-After
+	             of the server if it sent one, otherwise exponential with jitter
+	*/
+	if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	wait := c.minBackoff << (attempt - 1)
+	if wait > c.maxBackoff || wait <= 0 {
+		wait = c.maxBackoff
+	}
+	// spread retries of many clients
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+func (c *Client) send(ctx context.Context, call request) (*http.Response, error) {
+	/**
+	Function: send
+	Description: Send a request, retrying idempotent ones, and turn error responses into *Error.
+	             The caller closes the body of the response
+	*/
+	var body []byte
+	if call.body != nil {
+		encoded, err := json.Marshal(call.body)
+		if err != nil {
+			return nil, err
+		}
+		body = encoded
+	}
+	// streamed bodies cannot be sent again
+	retries := c.maxRetries
+	if !idempotent(call.method) || call.rawBody != nil {
+		retries = 0
+	}
+
+	for attempt := 0; ; attempt++ {
+		var reader io.Reader = call.rawBody
+		if body != nil {
+			reader = bytes.NewReader(body)
+		}
+		req, err := http.NewRequestWithContext(ctx, call.method, c.url(call), reader)
+		if err != nil {
+			return nil, err
+		}
+		for key, values := range call.header {
+			req.Header[key] = values
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		} else if call.contentType != "" {
+			req.Header.Set("Content-Type", call.contentType)
+		}
+		if call.accept != "" {
+			req.Header.Set("Accept", call.accept)
+		} else {
+			req.Header.Set("Accept", "application/json")
+		}
+		req.Header.Set("User-Agent", c.userAgent)
+		c.authorize(req)
+
+		response, err := c.httpClient.Do(req)
+		if err == nil && (response.StatusCode < 400 || call.anyStatus) {
+			return response, nil
+		}
+		if attempt >= retries || (err == nil && !retryable(response.StatusCode)) || ctx.Err() != nil {
+			if err != nil {
+				return nil, err
+			}
+			return nil, readError(response)
+		}
+
+		retryAfter := ""
+		if response != nil {
+			retryAfter = response.Header.Get("Retry-After")
+			io.Copy(io.Discard, response.Body)
+			response.Body.Close()
+		}
+		if err := wait(ctx, c.backoff(attempt+1, retryAfter)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func wait(ctx context.Context, duration time.Duration) error {
+	/**
+	Function: wait
+	Description: Sleep for duration, returning early with the error of ctx when it is done
+	*/
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (c *Client) do(ctx context.Context, call request, result interface{}) error {
+	/**
+	Function: do
+	Description: Send a request and decode its JSON response into result (if not nil)
+	*/
+	response, err := c.send(ctx, call)
+	if err != nil {
+		return err
+	}
+	return decode(call, response, result)
+}
+
+func decode(call request, response *http.Response, result interface{}) error {
+	defer response.Body.Close()
+	if result == nil {
+		io.Copy(io.Discard, response.Body)
+		return nil
+	}
+	if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+		return errors.New("could not decode the response of " + call.method + " " + strings.Join(call.path, "/") + ": " + err.Error())
+	}
+	return nil
+}
+
+func (c *Client) text(ctx context.Context, call request) (string, error) {
+	response, err := c.send(ctx, call)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	text, err := io.ReadAll(response.Body)
+	return string(text), err
+}
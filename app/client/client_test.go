@@ -0,0 +1,196 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_Request(t *testing.T) {
+	var got *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		w.Write([]byte(`{"Id": "3", "Title": "Flowers"}`))
+	}))
+	defer server.Close()
+
+	c := New(server.URL+"/", WithAPIKey("nn_secret"), WithUserAgent("test")).ForOwner("ophelia")
+	note, err := c.ReadNote(context.Background(), "Work & Play", "3")
+	if err != nil || note.Title != "Flowers" {
+		t.Fatalf("ReadNote returned unexpected note: got %+v %v", note, err)
+	}
+	if got.URL.EscapedPath() != "/readNote/Work%20&%20Play/3" || got.URL.Query().Get("owner") != "ophelia" {
+		t.Errorf("ReadNote requested wrong URL: got %v", got.URL)
+	}
+	if got.Header.Get("X-API-Key") != "nn_secret" || got.Header.Get("User-Agent") != "test" || got.Header.Get("Accept") != "application/json" {
+		t.Errorf("ReadNote sent wrong headers: got %v", got.Header)
+	}
+
+	// routes of your own notebooks only never get ?owner=
+	c.ListNotebooks(context.Background())
+	if got.URL.Path != "/listNotebooks" || got.URL.RawQuery != "" {
+		t.Errorf("ListNotebooks requested wrong URL: got %v", got.URL)
+	}
+}
+
+func Test_CreateNote(t *testing.T) {
+	// another client created a note at the same time, it comes after ours
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "/readNote/Work/3")
+		w.Write([]byte(`[{"Id": "3", "Title": "Flowers"}, {"Id": "4", "Title": "Songs"}]`))
+	}))
+	defer server.Close()
+
+	note, err := New(server.URL).CreateNote(context.Background(), "Work", NoteInput{Title: "Flowers"})
+	if err != nil || note.Id != "3" || note.Title != "Flowers" {
+		t.Errorf("CreateNote returned the wrong note: got %+v %v", note, err)
+	}
+}
+
+func Test_SearchNotes(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path+"?"+r.URL.RawQuery)
+		switch r.URL.Path {
+		case "/sharedWithMe":
+			w.Write([]byte(`[{"Owner": "ophelia", "Notebook": "Flowers", "Role": "viewer"}, {"Owner": "laertes", "Notebook": "Letters", "Role": "viewer"}]`))
+		case "/listNotes/Flowers":
+			w.Write([]byte(`[{"Id": "3", "Title": "Rosemary", "Body": "for remembrance"}]`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"Status": 404, "Error": "Notebook does not exist"}`))
+		}
+	}))
+	defer server.Close()
+
+	// a shared client searches the notebooks the owner shared, not the notebooks of the user
+	matches, err := New(server.URL).ForOwner("ophelia").SearchNotes(context.Background(), SearchQuery{Text: "remembrance"})
+	if err != nil || len(matches) != 1 || matches[0].Notebook != "Flowers" || matches[0].Id != "3" {
+		t.Errorf("SearchNotes returned unexpected matches: got %+v %v", matches, err)
+	}
+	if len(paths) != 2 || paths[0] != "/sharedWithMe?" || paths[1] != "/listNotes/Flowers?owner=ophelia" {
+		t.Errorf("SearchNotes requested wrong URLs: got %v", paths)
+	}
+}
+
+func Test_Retries(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"Status": 503, "Error": "Server is starting"}`))
+			return
+		}
+		w.Write([]byte(`["Work"]`))
+	}))
+	defer server.Close()
+	c := New(server.URL, WithRetries(3, time.Millisecond))
+
+	// idempotent requests are retried until the server answers
+	if titles, err := c.ListNotebooks(context.Background()); err != nil || len(titles) != 1 || atomic.LoadInt32(&calls) != 3 {
+		t.Errorf("ListNotebooks was not retried: got %v %v after %v calls", titles, err, calls)
+	}
+
+	// others are not, the server may have acted on them
+	atomic.StoreInt32(&calls, 0)
+	if _, err := c.CreateNotebook(context.Background(), "Work"); !errors.Is(err, ErrUnavailable) || atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("CreateNotebook returned wrong error: got %v after %v calls", err, calls)
+	}
+
+	// retries give up after maxRetries
+	atomic.StoreInt32(&calls, -10)
+	if _, err := c.ListNotebooks(context.Background()); !errors.Is(err, ErrUnavailable) || atomic.LoadInt32(&calls) != -6 {
+		t.Errorf("ListNotebooks returned wrong error: got %v after %v calls", err, calls+10)
+	}
+}
+
+func Test_RetryCancel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+	c := New(server.URL, WithRetries(5, time.Hour))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.ListNotebooks(ctx); !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > 5*time.Second {
+		t.Errorf("ListNotebooks did not stop when the context ended: got %v after %v", err, time.Since(start))
+	}
+}
+
+func Test_UploadAttachmentRetry(t *testing.T) {
+	var failed, resumed time.Time
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			if r.URL.Path == "/uploads" {
+				w.Header().Set("Location", "/uploads/7")
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+			w.Write([]byte(`{"Id": "3", "Title": "Flowers", "Attachments": [{"Id": "1", "Filename": "rue.txt"}]}`))
+		case http.MethodHead:
+			w.Header().Set("Upload-Offset", "0")
+		case http.MethodPatch:
+			if failed.IsZero() {
+				failed = time.Now()
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				w.Write([]byte(`{"Status": 503, "Error": "Server is busy"}`))
+				return
+			}
+			resumed = time.Now()
+			w.Header().Set("Upload-Offset", strconv.FormatInt(r.ContentLength, 10))
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+	c := New(server.URL, WithRetries(3, time.Millisecond))
+
+	// a failed chunk is resumed after the Retry-After of the server
+	note, err := c.UploadAttachment(context.Background(), "Work", "3", "rue.txt", "text/plain", strings.NewReader("for you"))
+	if err != nil || len(note.Attachments) != 1 {
+		t.Fatalf("UploadAttachment returned unexpected note: got %+v %v", note, err)
+	}
+	if waited := resumed.Sub(failed); waited < time.Second {
+		t.Errorf("UploadAttachment resumed before the Retry-After: waited %v", waited)
+	}
+}
+
+func Test_Errors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/readNote/Work/9":
+			w.Header().Set("X-Request-ID", "header-id")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"Status": 500, "Error": "Note with id \"9\" does not exist", "RequestId": "body-id"}`))
+		default:
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte("upstream down\n"))
+		}
+	}))
+	defer server.Close()
+	c := New(server.URL, WithRetries(0, 0))
+
+	_, err := c.ReadNote(context.Background(), "Work", "9")
+	var serverError *Error
+	if !errors.Is(err, ErrNotFound) || !errors.Is(err, ErrServerFailure) || !errors.As(err, &serverError) || serverError.RequestId != "body-id" {
+		t.Errorf("ReadNote returned wrong error: got %#v", err)
+	}
+	if errors.Is(err, ErrUnauthorized) {
+		t.Errorf("ReadNote error matches ErrUnauthorized: %v", err)
+	}
+
+	// bodies that are not an ErrorResponse are kept as the message
+	if _, err := c.ListNotebooks(context.Background()); !errors.As(err, &serverError) || serverError.Message != "upstream down" || serverError.StatusCode != http.StatusBadGateway {
+		t.Errorf("ListNotebooks returned wrong error: got %#v", err)
+	}
+}
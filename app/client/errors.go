@@ -0,0 +1,113 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Errors the *Error values returned by the client match with errors.Is
+var (
+	ErrBadRequest    = errors.New("bad request")
+	ErrValidation    = errors.New("request body does not match the schema")
+	ErrUnauthorized  = errors.New("unauthorized")
+	ErrForbidden     = errors.New("forbidden")
+	ErrNotFound      = errors.New("not found")
+	ErrConflict      = errors.New("conflict")
+	ErrTooLarge      = errors.New("request too large")
+	ErrExpired       = errors.New("expired")
+	ErrRateLimited   = errors.New("rate limited")
+	ErrUnavailable   = errors.New("server unavailable")
+	ErrServerFailure = errors.New("server error")
+)
+
+// FieldError is a problem with one field of a request body
+type FieldError struct {
+	Field   string `json:"Field"`
+	Message string `json:"Message"`
+}
+
+// Error is an error response of the server
+type Error struct {
+	StatusCode int
+	Message    string
+	// the X-Request-ID of the request, to find it in the server logs
+	RequestId string
+	// the fields of a request body that did not match the schema
+	Details []FieldError
+	// the Retry-After header of the response, used to back off before resuming an upload
+	retryAfter string
+}
+
+func (err *Error) Error() string {
+	message := "nevernote: " + strconv.Itoa(err.StatusCode) + " " + err.Message
+	for _, detail := range err.Details {
+		message += "\n  " + detail.Field + ": " + detail.Message
+	}
+	return message
+}
+
+func (err *Error) Is(target error) bool {
+	/**
+	Function: Is
+	Description: Match the sentinel error of the status. The server answers 500 for
+	             missing notebooks and notes, those match ErrNotFound as well
+	*/
+	switch target {
+	case ErrBadRequest:
+		return err.StatusCode == http.StatusBadRequest
+	case ErrValidation:
+		return err.StatusCode == http.StatusBadRequest && len(err.Details) > 0
+	case ErrUnauthorized:
+		return err.StatusCode == http.StatusUnauthorized
+	case ErrForbidden:
+		return err.StatusCode == http.StatusForbidden
+	case ErrNotFound:
+		return err.StatusCode == http.StatusNotFound || strings.Contains(err.Message, "does not exist")
+	case ErrConflict:
+		return err.StatusCode == http.StatusConflict
+	case ErrExpired:
+		return err.StatusCode == http.StatusGone
+	case ErrTooLarge:
+		return err.StatusCode == http.StatusRequestEntityTooLarge
+	case ErrRateLimited:
+		return err.StatusCode == http.StatusTooManyRequests
+	case ErrUnavailable:
+		return err.StatusCode == http.StatusServiceUnavailable
+	case ErrServerFailure:
+		return err.StatusCode >= 500
+	}
+	return false
+}
+
+func readError(response *http.Response) error {
+	/**
+	Function: readError
+	Description: The *Error of an error response, the body is an ErrorResponse of the server
+	             unless a proxy answered
+	*/
+	defer response.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(response.Body, 64<<10))
+
+	err := &Error{StatusCode: response.StatusCode, RequestId: response.Header.Get("X-Request-ID"), retryAfter: response.Header.Get("Retry-After")}
+	var decoded struct {
+		Error     string       `json:"Error"`
+		RequestId string       `json:"RequestId"`
+		Details   []FieldError `json:"Details"`
+	}
+	if json.Unmarshal(body, &decoded) == nil && decoded.Error != "" {
+		err.Message = decoded.Error
+		err.Details = decoded.Details
+		if decoded.RequestId != "" {
+			err.RequestId = decoded.RequestId
+		}
+	} else if text := strings.TrimSpace(string(body)); text != "" {
+		err.Message = text
+	} else {
+		err.Message = http.StatusText(response.StatusCode)
+	}
+	return err
+}
@@ -0,0 +1,40 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+func (c *Client) Healthcheck(ctx context.Context) error {
+	/**
+	Function: Healthcheck
+	Description: Check that the server is up
+	*/
+	_, err := c.text(ctx, request{method: http.MethodGet, path: []string{"healthcheck"}})
+	return err
+}
+
+func (c *Client) Ready(ctx context.Context) (HealthReport, error) {
+	/**
+	Function: Ready
+	Description: Run the readiness checks of the server. A server that is not ready answers
+	             503, the report is returned with an error matching ErrUnavailable
+	*/
+	var report HealthReport
+	response, err := c.send(ctx, request{method: http.MethodGet, path: []string{"readyz"}, anyStatus: true})
+	if err != nil {
+		return report, err
+	}
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusServiceUnavailable {
+		return report, readError(response)
+	}
+	defer response.Body.Close()
+	if err := json.NewDecoder(response.Body).Decode(&report); err != nil {
+		return report, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return report, &Error{StatusCode: response.StatusCode, Message: "server is " + report.Status, RequestId: response.Header.Get("X-Request-ID")}
+	}
+	return report, nil
+}
@@ -0,0 +1,271 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+func (c *Client) ListNotebooks(ctx context.Context) ([]string, error) {
+	var titles []string
+	err := c.do(ctx, request{method: http.MethodGet, path: []string{"listNotebooks"}}, &titles)
+	return titles, err
+}
+
+func (c *Client) NotebookTitles(ctx context.Context) ([]string, error) {
+	/**
+	Function: NotebookTitles
+	Description: Titles of the notebooks the client works on, for a ForOwner client the
+	             notebooks the owner shared with the current user
+	*/
+	if c.owner == "" {
+		return c.ListNotebooks(ctx)
+	}
+	grants, err := c.SharedWithMe(ctx)
+	if err != nil {
+		return nil, err
+	}
+	titles := []string{}
+	for _, grant := range grants {
+		if grant.Owner == c.owner {
+			titles = append(titles, grant.Notebook)
+		}
+	}
+	return titles, nil
+}
+
+func (c *Client) CreateNotebook(ctx context.Context, title string) ([]string, error) {
+	/**
+	Function: CreateNotebook
+	Description: Create a notebook, returning the titles of every notebook
+	*/
+	var titles []string
+	err := c.do(ctx, request{method: http.MethodPost, path: []string{"createNotebook", title}}, &titles)
+	return titles, err
+}
+
+func (c *Client) DeleteNotebook(ctx context.Context, title string) ([]string, error) {
+	/**
+	Function: DeleteNotebook
+	Description: Delete a notebook and its notes, returning the titles of the remaining notebooks
+	*/
+	var titles []string
+	err := c.do(ctx, request{method: http.MethodDelete, path: []string{"deleteNotebook", title}}, &titles)
+	return titles, err
+}
+
+func (c *Client) NumberOfNotes(ctx context.Context, notebook string) (int, error) {
+	var count int
+	err := c.do(ctx, request{method: http.MethodGet, path: []string{"numberOfNotes", notebook}, owner: true}, &count)
+	return count, err
+}
+
+func (c *Client) ListNotes(ctx context.Context, notebook string, tags ...string) ([]Note, error) {
+	/**
+	Function: ListNotes
+	Description: The notes of a notebook having every one of tags
+	*/
+	if tags == nil {
+		tags = []string{}
+	}
+	var notes []Note
+	err := c.do(ctx, request{method: http.MethodGet, path: []string{"listNotes", notebook}, owner: true, body: map[string][]string{"Tags": tags}}, &notes)
+	return notes, err
+}
+
+func (c *Client) ReadNote(ctx context.Context, notebook string, id string) (Note, error) {
+	var note Note
+	err := c.do(ctx, request{method: http.MethodGet, path: []string{"readNote", notebook, id}, owner: true}, &note)
+	return note, err
+}
+
+func (c *Client) ReadNoteAs(ctx context.Context, notebook string, id string, mediaType string) (string, error) {
+	/**
+	Function: ReadNoteAs
+	Description: A note as text/markdown (front matter and body), text/html or text/plain
+	*/
+	return c.text(ctx, request{method: http.MethodGet, path: []string{"readNote", notebook, id}, owner: true, accept: mediaType})
+}
+
+func (c *Client) RenderNote(ctx context.Context, notebook string, id string) (string, error) {
+	/**
+	Function: RenderNote
+	Description: The body of a note rendered as sanitized HTML
+	*/
+	return c.text(ctx, request{method: http.MethodGet, path: []string{"renderNote", notebook, id}, owner: true, accept: "text/html"})
+}
+
+func (c *Client) CreateNote(ctx context.Context, notebook string, note NoteInput) (Note, error) {
+	/**
+	Function: CreateNote
+	Description: Create a note, returning it with its id
+	*/
+	if note.Tags == nil {
+		note.Tags = []string{}
+	}
+	call := request{method: http.MethodPost, path: []string{"createNote", notebook}, owner: true, body: note}
+	response, err := c.send(ctx, call)
+	if err != nil {
+		return Note{}, err
+	}
+	// the server answers with the whole notebook, the Location header has the id of the new note
+	id := path.Base(response.Header.Get("Location"))
+	var notes []Note
+	if err := decode(call, response, &notes); err != nil {
+		return Note{}, err
+	}
+	return findNote(notes, id)
+}
+
+func (c *Client) UpdateNote(ctx context.Context, notebook string, id string, note NoteInput, rewriteLinks bool) (Note, error) {
+	/**
+	Function: UpdateNote
+	Description: Replace a note. With rewriteLinks, [[links]] to its old title in other
+	             notes are changed to the new title
+	*/
+	if note.Tags == nil {
+		note.Tags = []string{}
+	}
+	call := request{method: http.MethodPut, path: []string{"updateNote", notebook, id}, owner: true, body: note}
+	if rewriteLinks {
+		call.query = url.Values{"rewriteLinks": {"true"}}
+	}
+	var notes []Note
+	if err := c.do(ctx, call, &notes); err != nil {
+		return Note{}, err
+	}
+	return findNote(notes, id)
+}
+
+func (c *Client) DeleteNote(ctx context.Context, notebook string, id string) error {
+	return c.do(ctx, request{method: http.MethodDelete, path: []string{"deleteNote", notebook, id}, owner: true}, nil)
+}
+
+func findNote(notes []Note, id string) (Note, error) {
+	for _, note := range notes {
+		if note.Id == id {
+			return note, nil
+		}
+	}
+	return Note{}, errors.New("nevernote: note " + id + " is missing from the response")
+}
+
+// SearchQuery selects notes for SearchNotes, empty fields match every note
+type SearchQuery struct {
+	// only this notebook, every notebook when empty
+	Notebook string
+	// notes having every one of these tags
+	Tags []string
+	// case insensitive text in the title or body
+	Text string
+}
+
+// NoteMatch is a note found by SearchNotes
+type NoteMatch struct {
+	Notebook string
+	Note
+}
+
+func (c *Client) SearchNotes(ctx context.Context, query SearchQuery) ([]NoteMatch, error) {
+	/**
+	Function: SearchNotes
+	Description: Find notes by tags and text. The API has no search route, notebooks are
+	             listed by tags with listNotes and the text is matched by the client
+	*/
+	notebooks := []string{query.Notebook}
+	if query.Notebook == "" {
+		titles, err := c.NotebookTitles(ctx)
+		if err != nil {
+			return nil, err
+		}
+		notebooks = titles
+	}
+
+	text := strings.ToLower(query.Text)
+	var matches []NoteMatch
+	for _, notebook := range notebooks {
+		notes, err := c.ListNotes(ctx, notebook, query.Tags...)
+		if err != nil {
+			return nil, err
+		}
+		for _, note := range notes {
+			if text == "" || strings.Contains(strings.ToLower(note.Title), text) || strings.Contains(strings.ToLower(note.Body), text) {
+				matches = append(matches, NoteMatch{notebook, note})
+			}
+		}
+	}
+	return matches, nil
+}
+
+// TagQuery narrows AutocompleteTags
+type TagQuery struct {
+	// only tags of this notebook
+	Notebook string
+	// most suggestions returned, the server default when 0
+	Limit int
+}
+
+func (c *Client) AutocompleteTags(ctx context.Context, prefix string, query TagQuery) ([]TagSuggestion, error) {
+	/**
+	Function: AutocompleteTags
+	Description: Tags starting with prefix (case insensitive), most used first
+	*/
+	values := url.Values{"prefix": {prefix}}
+	if query.Notebook != "" {
+		values.Set("notebook", query.Notebook)
+	}
+	if query.Limit > 0 {
+		values.Set("limit", strconv.Itoa(query.Limit))
+	}
+	var suggestions []TagSuggestion
+	err := c.do(ctx, request{method: http.MethodGet, path: []string{"autocompleteTags"}, query: values, owner: true}, &suggestions)
+	return suggestions, err
+}
+
+func (c *Client) NoteLinks(ctx context.Context, notebook string, id string) ([]NoteLink, error) {
+	var links []NoteLink
+	err := c.do(ctx, request{method: http.MethodGet, path: []string{"noteLinks", notebook, id}, owner: true}, &links)
+	return links, err
+}
+
+func (c *Client) Backlinks(ctx context.Context, notebook string, id string) ([]LinkedNote, error) {
+	var notes []LinkedNote
+	err := c.do(ctx, request{method: http.MethodGet, path: []string{"backlinks", notebook, id}, owner: true}, &notes)
+	return notes, err
+}
+
+func (c *Client) BrokenLinks(ctx context.Context, notebook string) ([]LinkedNote, error) {
+	/**
+	Function: BrokenLinks
+	Description: Links that do not point at any note, in one notebook or all of them when empty
+	*/
+	call := request{method: http.MethodGet, path: []string{"brokenLinks"}, owner: true}
+	if notebook != "" {
+		call.query = url.Values{"notebook": {notebook}}
+	}
+	var notes []LinkedNote
+	err := c.do(ctx, call, &notes)
+	return notes, err
+}
+
+func (c *Client) NoteGraph(ctx context.Context, notebook string, tags ...string) (NoteGraph, error) {
+	/**
+	Function: NoteGraph
+	Description: The graph of links and tags of the notes in one notebook (all when empty)
+	             having any of tags
+	*/
+	values := url.Values{}
+	if notebook != "" {
+		values.Set("notebook", notebook)
+	}
+	for _, tag := range tags {
+		values.Add("tag", tag)
+	}
+	var graph NoteGraph
+	err := c.do(ctx, request{method: http.MethodGet, path: []string{"noteGraph"}, query: values, owner: true}, &graph)
+	return graph, err
+}
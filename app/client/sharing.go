@@ -0,0 +1,97 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+func (c *Client) AddComment(ctx context.Context, notebook string, id string, body string) (Note, error) {
+	var note Note
+	err := c.do(ctx, request{method: http.MethodPost, path: []string{"addComment", notebook, id}, owner: true, body: map[string]string{"Body": body}}, &note)
+	return note, err
+}
+
+func (c *Client) ShareNotebook(ctx context.Context, notebook string, username string, role string) (ShareGrant, error) {
+	/**
+	Function: ShareNotebook
+	Description: Share a notebook with a user as a RoleViewer, RoleCommenter or RoleEditor
+	*/
+	var grant ShareGrant
+	err := c.do(ctx, request{method: http.MethodPost, path: []string{"shareNotebook", notebook}, body: map[string]string{"Username": username, "Role": role}}, &grant)
+	return grant, err
+}
+
+func (c *Client) UpdateShare(ctx context.Context, notebook string, username string, role string) (ShareGrant, error) {
+	var grant ShareGrant
+	err := c.do(ctx, request{method: http.MethodPut, path: []string{"updateShare", notebook, username}, body: map[string]string{"Role": role}}, &grant)
+	return grant, err
+}
+
+func (c *Client) RevokeShare(ctx context.Context, notebook string, username string) (ShareGrant, error) {
+	var grant ShareGrant
+	err := c.do(ctx, request{method: http.MethodDelete, path: []string{"revokeShare", notebook, username}}, &grant)
+	return grant, err
+}
+
+func (c *Client) ListShares(ctx context.Context, notebook string) ([]ShareGrant, error) {
+	var grants []ShareGrant
+	err := c.do(ctx, request{method: http.MethodGet, path: []string{"listShares", notebook}}, &grants)
+	return grants, err
+}
+
+func (c *Client) SharedWithMe(ctx context.Context) ([]ShareGrant, error) {
+	/**
+	Function: SharedWithMe
+	Description: The notebooks other users shared, read them with ForOwner
+	*/
+	var grants []ShareGrant
+	err := c.do(ctx, request{method: http.MethodGet, path: []string{"sharedWithMe"}}, &grants)
+	return grants, err
+}
+
+func (c *Client) CreatePublicLink(ctx context.Context, notebook string, link PublicLinkInput) (PublicLink, error) {
+	var created PublicLink
+	err := c.do(ctx, request{method: http.MethodPost, path: []string{"createPublicLink", notebook}, body: link}, &created)
+	return created, err
+}
+
+func (c *Client) ListPublicLinks(ctx context.Context, notebook string) ([]PublicLink, error) {
+	var links []PublicLink
+	err := c.do(ctx, request{method: http.MethodGet, path: []string{"listPublicLinks", notebook}}, &links)
+	return links, err
+}
+
+func (c *Client) RevokePublicLink(ctx context.Context, linkId string) (PublicLink, error) {
+	var link PublicLink
+	err := c.do(ctx, request{method: http.MethodDelete, path: []string{"revokePublicLink", linkId}}, &link)
+	return link, err
+}
+
+func (c *Client) ReadPublicLink(ctx context.Context, token string, password string) (PublicContent, error) {
+	/**
+	Function: ReadPublicLink
+	Description: Open a public link, needs no credentials. Errors match ErrUnauthorized
+	             for a wrong password and ErrExpired for an expired link
+	*/
+	call := request{method: http.MethodGet, path: []string{"public", token}}
+	if password != "" {
+		call.header = http.Header{"X-Link-Password": {password}}
+	}
+	var raw json.RawMessage
+	if err := c.do(ctx, call, &raw); err != nil {
+		return PublicContent{}, err
+	}
+
+	// a notebook has Notes, a note has an Id
+	var content PublicContent
+	var probe struct {
+		Notes json.RawMessage `json:"Notes"`
+	}
+	if err := json.Unmarshal(raw, &probe); err == nil && probe.Notes != nil {
+		content.Notebook = &PublicNotebook{}
+		return content, json.Unmarshal(raw, content.Notebook)
+	}
+	content.Note = &Note{}
+	return content, json.Unmarshal(raw, content.Note)
+}
@@ -0,0 +1,234 @@
+package client
+
+// The types below mirror the JSON of the server, see /openapi.json
+
+// Note formats
+const (
+	FormatPlain    = "plain"
+	FormatMarkdown = "markdown"
+	FormatHTML     = "html"
+)
+
+// Notebook roles of a share
+const (
+	RoleViewer    = "viewer"
+	RoleCommenter = "commenter"
+	RoleEditor    = "editor"
+)
+
+// API key scopes
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+	ScopeKeys  = "keys"
+)
+
+type Note struct {
+	Id           string       `json:"Id"`
+	Title        string       `json:"Title"`
+	Body         string       `json:"Body"`
+	Format       string       `json:"Format,omitempty"`
+	Tags         []string     `json:"Tags"`
+	Attachments  []Attachment `json:"Attachments,omitempty"`
+	Comments     []Comment    `json:"Comments,omitempty"`
+	Created      string       `json:"Created"`
+	LastModified string       `json:"LastModified"`
+}
+
+// NoteInput is what CreateNote and UpdateNote send, Title and Body are
+// required and Tags must not be nil
+type NoteInput struct {
+	Title  string   `json:"Title"`
+	Body   string   `json:"Body"`
+	Format string   `json:"Format,omitempty"`
+	Tags   []string `json:"Tags"`
+}
+
+type Attachment struct {
+	Id           string            `json:"Id"`
+	Filename     string            `json:"Filename"`
+	ContentType  string            `json:"ContentType"`
+	DetectedType string            `json:"DetectedType,omitempty"`
+	Size         int64             `json:"Size"`
+	SHA256       string            `json:"SHA256"`
+	Width        int               `json:"Width,omitempty"`
+	Height       int               `json:"Height,omitempty"`
+	Thumbnails   map[string]string `json:"Thumbnails,omitempty"`
+	Created      string            `json:"Created"`
+}
+
+type Comment struct {
+	Id      string `json:"Id"`
+	Author  string `json:"Author"`
+	Body    string `json:"Body"`
+	Created string `json:"Created"`
+}
+
+type TagSuggestion struct {
+	Tag   string `json:"Tag"`
+	Count int    `json:"Count"`
+}
+
+type NoteLink struct {
+	Text     string `json:"Text"`
+	Notebook string `json:"Notebook,omitempty"`
+	Id       string `json:"Id,omitempty"`
+	Title    string `json:"Title,omitempty"`
+	Broken   bool   `json:"Broken"`
+}
+
+type LinkedNote struct {
+	Notebook string `json:"Notebook"`
+	Id       string `json:"Id"`
+	Title    string `json:"Title"`
+	Text     string `json:"Text,omitempty"`
+}
+
+// NoteGraph follows the JSON Graph Format (https://jsongraphformat.info)
+type NoteGraph struct {
+	Graph struct {
+		Directed bool `json:"directed"`
+		Nodes    map[string]struct {
+			Label    string            `json:"label"`
+			Metadata map[string]string `json:"metadata"`
+		} `json:"nodes"`
+		Edges []struct {
+			Source   string `json:"source"`
+			Target   string `json:"target"`
+			Relation string `json:"relation"`
+		} `json:"edges"`
+	} `json:"graph"`
+}
+
+type BlobCollection struct {
+	Removed    int   `json:"Removed"`
+	FreedBytes int64 `json:"FreedBytes"`
+}
+
+type User struct {
+	Username string `json:"Username"`
+	Created  string `json:"Created"`
+}
+
+type APIKey struct {
+	Id       string   `json:"Id"`
+	Name     string   `json:"Name"`
+	Username string   `json:"Username"`
+	Scopes   []string `json:"Scopes"`
+	Created  string   `json:"Created"`
+	LastUsed string   `json:"LastUsed,omitempty"`
+	Revoked  bool     `json:"Revoked"`
+}
+
+// NewAPIKey is a created key, Key is only returned this once
+type NewAPIKey struct {
+	APIKey
+	Key string `json:"Key"`
+}
+
+type SessionTokens struct {
+	AccessToken  string `json:"AccessToken"`
+	RefreshToken string `json:"RefreshToken"`
+	TokenType    string `json:"TokenType"`
+	ExpiresIn    int    `json:"ExpiresIn"`
+}
+
+type Quota struct {
+	MaxNotes           int   `json:"MaxNotes"`
+	MaxBodyBytes       int64 `json:"MaxBodyBytes"`
+	MaxAttachmentBytes int64 `json:"MaxAttachmentBytes"`
+}
+
+type QuotaUsage struct {
+	Notes           int   `json:"Notes"`
+	AttachmentBytes int64 `json:"AttachmentBytes"`
+}
+
+type QuotaReport struct {
+	Limits Quota      `json:"Limits"`
+	Usage  QuotaUsage `json:"Usage"`
+}
+
+type AuditEvent struct {
+	Id         int64  `json:"Id"`
+	Time       string `json:"Time"`
+	Actor      string `json:"Actor"`
+	Action     string `json:"Action"`
+	Owner      string `json:"Owner,omitempty"`
+	Notebook   string `json:"Notebook,omitempty"`
+	NoteId     string `json:"NoteId,omitempty"`
+	Target     string `json:"Target,omitempty"`
+	BeforeHash string `json:"BeforeHash,omitempty"`
+	AfterHash  string `json:"AfterHash,omitempty"`
+	ClientIP   string `json:"ClientIP"`
+	RequestId  string `json:"RequestId,omitempty"`
+	Hash       string `json:"Hash"`
+}
+
+// AuditFilter selects audit events, empty fields match everything
+type AuditFilter struct {
+	Actor    string
+	Action   string
+	Owner    string
+	Notebook string
+	NoteId   string
+	// times formatted like 2006.01.02 15:04:05
+	Since string
+	Until string
+	Limit int
+}
+
+type ShareGrant struct {
+	Owner    string `json:"Owner"`
+	Notebook string `json:"Notebook"`
+	Username string `json:"Username"`
+	Role     string `json:"Role"`
+	Created  string `json:"Created"`
+}
+
+type PublicLink struct {
+	Id           string `json:"Id"`
+	Owner        string `json:"Owner"`
+	Notebook     string `json:"Notebook"`
+	NoteId       string `json:"NoteId,omitempty"`
+	Url          string `json:"Url"`
+	Expires      string `json:"Expires,omitempty"`
+	HasPassword  bool   `json:"HasPassword"`
+	Created      string `json:"Created"`
+	AccessCount  int    `json:"AccessCount"`
+	LastAccessed string `json:"LastAccessed,omitempty"`
+	Revoked      bool   `json:"Revoked"`
+}
+
+// PublicLinkInput is what CreatePublicLink sends
+type PublicLinkInput struct {
+	// only this note, the whole notebook when empty
+	NoteId string `json:"NoteId,omitempty"`
+	// seconds, the link never expires when 0
+	ExpiresIn int    `json:"ExpiresIn,omitempty"`
+	Password  string `json:"Password,omitempty"`
+}
+
+// PublicContent is what a public link shows, a note or a notebook
+type PublicContent struct {
+	Note     *Note
+	Notebook *PublicNotebook
+}
+
+type PublicNotebook struct {
+	Title string `json:"Title"`
+	Notes []Note `json:"Notes"`
+}
+
+type HealthCheckResult struct {
+	Name       string `json:"Name"`
+	Status     string `json:"Status"`
+	Error      string `json:"Error,omitempty"`
+	DurationMs int64  `json:"DurationMs"`
+}
+
+type HealthReport struct {
+	Status string              `json:"Status"`
+	State  string              `json:"State,omitempty"`
+	Checks []HealthCheckResult `json:"Checks,omitempty"`
+}
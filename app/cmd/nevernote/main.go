@@ -0,0 +1,142 @@
+// Command nevernote is a command-line client of the Nevernote API.
+//
+//	nevernote profile add work --url https://notes.example.com --api-key nn_...
+//	nevernote nb ls
+//	nevernote note add -n Work --tag Herbs < flowers.md
+//	nevernote note edit 3
+//	nevernote search --tag Herbs rosemary
+//
+// Run "nevernote completion bash|zsh|fish|powershell" for shell completion.
+package main
+
+import (
+	"app/client"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+)
+
+// cli holds the global flags and the streams of one run
+type cli struct {
+	configPath string
+	profile    string
+	url        string
+	output     string
+	notebook   string
+
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+	// environment lookup, os.LookupEnv outside of tests
+	lookupEnv func(string) (string, bool)
+}
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+func newRootCommand(app *cli) *cobra.Command {
+	/**
+	Function: newRootCommand
+	Description: The nevernote command and its subcommands
+	*/
+	root := &cobra.Command{
+		Use:           "nevernote",
+		Short:         "Command-line client of the Nevernote API",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if app.output != outputTable && app.output != outputJSON {
+				return fmt.Errorf("unsupported output %q, use table or json", app.output)
+			}
+			return nil
+		},
+	}
+	root.SetIn(app.stdin)
+	root.SetOut(app.stdout)
+	root.SetErr(app.stderr)
+
+	flags := root.PersistentFlags()
+	flags.StringVar(&app.configPath, "config", "", "profiles file (default $NEVERNOTE_CONFIG or <user config dir>/nevernote/config.yaml)")
+	flags.StringVarP(&app.profile, "profile", "p", "", "profile to use (default $NEVERNOTE_PROFILE or the current profile)")
+	flags.StringVar(&app.url, "url", "", "server URL, overrides the profile (default $NEVERNOTE_URL)")
+	flags.StringVarP(&app.output, "output", "o", outputTable, "output format: table or json")
+	root.RegisterFlagCompletionFunc("profile", app.completeProfiles)
+	root.RegisterFlagCompletionFunc("output", cobra.FixedCompletions([]string{outputTable, outputJSON}, cobra.ShellCompDirectiveNoFileComp))
+
+	root.AddCommand(app.notebookCommand(), app.noteCommand(), app.searchCommand(), app.profileCommand())
+	return root
+}
+
+func (app *cli) getenv(key string) string {
+	value, _ := app.lookupEnv(key)
+	return value
+}
+
+func (app *cli) client() (*client.Client, Profile, error) {
+	/**
+	Function: client
+	Description: A client of the selected profile, with the --url flag and the
+	             NEVERNOTE_URL and NEVERNOTE_API_KEY variables taking precedence
+	*/
+	config, err := app.loadConfig()
+	if err != nil {
+		return nil, Profile{}, err
+	}
+	name := app.profileName(config)
+	profile, found := config.Profiles[name]
+	if !found && name != "" {
+		return nil, Profile{}, fmt.Errorf("profile %q does not exist, add it with \"nevernote profile add %s --url ...\"", name, name)
+	}
+
+	if url := app.getenv("NEVERNOTE_URL"); url != "" {
+		profile.URL = url
+	}
+	if app.url != "" {
+		profile.URL = app.url
+	}
+	if key := app.getenv("NEVERNOTE_API_KEY"); key != "" {
+		profile = Profile{URL: profile.URL, APIKey: key, Owner: profile.Owner, Notebook: profile.Notebook}
+	}
+	if profile.URL == "" {
+		return nil, Profile{}, errors.New("no server, add a profile with \"nevernote profile add <name> --url ...\" or use --url")
+	}
+
+	options := []client.Option{client.WithUserAgent("nevernote-cli")}
+	switch {
+	case profile.Token != "":
+		options = append(options, client.WithToken(profile.Token))
+	case profile.APIKey != "":
+		options = append(options, client.WithAPIKey(profile.APIKey))
+	case profile.Username != "":
+		options = append(options, client.WithBasicAuth(profile.Username, profile.Password))
+	}
+	c := client.New(profile.URL, options...)
+	if profile.Owner != "" {
+		c = c.ForOwner(profile.Owner)
+	}
+	return c, profile, nil
+}
+
+func (app *cli) run(args []string) int {
+	/**
+	Function: run
+	Description: Run the command line, returning the exit status
+	*/
+	root := newRootCommand(app)
+	root.SetArgs(args)
+	if err := root.ExecuteContext(context.Background()); err != nil {
+		fmt.Fprintln(app.stderr, "nevernote:", err)
+		return 1
+	}
+	return 0
+}
+
+func main() {
+	app := &cli{stdin: os.Stdin, stdout: os.Stdout, stderr: os.Stderr, lookupEnv: os.LookupEnv}
+	os.Exit(app.run(os.Args[1:]))
+}
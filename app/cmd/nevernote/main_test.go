@@ -0,0 +1,247 @@
+package main
+
+import (
+	"app/client"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeServer keeps notes in memory and answers the note routes like the API,
+// shared holds the notebooks other users shared with ophelia by owner
+type fakeServer struct {
+	mu        sync.Mutex
+	notebooks map[string][]client.Note
+	shared    map[string]map[string][]client.Note
+	nextId    int
+}
+
+func (server *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if username, password, ok := r.BasicAuth(); !ok || username != "ophelia" || password != "get thee to a nunnery" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]interface{}{"Status": 401, "Error": "Unauthorized"})
+		return
+	}
+	segments := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	notebooks := server.notebooks
+	if owner := r.URL.Query().Get("owner"); owner != "" {
+		notebooks = server.shared[owner]
+	}
+	notFound := func(message string) {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{"Status": 500, "Error": message})
+	}
+	notes := func() ([]client.Note, bool) {
+		notes, found := notebooks[segments[1]]
+		if !found {
+			notFound("Notebook \"" + segments[1] + "\" does not exist")
+		}
+		return notes, found
+	}
+	index := func(notes []client.Note) int {
+		for i, note := range notes {
+			if note.Id == segments[2] {
+				return i
+			}
+		}
+		notFound("Note with id \"" + segments[2] + "\" does not exist")
+		return -1
+	}
+
+	switch segments[0] {
+	case "listNotebooks":
+		titles := []string{}
+		for title := range server.notebooks {
+			titles = append(titles, title)
+		}
+		json.NewEncoder(w).Encode(titles)
+	case "sharedWithMe":
+		grants := []client.ShareGrant{}
+		for owner, shared := range server.shared {
+			for title := range shared {
+				grants = append(grants, client.ShareGrant{Owner: owner, Notebook: title, Username: "ophelia", Role: "editor"})
+			}
+		}
+		json.NewEncoder(w).Encode(grants)
+	case "listNotes":
+		if notes, ok := notes(); ok {
+			json.NewEncoder(w).Encode(notes)
+		}
+	case "createNote", "updateNote":
+		notes, ok := notes()
+		if !ok {
+			return
+		}
+		var input client.NoteInput
+		json.NewDecoder(r.Body).Decode(&input)
+		note := client.Note{Title: input.Title, Body: input.Body, Format: input.Format, Tags: input.Tags}
+		if segments[0] == "createNote" {
+			note.Id = strconv.Itoa(server.nextId)
+			server.nextId++
+			notes = append(notes, note)
+			w.Header().Set("Location", "/readNote/"+segments[1]+"/"+note.Id)
+		} else if i := index(notes); i >= 0 {
+			note.Id = notes[i].Id
+			notes[i] = note
+		} else {
+			return
+		}
+		notebooks[segments[1]] = notes
+		json.NewEncoder(w).Encode(notes)
+	case "readNote":
+		notes, ok := notes()
+		if !ok {
+			return
+		}
+		if i := index(notes); i >= 0 {
+			if r.Header.Get("Accept") == "text/markdown" {
+				document, _ := noteDocument(client.NoteInput{Title: notes[i].Title, Body: notes[i].Body, Format: notes[i].Format, Tags: notes[i].Tags})
+				w.Write([]byte(document))
+				return
+			}
+			json.NewEncoder(w).Encode(notes[i])
+		}
+	case "deleteNote":
+		notes, ok := notes()
+		if !ok {
+			return
+		}
+		if i := index(notes); i >= 0 {
+			notebooks[segments[1]] = append(notes[:i], notes[i+1:]...)
+			json.NewEncoder(w).Encode(notebooks[segments[1]])
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func Test_CLI(t *testing.T) {
+	server := &fakeServer{notebooks: map[string][]client.Note{"Work": {}, "Home": {
+		{Id: "100", Title: "Pansies", Body: "that's for thoughts", Tags: []string{"Flowers"}},
+	}}, shared: map[string]map[string][]client.Note{"laertes": {"Letters": {
+		{Id: "200", Title: "Farewell", Body: "my necessaries are embarked"},
+	}}}}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	dir := t.TempDir()
+	env := map[string]string{"NEVERNOTE_CONFIG": filepath.Join(dir, "config.yaml")}
+	run := func(stdin string, args ...string) (string, string, int) {
+		var stdout, stderr bytes.Buffer
+		app := &cli{stdin: strings.NewReader(stdin), stdout: &stdout, stderr: &stderr, lookupEnv: func(key string) (string, bool) {
+			value, found := env[key]
+			return value, found
+		}}
+		status := app.run(args)
+		return stdout.String(), stderr.String(), status
+	}
+
+	// commands need a server
+	if _, stderr, status := run("", "nb", "ls"); status != 1 || !strings.Contains(stderr, "profile add") {
+		t.Errorf("nb ls without a profile returned unexpected status or error: got %v %v", status, stderr)
+	}
+
+	// the first profile becomes the current one, the file is private
+	if _, stderr, status := run("", "profile", "add", "elsinore", "--url", httpServer.URL, "--username", "ophelia", "--password", "get thee to a nunnery", "--notebook", "Work"); status != 0 {
+		t.Fatalf("profile add failed: %v", stderr)
+	}
+	if _, stderr, status := run("", "profile", "add", "broken", "--url", httpServer.URL, "--username", "ophelia", "--password", "wrong"); status != 0 {
+		t.Fatalf("profile add failed: %v", stderr)
+	}
+	if info, err := os.Stat(env["NEVERNOTE_CONFIG"]); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("profiles file has wrong permissions: got %v %v", info.Mode(), err)
+	}
+	stdout, _, _ := run("", "profile", "ls")
+	if !strings.Contains(stdout, "*  elsinore  "+httpServer.URL) || !strings.Contains(stdout, "broken") {
+		t.Errorf("profile ls printed unexpected table:\n%v", stdout)
+	}
+	if _, stderr, status := run("", "nb", "ls", "--profile", "broken"); status != 1 || !strings.Contains(stderr, "401") {
+		t.Errorf("nb ls with a wrong password returned unexpected status or error: got %v %v", status, stderr)
+	}
+
+	// table and JSON output
+	stdout, _, _ = run("", "nb", "ls")
+	if !strings.HasPrefix(stdout, "NOTEBOOK\n") || !strings.Contains(stdout, "Work\n") || !strings.Contains(stdout, "Home\n") {
+		t.Errorf("nb ls printed unexpected table:\n%v", stdout)
+	}
+
+	// notes from stdin, front matter and flags set the metadata
+	stdout, stderr, status := run("---\ntitle: Flowers\ntags: [Herbs]\n---\n\nThere's *rosemary*\n", "note", "add", "--tag", "Remembrance", "-o", "json")
+	var note client.Note
+	if err := json.Unmarshal([]byte(stdout), &note); status != 0 || err != nil {
+		t.Fatalf("note add failed: %v %v %v", stdout, stderr, err)
+	}
+	if note.Title != "Flowers" || note.Body != "There's *rosemary*\n" || note.Format != client.FormatMarkdown || strings.Join(note.Tags, ",") != "Remembrance" {
+		t.Errorf("note add created unexpected note: got %+v", note)
+	}
+	run("# Columbines\n\nfor you", "note", "add", "-n", "Home")
+	if notes := server.notebooks["Home"]; len(notes) != 2 || notes[1].Title != "Columbines" {
+		t.Errorf("note add without a title created unexpected notes: got %+v", notes)
+	}
+
+	// notes are found by id in the notebook of the profile unless --notebook is given
+	if _, stderr, status := run("", "note", "cat", "100"); status != 1 || !strings.Contains(stderr, `"100" does not exist`) {
+		t.Errorf("note cat found a note outside the notebook of the profile: %v %v", status, stderr)
+	}
+	stdout, _, _ = run("", "note", "cat", "100", "-n", "Home")
+	if !strings.HasPrefix(stdout, "---\ntitle: Pansies\n") || !strings.HasSuffix(stdout, "\nthat's for thoughts") {
+		t.Errorf("note cat printed unexpected document:\n%v", stdout)
+	}
+
+	// edit runs the editor on the document and uploads the result
+	editor := filepath.Join(dir, "editor.sh")
+	os.WriteFile(editor, []byte("#!/bin/sh\nsed -i 's/rosemary/rue/; s/Herbs\\|Remembrance/Grace/' \"$1\"\n"), 0700)
+	env["EDITOR"] = editor
+	if _, stderr, status := run("", "note", "edit", note.Id); status != 0 {
+		t.Fatalf("note edit failed: %v", stderr)
+	}
+	if edited := server.notebooks["Work"][0]; edited.Body != "There's *rue*\n" || strings.Join(edited.Tags, ",") != "Grace" || edited.Title != "Flowers" {
+		t.Errorf("note edit uploaded unexpected note: got %+v", edited)
+	}
+	env["EDITOR"] = "true"
+	if _, stderr, _ := run("", "note", "edit", note.Id); !strings.Contains(stderr, "unchanged") {
+		t.Errorf("note edit without changes did not report it: %v", stderr)
+	}
+
+	// search matches text in every notebook
+	stdout, _, _ = run("", "search", "FOR")
+	if lines := strings.Split(strings.TrimSpace(stdout), "\n"); len(lines) != 3 || !strings.Contains(stdout, "Pansies") || !strings.Contains(stdout, "Columbines") {
+		t.Errorf("search printed unexpected table:\n%v", stdout)
+	}
+
+	// completion of commands and note ids
+	if stdout, _, status := run("", "completion", "bash"); status != 0 || !strings.Contains(stdout, "__start_nevernote") {
+		t.Errorf("completion bash printed unexpected script: %v", status)
+	}
+	if stdout, _, _ := run("", "__complete", "note", "rm", ""); !strings.Contains(stdout, note.Id+"\tFlowers") {
+		t.Errorf("note ids were not completed: %v", stdout)
+	}
+
+	// a profile with an owner finds notes and completes ids in the notebooks the owner shared
+	if _, stderr, status := run("", "profile", "add", "laertes", "--url", httpServer.URL, "--username", "ophelia", "--password", "get thee to a nunnery", "--owner", "laertes"); status != 0 {
+		t.Fatalf("profile add failed: %v", stderr)
+	}
+	if stdout, stderr, _ := run("", "note", "cat", "200", "-p", "laertes"); !strings.Contains(stdout, "title: Farewell") {
+		t.Errorf("note cat did not find the shared note: %v %v", stdout, stderr)
+	}
+	if stdout, _, _ := run("", "__complete", "note", "cat", "-p", "laertes", ""); !strings.Contains(stdout, "200\tFarewell") || strings.Contains(stdout, "100") {
+		t.Errorf("shared note ids were not completed: %v", stdout)
+	}
+	if stdout, _, _ := run("", "__complete", "note", "ls", "-p", "laertes", ""); !strings.Contains(stdout, "Letters") || strings.Contains(stdout, "Home") {
+		t.Errorf("shared notebooks were not completed: %v", stdout)
+	}
+
+	if _, stderr, status := run("", "note", "rm", note.Id, "404"); status != 1 || !strings.Contains(stderr, `"404" does not exist`) || len(server.notebooks["Work"]) != 0 {
+		t.Errorf("note rm returned unexpected status or error: got %v %v", status, stderr)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"github.com/spf13/cobra"
+	"strings"
+)
+
+func (app *cli) notebookCommand() *cobra.Command {
+	/**
+	Function: notebookCommand
+	Description: nevernote nb ls|create|rm
+	*/
+	command := &cobra.Command{Use: "nb", Aliases: []string{"notebook"}, Short: "Manage notebooks"}
+
+	list := &cobra.Command{
+		Use:   "ls",
+		Short: "List the notebooks",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, _, err := app.client()
+			if err != nil {
+				return err
+			}
+			titles, err := c.ListNotebooks(cmd.Context())
+			if err != nil {
+				return err
+			}
+			return app.printTitles(titles)
+		},
+	}
+
+	create := &cobra.Command{
+		Use:   "create <title>",
+		Short: "Create a notebook",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, _, err := app.client()
+			if err != nil {
+				return err
+			}
+			titles, err := c.CreateNotebook(cmd.Context(), args[0])
+			if err != nil {
+				return err
+			}
+			return app.printTitles(titles)
+		},
+	}
+
+	remove := &cobra.Command{
+		Use:               "rm <title>",
+		Short:             "Delete a notebook and its notes",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: app.completeOwnNotebooks,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, _, err := app.client()
+			if err != nil {
+				return err
+			}
+			titles, err := c.DeleteNotebook(cmd.Context(), args[0])
+			if err != nil {
+				return err
+			}
+			return app.printTitles(titles)
+		},
+	}
+
+	command.AddCommand(list, create, remove)
+	return command
+}
+
+func (app *cli) printTitles(titles []string) error {
+	if app.output == outputJSON {
+		if titles == nil {
+			titles = []string{}
+		}
+		return app.printJSON(titles)
+	}
+	rows := make([][]string, len(titles))
+	for i, title := range titles {
+		rows[i] = []string{title}
+	}
+	return app.printTable([]string{"NOTEBOOK"}, rows)
+}
+
+func (app *cli) completeNotebooks(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	/**
+	Function: completeNotebooks
+	Description: Complete the first argument with the notebooks notes are read from, the
+	             notebooks the owner of the profile shared when it has one
+	*/
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	return app.notebookTitles(cmd, toComplete)
+}
+
+func (app *cli) completeOwnNotebooks(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	/**
+	Function: completeOwnNotebooks
+	Description: Complete the first argument with the notebooks of the user, the only
+	             ones nb commands change
+	*/
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	c, _, err := app.client()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	titles, err := c.ListNotebooks(cmd.Context())
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	return matchingTitles(titles, toComplete), cobra.ShellCompDirectiveNoFileComp
+}
+
+func (app *cli) notebookTitles(cmd *cobra.Command, toComplete string) ([]string, cobra.ShellCompDirective) {
+	c, _, err := app.client()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	titles, err := c.NotebookTitles(cmd.Context())
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	return matchingTitles(titles, toComplete), cobra.ShellCompDirectiveNoFileComp
+}
+
+func matchingTitles(titles []string, toComplete string) []string {
+	var matches []string
+	for _, title := range titles {
+		if strings.HasPrefix(title, toComplete) {
+			matches = append(matches, title)
+		}
+	}
+	return matches
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"app/client"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// representations of note cat, the Accept header sent for each
+var noteFormats = map[string]string{
+	"markdown": "text/markdown",
+	"html":     "text/html",
+	"text":     "text/plain",
+}
+
+func (app *cli) noteCommand() *cobra.Command {
+	/**
+	Function: noteCommand
+	Description: nevernote note ls|add|cat|edit|rm
+	*/
+	command := &cobra.Command{Use: "note", Short: "Manage notes"}
+	command.PersistentFlags().StringVarP(&app.notebook, "notebook", "n", "", "notebook of the notes (default the notebook of the profile), notes given by id are looked for in every notebook without one")
+	command.RegisterFlagCompletionFunc("notebook", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return app.notebookTitles(cmd, toComplete)
+	})
+
+	var listTags []string
+	list := &cobra.Command{
+		Use:               "ls [notebook]",
+		Short:             "List the notes of a notebook",
+		Args:              cobra.MaximumNArgs(1),
+		ValidArgsFunction: app.completeNotebooks,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, profile, err := app.client()
+			if err != nil {
+				return err
+			}
+			notebook := app.notebookOf(profile)
+			if len(args) == 1 {
+				notebook = args[0]
+			}
+			if notebook == "" {
+				return errors.New("need a notebook, as an argument or with --notebook")
+			}
+			notes, err := c.ListNotes(cmd.Context(), notebook, listTags...)
+			if err != nil {
+				return err
+			}
+			return app.printNotes(notes)
+		},
+	}
+	list.Flags().StringArrayVarP(&listTags, "tag", "t", nil, "only notes with this tag, repeat for several")
+	list.RegisterFlagCompletionFunc("tag", app.completeTags)
+
+	var input client.NoteInput
+	add := &cobra.Command{
+		Use:   "add [file]",
+		Short: "Add a note from a file or stdin, YAML front matter sets the title, tags and format",
+		Long: "Add a note from a file or stdin. The document may start with YAML front matter\n" +
+			"(title, tags, format) like the one \"note cat\" prints, flags take precedence.\n" +
+			"Without a title the first line of the document is used.",
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, profile, err := app.client()
+			if err != nil {
+				return err
+			}
+			notebook := app.notebookOf(profile)
+			if notebook == "" {
+				return errors.New("need a notebook, use --notebook or set one in the profile")
+			}
+
+			var document []byte
+			if len(args) == 1 && args[0] != "-" {
+				document, err = os.ReadFile(args[0])
+			} else {
+				document, err = io.ReadAll(app.stdin)
+			}
+			if err != nil {
+				return err
+			}
+			note, err := parseNoteDocument(string(document))
+			if err != nil {
+				return err
+			}
+			if input.Title != "" {
+				note.Title = input.Title
+			}
+			if len(input.Tags) > 0 {
+				note.Tags = input.Tags
+			}
+			if input.Format != "" {
+				note.Format = input.Format
+			}
+			if note.Title == "" {
+				note.Title = firstLine(note.Body)
+			}
+			if note.Format == "" && (len(args) == 0 || strings.EqualFold(filepath.Ext(args[0]), ".md")) {
+				note.Format = client.FormatMarkdown
+			}
+
+			created, err := c.CreateNote(cmd.Context(), notebook, note)
+			if err != nil {
+				return err
+			}
+			return app.printNote(created)
+		},
+	}
+	add.Flags().StringVar(&input.Title, "title", "", "title of the note")
+	add.Flags().StringArrayVarP(&input.Tags, "tag", "t", nil, "tag of the note, repeat for several")
+	add.Flags().StringVar(&input.Format, "format", "", "format of the body: plain, markdown or html (default markdown for stdin and .md files)")
+	add.RegisterFlagCompletionFunc("tag", app.completeTags)
+	add.RegisterFlagCompletionFunc("format", cobra.FixedCompletions([]string{client.FormatPlain, client.FormatMarkdown, client.FormatHTML}, cobra.ShellCompDirectiveNoFileComp))
+
+	var catFormat string
+	cat := &cobra.Command{
+		Use:               "cat <id>",
+		Short:             "Print a note as Markdown with front matter, HTML or text (JSON with -o json)",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: app.completeNoteIds,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, profile, err := app.client()
+			if err != nil {
+				return err
+			}
+			notebook, note, err := app.findNote(cmd.Context(), c, profile, args[0])
+			if err != nil {
+				return err
+			}
+			if app.output == outputJSON {
+				return app.printJSON(note)
+			}
+			mediaType, found := noteFormats[catFormat]
+			if !found {
+				return fmt.Errorf("unsupported format %q, use markdown, html or text", catFormat)
+			}
+			text, err := c.ReadNoteAs(cmd.Context(), notebook, note.Id, mediaType)
+			if err != nil {
+				return err
+			}
+			_, err = io.WriteString(app.stdout, text)
+			return err
+		},
+	}
+	cat.Flags().StringVar(&catFormat, "format", "markdown", "markdown, html or text")
+	cat.RegisterFlagCompletionFunc("format", cobra.FixedCompletions([]string{"markdown", "html", "text"}, cobra.ShellCompDirectiveNoFileComp))
+
+	var rewriteLinks bool
+	edit := &cobra.Command{
+		Use:               "edit <id>",
+		Short:             "Edit a note in $VISUAL or $EDITOR and upload the result",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: app.completeNoteIds,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, profile, err := app.client()
+			if err != nil {
+				return err
+			}
+			notebook, note, err := app.findNote(cmd.Context(), c, profile, args[0])
+			if err != nil {
+				return err
+			}
+			original := client.NoteInput{Title: note.Title, Body: note.Body, Format: note.Format, Tags: note.Tags}
+			edited, err := app.editNote(original)
+			if err != nil {
+				return err
+			}
+			if sameNote(original, edited) {
+				fmt.Fprintln(app.stderr, "nevernote: note unchanged, not uploaded")
+				return nil
+			}
+			updated, err := c.UpdateNote(cmd.Context(), notebook, note.Id, edited, rewriteLinks)
+			if err != nil {
+				return err
+			}
+			return app.printNote(updated)
+		},
+	}
+	edit.Flags().BoolVar(&rewriteLinks, "rewrite-links", false, "when the title changes, update the [[links]] of other notes to it")
+
+	remove := &cobra.Command{
+		Use:               "rm <id>...",
+		Short:             "Delete notes",
+		Args:              cobra.MinimumNArgs(1),
+		ValidArgsFunction: app.completeNoteIds,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, profile, err := app.client()
+			if err != nil {
+				return err
+			}
+			for _, id := range args {
+				notebook, note, err := app.findNote(cmd.Context(), c, profile, id)
+				if err != nil {
+					return err
+				}
+				if err := c.DeleteNote(cmd.Context(), notebook, note.Id); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+
+	command.AddCommand(list, add, cat, edit, remove)
+	return command
+}
+
+func (app *cli) searchCommand() *cobra.Command {
+	/**
+	Function: searchCommand
+	Description: nevernote search [text] --tag ... --notebook ...
+	*/
+	var query client.SearchQuery
+	command := &cobra.Command{
+		Use:   "search [text]",
+		Short: "Find notes by tags and text in their title or body",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, _, err := app.client()
+			if err != nil {
+				return err
+			}
+			if len(args) == 1 {
+				query.Text = args[0]
+			}
+			if query.Text == "" && len(query.Tags) == 0 {
+				return errors.New("need text or --tag to search for")
+			}
+			matches, err := c.SearchNotes(cmd.Context(), query)
+			if err != nil {
+				return err
+			}
+			if app.output == outputJSON {
+				if matches == nil {
+					matches = []client.NoteMatch{}
+				}
+				return app.printJSON(matches)
+			}
+			rows := make([][]string, 0, len(matches))
+			for _, match := range matches {
+				rows = append(rows, []string{match.Notebook, match.Id, match.Title, strings.Join(match.Tags, ",")})
+			}
+			return app.printTable([]string{"NOTEBOOK", "ID", "TITLE", "TAGS"}, rows)
+		},
+	}
+	command.Flags().StringArrayVarP(&query.Tags, "tag", "t", nil, "only notes with this tag, repeat for several")
+	command.Flags().StringVarP(&query.Notebook, "notebook", "n", "", "only this notebook (default every notebook)")
+	command.RegisterFlagCompletionFunc("tag", app.completeTags)
+	command.RegisterFlagCompletionFunc("notebook", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return app.notebookTitles(cmd, toComplete)
+	})
+	return command
+}
+
+func (app *cli) notebookOf(profile Profile) string {
+	if app.notebook != "" {
+		return app.notebook
+	}
+	return profile.Notebook
+}
+
+func (app *cli) findNote(ctx context.Context, c *client.Client, profile Profile, id string) (string, client.Note, error) {
+	/**
+	Function: findNote
+	Description: A note by id and its notebook. Note ids are unique on a server, without
+	             --notebook or a notebook in the profile every notebook is searched
+	*/
+	if notebook := app.notebookOf(profile); notebook != "" {
+		note, err := c.ReadNote(ctx, notebook, id)
+		return notebook, note, err
+	}
+	notebooks, err := c.NotebookTitles(ctx)
+	if err != nil {
+		return "", client.Note{}, err
+	}
+	for _, notebook := range notebooks {
+		notes, err := c.ListNotes(ctx, notebook)
+		if err != nil {
+			return "", client.Note{}, err
+		}
+		for _, note := range notes {
+			if note.Id == id {
+				return notebook, note, nil
+			}
+		}
+	}
+	return "", client.Note{}, fmt.Errorf("note with id %q does not exist", id)
+}
+
+func (app *cli) printNote(note client.Note) error {
+	if app.output == outputJSON {
+		return app.printJSON(note)
+	}
+	return app.printNotes([]client.Note{note})
+}
+
+// frontMatter is the part of a note that can be edited besides its body
+type frontMatter struct {
+	Title  string   `yaml:"title"`
+	Format string   `yaml:"format,omitempty"`
+	Tags   []string `yaml:"tags"`
+}
+
+func noteDocument(note client.NoteInput) (string, error) {
+	/**
+	Function: noteDocument
+	Description: A note as a Markdown document with YAML front matter, for editing
+	*/
+	tags := note.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	header, err := yaml.Marshal(frontMatter{Title: note.Title, Format: note.Format, Tags: tags})
+	if err != nil {
+		return "", err
+	}
+	return "---\n" + string(header) + "---\n\n" + note.Body, nil
+}
+
+func parseNoteDocument(document string) (client.NoteInput, error) {
+	/**
+	Function: parseNoteDocument
+	Description: Split a document into its front matter (if any) and body. The front matter
+	             "note cat" prints has more fields, those are ignored
+	*/
+	note := client.NoteInput{Body: document, Tags: []string{}}
+	document = strings.ReplaceAll(document, "\r\n", "\n")
+	if !strings.HasPrefix(document, "---\n") {
+		return note, nil
+	}
+	header, body, found := strings.Cut(document[len("---\n"):], "\n---\n")
+	if !found {
+		return note, errors.New("front matter is not closed by a --- line")
+	}
+
+	var matter frontMatter
+	if err := yaml.Unmarshal([]byte(header), &matter); err != nil {
+		return note, fmt.Errorf("could not read the front matter: %v", err)
+	}
+	note.Title = matter.Title
+	note.Format = matter.Format
+	if matter.Tags != nil {
+		note.Tags = matter.Tags
+	}
+	// the blank line noteDocument puts after the front matter
+	note.Body = strings.TrimPrefix(body, "\n")
+	return note, nil
+}
+
+func firstLine(body string) string {
+	/**
+	Function: firstLine
+	Description: The first non empty line of a body without Markdown heading marks, the
+	             default title of a note
+	*/
+	for _, line := range strings.Split(body, "\n") {
+		if line = strings.TrimSpace(strings.TrimLeft(line, "# ")); line != "" {
+			return line
+		}
+	}
+	return ""
+}
+
+func sameNote(a client.NoteInput, b client.NoteInput) bool {
+	return a.Title == b.Title && a.Body == b.Body && a.Format == b.Format && strings.Join(a.Tags, "\x00") == strings.Join(b.Tags, "\x00")
+}
+
+func (app *cli) editNote(note client.NoteInput) (client.NoteInput, error) {
+	/**
+	Function: editNote
+	Description: Open a note in the editor of the user and read it back
+	*/
+	editor := app.getenv("VISUAL")
+	if editor == "" {
+		editor = app.getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+
+	document, err := noteDocument(note)
+	if err != nil {
+		return note, err
+	}
+	file, err := os.CreateTemp("", "nevernote-*.md")
+	if err != nil {
+		return note, err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.WriteString(document); err != nil {
+		file.Close()
+		return note, err
+	}
+	if err := file.Close(); err != nil {
+		return note, err
+	}
+
+	// editors are often given with arguments, ex. "code --wait"
+	words := strings.Fields(editor)
+	command := exec.Command(words[0], append(words[1:], file.Name())...)
+	command.Stdin, command.Stdout, command.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := command.Run(); err != nil {
+		return note, fmt.Errorf("editor %q failed: %v", editor, err)
+	}
+
+	edited, err := os.ReadFile(file.Name())
+	if err != nil {
+		return note, err
+	}
+	if len(bytes.TrimSpace(edited)) == 0 {
+		return note, errors.New("the edited note is empty, not uploaded")
+	}
+	return parseNoteDocument(string(edited))
+}
+
+func (app *cli) completeNoteIds(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	/**
+	Function: completeNoteIds
+	Description: Complete note ids, with their titles as descriptions
+	*/
+	c, profile, err := app.client()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	notebooks := []string{app.notebookOf(profile)}
+	if notebooks[0] == "" {
+		if notebooks, err = c.NotebookTitles(cmd.Context()); err != nil {
+			return nil, cobra.ShellCompDirectiveError
+		}
+	}
+	var ids []string
+	for _, notebook := range notebooks {
+		notes, err := c.ListNotes(cmd.Context(), notebook)
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveError
+		}
+		for _, note := range notes {
+			if strings.HasPrefix(note.Id, toComplete) {
+				ids = append(ids, note.Id+"\t"+note.Title)
+			}
+		}
+	}
+	return ids, cobra.ShellCompDirectiveNoFileComp
+}
+
+func (app *cli) completeTags(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	c, profile, err := app.client()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	suggestions, err := c.AutocompleteTags(cmd.Context(), toComplete, client.TagQuery{Notebook: app.notebookOf(profile)})
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	tags := make([]string, len(suggestions))
+	for i, suggestion := range suggestions {
+		tags[i] = suggestion.Tag
+	}
+	return tags, cobra.ShellCompDirectiveNoFileComp
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"app/client"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+)
+
+func (app *cli) printJSON(value interface{}) error {
+	encoder := json.NewEncoder(app.stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+func (app *cli) printTable(header []string, rows [][]string) error {
+	/**
+	Function: printTable
+	Description: Print rows as aligned columns under header
+	*/
+	writer := tabwriter.NewWriter(app.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(writer, strings.Join(row, "\t"))
+	}
+	return writer.Flush()
+}
+
+func (app *cli) printNotes(notes []client.Note) error {
+	if app.output == outputJSON {
+		if notes == nil {
+			notes = []client.Note{}
+		}
+		return app.printJSON(notes)
+	}
+	rows := make([][]string, 0, len(notes))
+	for _, note := range notes {
+		rows = append(rows, []string{note.Id, note.Title, strings.Join(note.Tags, ","), note.LastModified})
+	}
+	return app.printTable([]string{"ID", "TITLE", "TAGS", "MODIFIED"}, rows)
+}
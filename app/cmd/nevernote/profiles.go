@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Profile is one server and the credentials to use with it
+type Profile struct {
+	URL      string `yaml:"url"`
+	APIKey   string `yaml:"api_key,omitempty"`
+	Token    string `yaml:"token,omitempty"`
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	// notebooks of this user instead of your own, when shared with you
+	Owner string `yaml:"owner,omitempty"`
+	// notebook used when a command is not given one
+	Notebook string `yaml:"notebook,omitempty"`
+}
+
+// Config is the profiles file
+type Config struct {
+	Current  string             `yaml:"current,omitempty"`
+	Profiles map[string]Profile `yaml:"profiles"`
+}
+
+func (app *cli) configFile() (string, error) {
+	if app.configPath != "" {
+		return app.configPath, nil
+	}
+	if path := app.getenv("NEVERNOTE_CONFIG"); path != "" {
+		return path, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "nevernote", "config.yaml"), nil
+}
+
+func (app *cli) loadConfig() (Config, error) {
+	/**
+	Function: loadConfig
+	Description: Read the profiles file, a missing file has no profiles
+	*/
+	config := Config{Profiles: map[string]Profile{}}
+	path, err := app.configFile()
+	if err != nil {
+		return config, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("could not read %v: %v", path, err)
+	}
+	if config.Profiles == nil {
+		config.Profiles = map[string]Profile{}
+	}
+	return config, nil
+}
+
+func (app *cli) saveConfig(config Config) error {
+	/**
+	Function: saveConfig
+	Description: Write the profiles file, only readable by the user as it holds credentials
+	*/
+	path, err := app.configFile()
+	if err != nil {
+		return err
+	}
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+func (app *cli) profileName(config Config) string {
+	if app.profile != "" {
+		return app.profile
+	}
+	if name := app.getenv("NEVERNOTE_PROFILE"); name != "" {
+		return name
+	}
+	return config.Current
+}
+
+func (app *cli) profileCommand() *cobra.Command {
+	/**
+	Function: profileCommand
+	Description: nevernote profile ls|add|use|rm
+	*/
+	command := &cobra.Command{Use: "profile", Short: "Manage the servers and credentials to use"}
+
+	list := &cobra.Command{
+		Use:   "ls",
+		Short: "List the profiles",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config, err := app.loadConfig()
+			if err != nil {
+				return err
+			}
+			names := make([]string, 0, len(config.Profiles))
+			for name := range config.Profiles {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			current := app.profileName(config)
+			if app.output == outputJSON {
+				profiles := make([]map[string]interface{}, 0, len(names))
+				for _, name := range names {
+					profile := config.Profiles[name]
+					profiles = append(profiles, map[string]interface{}{"Name": name, "URL": profile.URL, "Auth": authMethod(profile), "Notebook": profile.Notebook, "Current": name == current})
+				}
+				return app.printJSON(profiles)
+			}
+			rows := make([][]string, 0, len(names))
+			for _, name := range names {
+				profile := config.Profiles[name]
+				marker := ""
+				if name == current {
+					marker = "*"
+				}
+				rows = append(rows, []string{marker, name, profile.URL, authMethod(profile), profile.Notebook})
+			}
+			return app.printTable([]string{"", "NAME", "URL", "AUTH", "NOTEBOOK"}, rows)
+		},
+	}
+
+	var profile Profile
+	add := &cobra.Command{
+		Use:   "add <name>",
+		Short: "Add or replace a profile, the first one becomes the current profile",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if profile.URL == "" {
+				return errors.New("need --url to add a profile")
+			}
+			config, err := app.loadConfig()
+			if err != nil {
+				return err
+			}
+			config.Profiles[args[0]] = profile
+			if config.Current == "" {
+				config.Current = args[0]
+			}
+			return app.saveConfig(config)
+		},
+	}
+	add.Flags().StringVar(&profile.URL, "url", "", "server URL (ex. http://localhost:5000)")
+	add.Flags().StringVar(&profile.APIKey, "api-key", "", "API key")
+	add.Flags().StringVar(&profile.Token, "token", "", "session access token")
+	add.Flags().StringVar(&profile.Username, "username", "", "username for basic authentication")
+	add.Flags().StringVar(&profile.Password, "password", "", "password for basic authentication")
+	add.Flags().StringVar(&profile.Owner, "owner", "", "work on the notebooks this user shared with you")
+	add.Flags().StringVar(&profile.Notebook, "notebook", "", "notebook used when a command is not given one")
+
+	use := &cobra.Command{
+		Use:               "use <name>",
+		Short:             "Make a profile the current one",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: app.completeProfiles,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config, err := app.loadConfig()
+			if err != nil {
+				return err
+			}
+			if _, found := config.Profiles[args[0]]; !found {
+				return fmt.Errorf("profile %q does not exist", args[0])
+			}
+			config.Current = args[0]
+			return app.saveConfig(config)
+		},
+	}
+
+	remove := &cobra.Command{
+		Use:               "rm <name>",
+		Short:             "Remove a profile",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: app.completeProfiles,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config, err := app.loadConfig()
+			if err != nil {
+				return err
+			}
+			if _, found := config.Profiles[args[0]]; !found {
+				return fmt.Errorf("profile %q does not exist", args[0])
+			}
+			delete(config.Profiles, args[0])
+			if config.Current == args[0] {
+				config.Current = ""
+			}
+			return app.saveConfig(config)
+		},
+	}
+
+	command.AddCommand(list, add, use, remove)
+	return command
+}
+
+func authMethod(profile Profile) string {
+	switch {
+	case profile.Token != "":
+		return "token"
+	case profile.APIKey != "":
+		return "api key"
+	case profile.Username != "":
+		return "password (" + profile.Username + ")"
+	}
+	return "none"
+}
+
+func (app *cli) completeProfiles(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	config, err := app.loadConfig()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	var names []string
+	for name := range config.Profiles {
+		if strings.HasPrefix(name, toComplete) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
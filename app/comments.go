@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Comment is a remark on a note, anybody with at least the commenter role
+// on the notebook can add one
+type Comment struct {
+	Id      string `json:"Id"`
+	Author  string `json:"Author"`
+	Body    string `json:"Body"`
+	Created string `json:"Created"`
+}
+
+var commentIdCounter int
+
+func addComment(w http.ResponseWriter, r *http.Request) {
+	/**
+	Function: addComment
+	Description: Comment on a note (based on id) in a notebook
+	*/
+	owner, notebooks, ok := ownerNotebooks(w, r, RoleCommenter)
+	if !ok {
+		return
+	}
+
+	vars := mux.Vars(r)
+	title := vars["title"]
+	noteId := vars["noteId"]
+
+	reqBody, _ := ioutil.ReadAll(r.Body)
+	var request struct {
+		Body string `json:"Body"`
+	}
+	json.Unmarshal(reqBody, &request)
+	if request.Body == "" {
+		returnStatusError(w, http.StatusBadRequest, "Need Body to add a comment")
+		return
+	}
+
+	if notebooks[title] == nil {
+		returnError(w, "Notebook \""+title+"\" does not exist")
+		return
+	}
+	i, found := findNoteIndex(notebooks, title, noteId)
+	if !found {
+		returnError(w, "Note with id \""+noteId+"\" does not exist")
+		return
+	}
+
+	// comments do not change the note itself, so LastModified is kept
+	note := &notebooks[title][i]
+	before := *note
+	comment := Comment{
+		Id:      strconv.Itoa(commentIdCounter),
+		Author:  requestUsername(r),
+		Body:    request.Body,
+		Created: time.Now().Format("2006.01.02 15:04:05"),
+	}
+	note.Comments = append(note.Comments, comment)
+	commentIdCounter++
+	audit(r, AuditEvent{Action: AuditCommentAdd, Owner: owner, Notebook: title, NoteId: noteId, Target: comment.Id}, before, *note)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(note)
+}
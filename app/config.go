@@ -0,0 +1,467 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is every setting of the server. Settings are read from the
+// defaults, then a YAML or TOML config file, then environment variables and
+// finally command line flags, each overriding the ones before. The env and
+// flag tags name the environment variable and flag of a setting, secrets
+// have no flag so they don't show up in the process list.
+type Config struct {
+	Listen   string        `yaml:"listen" toml:"listen" env:"NEVERNOTE_LISTEN" flag:"listen" usage:"address to listen on"`
+	Storage  StorageConfig `yaml:"storage" toml:"storage"`
+	Timeouts TimeoutConfig `yaml:"timeouts" toml:"timeouts"`
+	Limits   LimitConfig   `yaml:"limits" toml:"limits"`
+	Log      LogConfig     `yaml:"log" toml:"log"`
+	Tracing  TracingConfig `yaml:"tracing" toml:"tracing"`
+	TLS      TLSConfig     `yaml:"tls" toml:"tls"`
+	Auth     AuthConfig    `yaml:"auth" toml:"auth"`
+	Features FeatureConfig `yaml:"features" toml:"features"`
+}
+
+type StorageConfig struct {
+	Backend string `yaml:"backend" toml:"backend" env:"NEVERNOTE_STORAGE_BACKEND" flag:"storage-backend" usage:"storage backend, only memory is supported"`
+	Path    string `yaml:"path" toml:"path" env:"NEVERNOTE_STORAGE_PATH" flag:"storage-path" usage:"directory for attachments, uploads and the audit log"`
+}
+
+type TimeoutConfig struct {
+	ReadHeader Duration `yaml:"read_header" toml:"read_header" env:"NEVERNOTE_READ_HEADER_TIMEOUT" flag:"read-header-timeout" usage:"time to read the request headers"`
+	Read       Duration `yaml:"read" toml:"read" env:"NEVERNOTE_READ_TIMEOUT" flag:"read-timeout" usage:"time to read a whole request, 0 for no limit"`
+	Write      Duration `yaml:"write" toml:"write" env:"NEVERNOTE_WRITE_TIMEOUT" flag:"write-timeout" usage:"time to write a response, 0 for no limit"`
+	Idle       Duration `yaml:"idle" toml:"idle" env:"NEVERNOTE_IDLE_TIMEOUT" flag:"idle-timeout" usage:"time to keep idle connections open"`
+	Shutdown   Duration `yaml:"shutdown" toml:"shutdown" env:"NEVERNOTE_SHUTDOWN_TIMEOUT" flag:"shutdown-timeout" usage:"time to finish requests on shutdown"`
+	Drain      Duration `yaml:"drain" toml:"drain" env:"NEVERNOTE_DRAIN_DELAY" flag:"drain-delay" usage:"time /readyz fails before shutting down, for load balancers to notice"`
+	Stream     Duration `yaml:"stream" toml:"stream" env:"NEVERNOTE_STREAM_TIMEOUT" flag:"stream-timeout" usage:"time to upload or download an attachment or upload chunk instead of the read and write timeouts, 0 for no limit"`
+	Upload     Duration `yaml:"upload" toml:"upload" env:"NEVERNOTE_UPLOAD_EXPIRY" flag:"upload-expiry" usage:"time to finish a resumable upload before it is deleted, 0 to keep them"`
+}
+
+type LimitConfig struct {
+	MaxNotes           int     `yaml:"max_notes" toml:"max_notes" env:"NEVERNOTE_MAX_NOTES" flag:"max-notes" usage:"notes per user, 0 for unlimited"`
+	MaxBodyBytes       int64   `yaml:"max_body_bytes" toml:"max_body_bytes" env:"NEVERNOTE_MAX_BODY_BYTES" flag:"max-body-bytes" usage:"bytes per note body, 0 for unlimited"`
+	MaxAttachmentBytes int64   `yaml:"max_attachment_bytes" toml:"max_attachment_bytes" env:"NEVERNOTE_MAX_ATTACHMENT_BYTES" flag:"max-attachment-bytes" usage:"attachment bytes per user, 0 for unlimited"`
+	MaxUploadBytes     int64   `yaml:"max_upload_bytes" toml:"max_upload_bytes" env:"NEVERNOTE_MAX_UPLOAD_BYTES" flag:"max-upload-bytes" usage:"bytes per resumable upload"`
+	MaxRequestBytes    int64   `yaml:"max_request_bytes" toml:"max_request_bytes" env:"NEVERNOTE_MAX_REQUEST_BYTES" flag:"max-request-bytes" usage:"bytes per request body, except attachments and uploads"`
+	MaxHeaderBytes     int     `yaml:"max_header_bytes" toml:"max_header_bytes" env:"NEVERNOTE_MAX_HEADER_BYTES" flag:"max-header-bytes" usage:"bytes of request headers"`
+	MinFreeDiskBytes   int64   `yaml:"min_free_disk_bytes" toml:"min_free_disk_bytes" env:"NEVERNOTE_MIN_FREE_DISK_BYTES" flag:"min-free-disk-bytes" usage:"free bytes of the storage path below which /readyz fails"`
+	RateLimit          float64 `yaml:"rate_limit" toml:"rate_limit" env:"NEVERNOTE_RATE_LIMIT" flag:"rate-limit" usage:"requests per second per client"`
+	RateLimitBurst     int     `yaml:"rate_limit_burst" toml:"rate_limit_burst" env:"NEVERNOTE_RATE_LIMIT_BURST" flag:"rate-limit-burst" usage:"requests a client can make at once"`
+}
+
+type LogConfig struct {
+	Level  string `yaml:"level" toml:"level" env:"NEVERNOTE_LOG_LEVEL" flag:"log-level" usage:"debug, info, warn or error"`
+	Format string `yaml:"format" toml:"format" env:"NEVERNOTE_LOG_FORMAT" flag:"log-format" usage:"json or text"`
+}
+
+type TracingConfig struct {
+	Endpoint    string  `yaml:"endpoint" toml:"endpoint" env:"NEVERNOTE_TRACING_ENDPOINT" flag:"tracing-endpoint" usage:"OTLP/HTTP collector URL (ex. http://localhost:4318), tracing is off when empty"`
+	ServiceName string  `yaml:"service_name" toml:"service_name" env:"NEVERNOTE_TRACING_SERVICE_NAME" flag:"tracing-service-name" usage:"service name of the spans"`
+	SampleRatio float64 `yaml:"sample_ratio" toml:"sample_ratio" env:"NEVERNOTE_TRACING_SAMPLE_RATIO" flag:"tracing-sample-ratio" usage:"fraction of new traces recorded, 0 to 1"`
+}
+
+type TLSConfig struct {
+	CertFile     string   `yaml:"cert_file" toml:"cert_file" env:"NEVERNOTE_TLS_CERT" flag:"tls-cert" usage:"PEM certificate, serves HTTPS when set"`
+	KeyFile      string   `yaml:"key_file" toml:"key_file" env:"NEVERNOTE_TLS_KEY" flag:"tls-key" usage:"PEM private key of the certificate"`
+	MinVersion   string   `yaml:"min_version" toml:"min_version" env:"NEVERNOTE_TLS_MIN_VERSION" flag:"tls-min-version" usage:"oldest TLS version, 1.2 or 1.3"`
+	Ciphers      []string `yaml:"ciphers" toml:"ciphers" env:"NEVERNOTE_TLS_CIPHERS" flag:"tls-ciphers" usage:"comma separated TLS 1.2 cipher suites, empty for Go's defaults"`
+	ClientAuth   string   `yaml:"client_auth" toml:"client_auth" env:"NEVERNOTE_TLS_CLIENT_AUTH" flag:"tls-client-auth" usage:"client certificates: none, request or require"`
+	ClientCAFile string   `yaml:"client_ca_file" toml:"client_ca_file" env:"NEVERNOTE_TLS_CLIENT_CA" flag:"tls-client-ca" usage:"PEM CAs that sign client certificates"`
+}
+
+type AuthConfig struct {
+	JWTKeys string   `yaml:"jwt_keys" toml:"jwt_keys" env:"NEVERNOTE_JWT_KEYS" secret:"true"`
+	LinkKey string   `yaml:"link_key" toml:"link_key" env:"NEVERNOTE_LINK_KEY" secret:"true"`
+	Admins  []string `yaml:"admins" toml:"admins" env:"NEVERNOTE_ADMINS" flag:"admins" usage:"comma separated usernames that can read the audit log and collect blobs"`
+}
+
+type FeatureConfig struct {
+	Sharing     bool `yaml:"sharing" toml:"sharing" env:"NEVERNOTE_FEATURE_SHARING" flag:"feature-sharing" usage:"share notebooks and comment on notes"`
+	PublicLinks bool `yaml:"public_links" toml:"public_links" env:"NEVERNOTE_FEATURE_PUBLIC_LINKS" flag:"feature-public-links" usage:"public read-only links"`
+	Uploads     bool `yaml:"uploads" toml:"uploads" env:"NEVERNOTE_FEATURE_UPLOADS" flag:"feature-uploads" usage:"resumable uploads"`
+	Metrics     bool `yaml:"metrics" toml:"metrics" env:"NEVERNOTE_FEATURE_METRICS" flag:"feature-metrics" usage:"Prometheus metrics at /metrics"`
+}
+
+// Duration is a time.Duration written like "30s" or "5m"
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Settings is the configuration the server runs with
+var Settings = defaultConfig()
+
+const redacted = "[redacted]"
+
+func defaultConfig() Config {
+	return Config{
+		Listen:  ":5000",
+		Storage: StorageConfig{Backend: "memory", Path: "data"},
+		Timeouts: TimeoutConfig{
+			ReadHeader: Duration(10 * time.Second),
+			Read:       Duration(time.Minute),
+			Write:      Duration(2 * time.Minute),
+			Idle:       Duration(2 * time.Minute),
+			Shutdown:   Duration(30 * time.Second),
+			Stream:     Duration(time.Hour),
+			Upload:     Duration(24 * time.Hour),
+		},
+		Limits: LimitConfig{
+			MaxUploadBytes:   4 << 30,
+			MaxRequestBytes:  8 << 20,
+			MaxHeaderBytes:   64 << 10,
+			MinFreeDiskBytes: 64 << 20,
+			RateLimit:        20,
+			RateLimitBurst:   40,
+		},
+		Log:      LogConfig{Level: "info", Format: "json"},
+		Tracing:  TracingConfig{ServiceName: "nevernote", SampleRatio: 1},
+		TLS:      TLSConfig{MinVersion: "1.2", ClientAuth: "none"},
+		Features: FeatureConfig{Sharing: true, PublicLinks: true, Uploads: true, Metrics: true},
+	}
+}
+
+// configField is a setting that can be set from the environment or a flag
+type configField struct {
+	value  reflect.Value
+	field  reflect.StructField
+	secret bool
+}
+
+func configFields(value reflect.Value) []configField {
+	/**
+	Function: configFields
+	Description: Every setting of a config struct, including the ones of nested sections
+	*/
+	var fields []configField
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if field.Type.Kind() == reflect.Struct {
+			fields = append(fields, configFields(value.Field(i))...)
+			continue
+		}
+		fields = append(fields, configField{value: value.Field(i), field: field, secret: field.Tag.Get("secret") == "true"})
+	}
+	return fields
+}
+
+func (setting configField) set(text string) error {
+	/**
+	Function: set
+	Description: Parse the text of an environment variable or flag into a setting
+	*/
+	if unmarshaler, ok := setting.value.Addr().Interface().(interface{ UnmarshalText([]byte) error }); ok {
+		return unmarshaler.UnmarshalText([]byte(text))
+	}
+	switch setting.value.Kind() {
+	case reflect.String:
+		setting.value.SetString(text)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(text)
+		if err != nil {
+			return errors.New("need true or false")
+		}
+		setting.value.SetBool(parsed)
+	case reflect.Int, reflect.Int64:
+		parsed, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return errors.New("need a whole number")
+		}
+		setting.value.SetInt(parsed)
+	case reflect.Float64:
+		parsed, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return errors.New("need a number")
+		}
+		setting.value.SetFloat(parsed)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(text, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		setting.value.Set(reflect.ValueOf(items))
+	default:
+		return errors.New("unsupported setting type " + setting.value.Type().String())
+	}
+	return nil
+}
+
+func readConfigFile(path string, config *Config) error {
+	/**
+	Function: readConfigFile
+	Description: Read a YAML (.yaml, .yml) or TOML (.toml) config file, unknown settings are errors
+	*/
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(file)
+		decoder.KnownFields(true)
+		if err := decoder.Decode(config); err != nil && err != io.EOF {
+			return err
+		}
+	case ".toml":
+		metadata, err := toml.NewDecoder(file).Decode(config)
+		if err != nil {
+			return err
+		}
+		if undecoded := metadata.Undecoded(); len(undecoded) > 0 {
+			return errors.New("unknown setting \"" + undecoded[0].String() + "\"")
+		}
+	default:
+		return errors.New("unsupported config file format \"" + filepath.Ext(path) + "\", use .yaml, .yml or .toml")
+	}
+	return nil
+}
+
+func loadConfig(args []string, getenv func(string) string, output io.Writer) (Config, bool, error) {
+	/**
+	Function: loadConfig
+	Description: Load the configuration from the config file (-config or NEVERNOTE_CONFIG),
+	             environment and flags and validate it. The bool is set by -print-config
+	*/
+	config := defaultConfig()
+	fields := configFields(reflect.ValueOf(&config).Elem())
+
+	flags := flag.NewFlagSet("nevernote", flag.ContinueOnError)
+	flags.SetOutput(output)
+	configPath := flags.String("config", getenv("NEVERNOTE_CONFIG"), "YAML or TOML config file")
+	printConfig := flags.Bool("print-config", false, "print the configuration with secrets redacted and exit")
+
+	// flags are applied last, after the config file and environment
+	type flagValue struct {
+		setting configField
+		text    string
+	}
+	var flagValues []flagValue
+	for _, setting := range fields {
+		if setting.field.Tag.Get("flag") == "" {
+			continue
+		}
+		setting := setting
+		usage := setting.field.Tag.Get("usage") + " (" + setting.field.Tag.Get("env") + ")"
+		record := func(text string) error {
+			flagValues = append(flagValues, flagValue{setting, text})
+			return nil
+		}
+		if setting.value.Kind() == reflect.Bool {
+			flags.BoolFunc(setting.field.Tag.Get("flag"), usage, record)
+		} else {
+			flags.Func(setting.field.Tag.Get("flag"), usage, record)
+		}
+	}
+	if err := flags.Parse(args); err != nil {
+		return Config{}, false, err
+	}
+	if flags.NArg() > 0 {
+		return Config{}, false, errors.New("unexpected argument \"" + flags.Arg(0) + "\"")
+	}
+
+	if *configPath != "" {
+		if err := readConfigFile(*configPath, &config); err != nil {
+			return Config{}, false, errors.New("config file " + *configPath + ": " + err.Error())
+		}
+	}
+	for _, setting := range fields {
+		name := setting.field.Tag.Get("env")
+		if text := getenv(name); text != "" {
+			if err := setting.set(text); err != nil {
+				return Config{}, false, errors.New(name + ": " + err.Error())
+			}
+		}
+	}
+	for _, value := range flagValues {
+		if err := value.setting.set(value.text); err != nil {
+			return Config{}, false, errors.New("-" + value.setting.field.Tag.Get("flag") + ": " + err.Error())
+		}
+	}
+
+	if err := config.validate(); err != nil {
+		return Config{}, false, err
+	}
+	return config, *printConfig, nil
+}
+
+func (config Config) validate() error {
+	/**
+	Function: validate
+	Description: Check every setting, reporting all problems at once
+	*/
+	var problems []error
+	problem := func(setting string, message string) {
+		problems = append(problems, errors.New(setting+": "+message))
+	}
+
+	if _, _, err := net.SplitHostPort(config.Listen); err != nil {
+		problem("listen", "need host:port like \":5000\", got \""+config.Listen+"\"")
+	}
+	if config.Storage.Backend != "memory" {
+		problem("storage.backend", "unsupported backend \""+config.Storage.Backend+"\", only memory is supported")
+	}
+	if config.Storage.Path == "" {
+		problem("storage.path", "need a directory")
+	}
+
+	timeouts := []struct {
+		setting string
+		value   Duration
+	}{
+		{"timeouts.read_header", config.Timeouts.ReadHeader},
+		{"timeouts.read", config.Timeouts.Read},
+		{"timeouts.write", config.Timeouts.Write},
+		{"timeouts.idle", config.Timeouts.Idle},
+		{"timeouts.shutdown", config.Timeouts.Shutdown},
+		{"timeouts.drain", config.Timeouts.Drain},
+		{"timeouts.stream", config.Timeouts.Stream},
+		{"timeouts.upload", config.Timeouts.Upload},
+	}
+	for _, timeout := range timeouts {
+		if timeout.value < 0 {
+			problem(timeout.setting, "cannot be negative")
+		}
+	}
+
+	if config.Limits.MaxNotes < 0 {
+		problem("limits.max_notes", "cannot be negative")
+	}
+	if config.Limits.MaxBodyBytes < 0 {
+		problem("limits.max_body_bytes", "cannot be negative")
+	}
+	if config.Limits.MaxAttachmentBytes < 0 {
+		problem("limits.max_attachment_bytes", "cannot be negative")
+	}
+	if config.Limits.MaxUploadBytes <= 0 {
+		problem("limits.max_upload_bytes", "must be more than 0")
+	}
+	if config.Limits.MaxRequestBytes <= 0 {
+		problem("limits.max_request_bytes", "must be more than 0")
+	}
+	if config.Limits.MaxHeaderBytes < 4096 {
+		problem("limits.max_header_bytes", "must be at least 4096")
+	}
+	if config.Limits.MinFreeDiskBytes < 0 {
+		problem("limits.min_free_disk_bytes", "cannot be negative")
+	}
+	if config.Limits.RateLimit <= 0 {
+		problem("limits.rate_limit", "must be more than 0")
+	}
+	if config.Limits.RateLimitBurst < 1 {
+		problem("limits.rate_limit_burst", "must be at least 1")
+	}
+
+	if _, found := logLevels[config.Log.Level]; !found {
+		problem("log.level", "unsupported level \""+config.Log.Level+"\", use debug, info, warn or error")
+	}
+	if config.Log.Format != "json" && config.Log.Format != "text" {
+		problem("log.format", "unsupported format \""+config.Log.Format+"\", use json or text")
+	}
+
+	if config.Tracing.Endpoint != "" {
+		if endpoint, err := url.Parse(config.Tracing.Endpoint); err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			problem("tracing.endpoint", "need an http or https URL, ex. http://localhost:4318")
+		}
+	}
+	if config.Tracing.ServiceName == "" {
+		problem("tracing.service_name", "cannot be empty")
+	}
+	if config.Tracing.SampleRatio < 0 || config.Tracing.SampleRatio > 1 {
+		problem("tracing.sample_ratio", "must be between 0 and 1")
+	}
+
+	if (config.TLS.CertFile == "") != (config.TLS.KeyFile == "") {
+		problem("tls", "need both cert_file and key_file")
+	}
+	if _, found := tlsVersions[config.TLS.MinVersion]; !found {
+		problem("tls.min_version", "unsupported version \""+config.TLS.MinVersion+"\", use 1.2 or 1.3")
+	}
+	for _, name := range config.TLS.Ciphers {
+		if _, found := tlsCipherSuite(name); !found {
+			problem("tls.ciphers", "unknown or insecure cipher suite \""+name+"\"")
+		}
+	}
+	if _, found := tlsClientAuth[config.TLS.ClientAuth]; !found {
+		problem("tls.client_auth", "unsupported policy \""+config.TLS.ClientAuth+"\", use none, request or require")
+	} else if config.TLS.ClientAuth != "none" && config.TLS.ClientCAFile == "" {
+		problem("tls.client_ca_file", "needed to verify client certificates")
+	}
+	if config.TLS.ClientCAFile != "" && config.TLS.CertFile == "" {
+		problem("tls.client_ca_file", "client certificates need cert_file and key_file")
+	}
+	for setting, path := range map[string]string{"tls.cert_file": config.TLS.CertFile, "tls.key_file": config.TLS.KeyFile, "tls.client_ca_file": config.TLS.ClientCAFile} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			problem(setting, err.Error())
+		}
+	}
+
+	// report the problem without the secret itself
+	if _, err := parseSigningKeys(config.Auth.JWTKeys); err != nil {
+		problem("auth.jwt_keys", err.Error())
+	}
+	if _, err := parseLinkKey(config.Auth.LinkKey); err != nil {
+		problem("auth.link_key", err.Error())
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n%w", errors.Join(problems...))
+	}
+	return nil
+}
+
+func (config Config) redacted() Config {
+	/**
+	Function: redacted
+	Description: A copy of the configuration with every set secret replaced by [redacted]
+	*/
+	for _, setting := range configFields(reflect.ValueOf(&config).Elem()) {
+		if setting.secret && setting.value.String() != "" {
+			setting.value.SetString(redacted)
+		}
+	}
+	return config
+}
+
+func writeConfig(w io.Writer, config Config) error {
+	/**
+	Function: writeConfig
+	Description: Write the configuration as YAML with secrets redacted
+	*/
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(config.redacted()); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+func freeDiskBytes(path string) (uint64, error) {
+	return 0, errors.New("free disk space is not supported on this platform")
+}
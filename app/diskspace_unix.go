@@ -0,0 +1,17 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+func freeDiskBytes(path string) (uint64, error) {
+	/**
+	Function: freeDiskBytes
+	Description: Bytes of the file system of path available to the server
+	*/
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
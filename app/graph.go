@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// GraphNode is a note or a tag in the exported note graph
+type GraphNode struct {
+	Label    string            `json:"label"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// GraphEdge is a link between notes or the membership of a note in a tag
+type GraphEdge struct {
+	Source   string `json:"source"`
+	Target   string `json:"target"`
+	Relation string `json:"relation"`
+}
+
+// NoteGraph follows the JSON Graph Format (https://jsongraphformat.info)
+type NoteGraph struct {
+	Graph struct {
+		Directed bool                 `json:"directed"`
+		Nodes    map[string]GraphNode `json:"nodes"`
+		Edges    []GraphEdge          `json:"edges"`
+	} `json:"graph"`
+}
+
+const (
+	graphNodeNote = "note"
+	graphNodeTag  = "tag"
+
+	graphEdgeLink   = "links"
+	graphEdgeTagged = "tagged"
+)
+
+func noteNodeId(ref noteRef) string {
+	return graphNodeNote + ":" + ref.Notebook + "/" + ref.Id
+}
+
+func tagNodeId(tag string) string {
+	return graphNodeTag + ":" + tag
+}
+
+func buildNoteGraph(owner string, notebookTitle string, tags []string) NoteGraph {
+	/**
+	Function: buildNoteGraph
+	Description: Graph of the notes of a user, their tags and the links between them,
+	             limited to a notebook and/or notes having all the given tags
+	*/
+	var graph NoteGraph
+	graph.Graph.Directed = true
+	graph.Graph.Nodes = make(map[string]GraphNode)
+	graph.Graph.Edges = []GraphEdge{}
+
+	var refs []noteRef
+	for _, title := range sortedNotebookTitles(owner) {
+		if notebookTitle != "" && title != notebookTitle {
+			continue
+		}
+		for _, note := range Notebooks[owner][title] {
+			if !isSubset(tags, note.Tags) {
+				continue
+			}
+			ref := noteRef{Owner: owner, Notebook: title, Id: note.Id}
+			refs = append(refs, ref)
+			graph.Graph.Nodes[noteNodeId(ref)] = GraphNode{
+				Label: note.Title,
+				Metadata: map[string]string{
+					"type":     graphNodeNote,
+					"notebook": title,
+					"id":       note.Id,
+				},
+			}
+
+			for _, tag := range uniqueTags(note.Tags) {
+				graph.Graph.Nodes[tagNodeId(tag)] = GraphNode{
+					Label:    tag,
+					Metadata: map[string]string{"type": graphNodeTag},
+				}
+				graph.Graph.Edges = append(graph.Graph.Edges, GraphEdge{Source: noteNodeId(ref), Target: tagNodeId(tag), Relation: graphEdgeTagged})
+			}
+		}
+	}
+
+	// only keep links between notes that made it into the graph
+	for _, ref := range refs {
+		for _, link := range resolveLinks(ref) {
+			if link.Broken {
+				continue
+			}
+			target := noteNodeId(noteRef{Owner: owner, Notebook: link.Notebook, Id: link.Id})
+			if _, included := graph.Graph.Nodes[target]; included {
+				graph.Graph.Edges = append(graph.Graph.Edges, GraphEdge{Source: noteNodeId(ref), Target: target, Relation: graphEdgeLink})
+			}
+		}
+	}
+
+	return graph
+}
+
+func dotQuote(s string) string {
+	return "\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\r\n", "\\n", "\r", "\\n", "\n", "\\n").Replace(s) + "\""
+}
+
+func (graph NoteGraph) dot() string {
+	/**
+	Function: dot
+	Description: Graphviz DOT version of the note graph
+	*/
+	ids := make([]string, 0, len(graph.Graph.Nodes))
+	for id := range graph.Graph.Nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var buf strings.Builder
+	buf.WriteString("digraph nevernote {\n")
+	for _, id := range ids {
+		node := graph.Graph.Nodes[id]
+		if node.Metadata["type"] == graphNodeTag {
+			buf.WriteString("  " + dotQuote(id) + " [label=" + dotQuote("#"+node.Label) + ", shape=ellipse];\n")
+		} else {
+			buf.WriteString("  " + dotQuote(id) + " [label=" + dotQuote(node.Label) + ", shape=box];\n")
+		}
+	}
+	for _, edge := range graph.Graph.Edges {
+		style := "solid"
+		if edge.Relation == graphEdgeTagged {
+			style = "dashed"
+		}
+		buf.WriteString("  " + dotQuote(edge.Source) + " -> " + dotQuote(edge.Target) + " [label=" + dotQuote(edge.Relation) + ", style=" + style + "];\n")
+	}
+	buf.WriteString("}\n")
+	return buf.String()
+}
+
+func noteGraph(w http.ResponseWriter, r *http.Request) {
+	/**
+	Function: noteGraph
+	Description: Export notes, tags and links as a JSON graph or Graphviz DOT
+	*/
+	owner, notebooks, ok := ownerNotebooks(w, r, RoleOwner)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	notebookTitle := query.Get("notebook")
+	if notebookTitle != "" && notebooks[notebookTitle] == nil {
+		returnError(w, "Notebook \""+notebookTitle+"\" does not exist")
+		return
+	}
+
+	graph := buildNoteGraph(owner, notebookTitle, query["tag"])
+
+	switch query.Get("format") {
+	case "", "json":
+		json.NewEncoder(w).Encode(graph)
+	case "dot":
+		w.Header().Set("Content-Type", "text/vnd.graphviz; charset=utf-8")
+		io.WriteString(w, graph.dot())
+	default:
+		returnError(w, "Unsupported graph format \""+query.Get("format")+"\"")
+	}
+}
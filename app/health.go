@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Server states reported by /readyz. Servers started by startServer are
+// starting until the stores are loaded and draining once they are stopped,
+// only ready servers take traffic.
+const (
+	StateStarting = "starting"
+	StateReady    = "ready"
+	StateDraining = "draining"
+)
+
+type readinessState struct {
+	mu    sync.Mutex
+	state string
+}
+
+// Readiness is the state of the server
+var Readiness = &readinessState{state: StateReady}
+
+func (readiness *readinessState) set(state string) {
+	readiness.mu.Lock()
+	defer readiness.mu.Unlock()
+	readiness.state = state
+}
+
+func (readiness *readinessState) get() string {
+	readiness.mu.Lock()
+	defer readiness.mu.Unlock()
+	return readiness.state
+}
+
+// storesLoading is set while startServer loads the stores in the background.
+// Requests only get to the stores once it is cleared, which publishes them
+var storesLoading atomic.Bool
+
+// indexesBuilt is set once the tag index and link graph have been built
+var indexesBuilt atomic.Bool
+
+const defaultHealthCheckTimeout = 2 * time.Second
+
+// healthCheck is a named probe of a dependency the server needs to serve requests
+type healthCheck struct {
+	name    string
+	timeout time.Duration
+	check   func(ctx context.Context) error
+}
+
+type healthRegistry struct {
+	mu     sync.Mutex
+	checks []healthCheck
+}
+
+// HealthChecks are the checks /readyz runs
+var HealthChecks = &healthRegistry{}
+
+// HealthCheckResult is the outcome of one check
+type HealthCheckResult struct {
+	Name       string `json:"Name"`
+	Status     string `json:"Status"`
+	Error      string `json:"Error,omitempty"`
+	DurationMs int64  `json:"DurationMs"`
+}
+
+// HealthReport is the body of /livez and /readyz
+type HealthReport struct {
+	Status string              `json:"Status"`
+	State  string              `json:"State,omitempty"`
+	Checks []HealthCheckResult `json:"Checks,omitempty"`
+}
+
+func (registry *healthRegistry) register(name string, timeout time.Duration, check func(ctx context.Context) error) {
+	/**
+	Function: register
+	Description: Add a check, replacing an earlier check with the same name
+	*/
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	if timeout <= 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+	for i := range registry.checks {
+		if registry.checks[i].name == name {
+			registry.checks[i] = healthCheck{name, timeout, check}
+			return
+		}
+	}
+	registry.checks = append(registry.checks, healthCheck{name, timeout, check})
+}
+
+func (registry *healthRegistry) run(ctx context.Context) ([]HealthCheckResult, bool) {
+	/**
+	Function: run
+	Description: Run every check concurrently, each within its timeout, reporting whether all of them passed
+	*/
+	registry.mu.Lock()
+	checks := append([]healthCheck(nil), registry.checks...)
+	registry.mu.Unlock()
+
+	results := make([]HealthCheckResult, len(checks))
+	var wait sync.WaitGroup
+	for i, check := range checks {
+		wait.Add(1)
+		go func(i int, check healthCheck) {
+			defer wait.Done()
+			results[i] = runHealthCheck(ctx, check)
+		}(i, check)
+	}
+	wait.Wait()
+
+	healthy := true
+	for _, result := range results {
+		healthy = healthy && result.Status == "ok"
+	}
+	return results, healthy
+}
+
+func runHealthCheck(ctx context.Context, check healthCheck) HealthCheckResult {
+	ctx, cancel := context.WithTimeout(ctx, check.timeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- check.check(ctx) }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		// a check stuck on a hanging disk must not hang the probe
+		err = errors.New("timed out after " + check.timeout.String())
+	}
+
+	result := HealthCheckResult{Name: check.name, Status: "ok", DurationMs: time.Since(start).Milliseconds()}
+	if err != nil {
+		result.Status = "failing"
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func writeHealthReport(w http.ResponseWriter, report HealthReport) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+func livez(w http.ResponseWriter, r *http.Request) {
+	/**
+	Function: livez
+	Description: Liveness probe, the process is up and serving HTTP. Dependencies are
+	             left to /readyz so a broken disk doesn't get the server restarted in a loop
+	*/
+	writeHealthReport(w, HealthReport{Status: "ok"})
+}
+
+func readyz(w http.ResponseWriter, r *http.Request) {
+	/**
+	Function: readyz
+	Description: Readiness probe, runs every health check and reports each of them,
+	             503 while starting, draining or when a check fails
+	*/
+	state := Readiness.get()
+	if state != StateReady {
+		writeHealthReport(w, HealthReport{Status: "unavailable", State: state})
+		return
+	}
+
+	checks, healthy := HealthChecks.run(r.Context())
+	report := HealthReport{Status: "ok", State: state, Checks: checks}
+	if !healthy {
+		report.Status = "unavailable"
+	}
+	writeHealthReport(w, report)
+}
+
+// routes of the health checks and metrics
+var healthRoutes = map[string]bool{
+	"/healthcheck": true,
+	"/livez":       true,
+	"/readyz":      true,
+	"/metrics":     true,
+}
+
+// routes answered while the stores are loading, they don't use the stores.
+// /metrics waits as it counts the notes
+var startingRoutes = map[string]bool{
+	"/healthcheck": true,
+	"/livez":       true,
+	"/readyz":      true,
+}
+
+func requireReady(next http.Handler) http.Handler {
+	/**
+	Function: requireReady
+	Description: Middleware answering 503 while the stores are still being loaded
+	*/
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if storesLoading.Load() {
+			if route := mux.CurrentRoute(r); route != nil {
+				if template, err := route.GetPathTemplate(); err == nil && startingRoutes[template] {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			w.Header().Set("Retry-After", "1")
+			returnStatusError(w, http.StatusServiceUnavailable, "Server is starting")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func checkStorage(ctx context.Context) error {
+	/**
+	Function: checkStorage
+	Description: The storage path can be written to
+	*/
+	file, err := os.CreateTemp(Settings.Storage.Path, ".readyz-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.WriteString("ok"); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func checkDiskSpace(ctx context.Context) error {
+	/**
+	Function: checkDiskSpace
+	Description: The storage path has at least limits.min_free_disk_bytes free
+	*/
+	free, err := freeDiskBytes(Settings.Storage.Path)
+	if err != nil {
+		return err
+	}
+	if free < uint64(Settings.Limits.MinFreeDiskBytes) {
+		return errors.New(strconv.FormatUint(free, 10) + " bytes free, need " + strconv.FormatInt(Settings.Limits.MinFreeDiskBytes, 10))
+	}
+	return nil
+}
+
+func checkIndexes(ctx context.Context) error {
+	if !indexesBuilt.Load() {
+		return errors.New("tag index and link graph are not built")
+	}
+	return nil
+}
+
+func checkAuditLog(ctx context.Context) error {
+	/**
+	Function: checkAuditLog
+	Description: The audit log file is open and its last write succeeded. Notes are kept in
+	             memory without a write-ahead log, the audit log is the only file every change
+	             is appended to. A failed write is logged and does not fail the change
+	*/
+	return Audit.writable()
+}
+
+func registerHealthChecks() {
+	/**
+	Function: registerHealthChecks
+	Description: Register the checks of the stores used by the server
+	*/
+	HealthChecks.register("storage", 0, checkStorage)
+	HealthChecks.register("disk_space", 0, checkDiskSpace)
+	HealthChecks.register("indexes", 0, checkIndexes)
+	HealthChecks.register("audit_log", 0, checkAuditLog)
+}
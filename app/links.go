@@ -0,0 +1,436 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// NoteLink is a [[wiki link]] found in a note body and the note it points at
+type NoteLink struct {
+	Text     string `json:"Text"`
+	Notebook string `json:"Notebook,omitempty"`
+	Id       string `json:"Id,omitempty"`
+	Title    string `json:"Title,omitempty"`
+	Broken   bool   `json:"Broken"`
+}
+
+// LinkedNote identifies a note that links to another note
+type LinkedNote struct {
+	Notebook string `json:"Notebook"`
+	Id       string `json:"Id"`
+	Title    string `json:"Title"`
+	Text     string `json:"Text,omitempty"`
+}
+
+// noteRef identifies a note, ids are only unique within a notebook and
+// notebook titles only within the notebooks of a user
+type noteRef struct {
+	Owner    string
+	Notebook string
+	Id       string
+}
+
+type linkGraph struct {
+	mu sync.Mutex
+	// note -> link targets as written in the note body
+	outgoing map[noteRef][]string
+	// normalized link target -> notes linking to it
+	incoming map[string]map[noteRef]bool
+}
+
+// LinkGraph holds the [[wiki links]] between notes, parsed when notes are saved
+var LinkGraph = newLinkGraph()
+
+// matches [[target]] and [[target|label]]
+var wikiLinkPattern = regexp.MustCompile(`\[\[([^\[\]|]+)(\|[^\[\]]*)?\]\]`)
+
+func newLinkGraph() *linkGraph {
+	return &linkGraph{
+		outgoing: make(map[noteRef][]string),
+		incoming: make(map[string]map[noteRef]bool),
+	}
+}
+
+func normalizeLinkTarget(target string) string {
+	return strings.ToLower(strings.TrimSpace(target))
+}
+
+func parseLinks(body string) []string {
+	/**
+	Function: parseLinks
+	Description: Find the targets of all [[wiki links]] in a note body
+	*/
+	var targets []string
+	seen := make(map[string]bool)
+	for _, match := range wikiLinkPattern.FindAllStringSubmatch(body, -1) {
+		target := strings.TrimSpace(match[1])
+		if target == "" || seen[normalizeLinkTarget(target)] {
+			continue
+		}
+		seen[normalizeLinkTarget(target)] = true
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+func (g *linkGraph) set(owner string, notebookTitle string, note Note) {
+	/**
+	Function: set
+	Description: Replace the outgoing links of a note with the links in its body
+	*/
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ref := noteRef{Owner: owner, Notebook: notebookTitle, Id: note.Id}
+	g.removeLocked(ref)
+
+	targets := parseLinks(note.Body)
+	if len(targets) == 0 {
+		return
+	}
+	g.outgoing[ref] = targets
+	for _, target := range targets {
+		key := normalizeLinkTarget(target)
+		if g.incoming[key] == nil {
+			g.incoming[key] = make(map[noteRef]bool)
+		}
+		g.incoming[key][ref] = true
+	}
+}
+
+func (g *linkGraph) remove(owner string, notebookTitle string, note Note) {
+	/**
+	Function: remove
+	Description: Drop all outgoing links of a note
+	*/
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.removeLocked(noteRef{Owner: owner, Notebook: notebookTitle, Id: note.Id})
+}
+
+func (g *linkGraph) removeLocked(ref noteRef) {
+	for _, target := range g.outgoing[ref] {
+		key := normalizeLinkTarget(target)
+		delete(g.incoming[key], ref)
+		if len(g.incoming[key]) == 0 {
+			delete(g.incoming, key)
+		}
+	}
+	delete(g.outgoing, ref)
+}
+
+func (g *linkGraph) size() int {
+	/**
+	Function: size
+	Description: Number of links between notes in the graph
+	*/
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	size := 0
+	for _, targets := range g.outgoing {
+		size += len(targets)
+	}
+	return size
+}
+
+func (g *linkGraph) links(ref noteRef) []string {
+	/**
+	Function: links
+	Description: Link targets as written in a note
+	*/
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]string(nil), g.outgoing[ref]...)
+}
+
+func (g *linkGraph) linking(owner string, targets ...string) []noteRef {
+	/**
+	Function: linking
+	Description: Notes of a user with a link to any of the targets
+	*/
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	seen := make(map[noteRef]bool)
+	var refs []noteRef
+	for _, target := range targets {
+		for ref := range g.incoming[normalizeLinkTarget(target)] {
+			if ref.Owner == owner && !seen[ref] {
+				seen[ref] = true
+				refs = append(refs, ref)
+			}
+		}
+	}
+	sortNoteRefs(refs)
+	return refs
+}
+
+func (g *linkGraph) sources(owner string) []noteRef {
+	/**
+	Function: sources
+	Description: Every note of a user that has at least one outgoing link
+	*/
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var refs []noteRef
+	for ref := range g.outgoing {
+		if ref.Owner == owner {
+			refs = append(refs, ref)
+		}
+	}
+	sortNoteRefs(refs)
+	return refs
+}
+
+func sortNoteRefs(refs []noteRef) {
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].Notebook != refs[j].Notebook {
+			return refs[i].Notebook < refs[j].Notebook
+		}
+		return refs[i].Id < refs[j].Id
+	})
+}
+
+func rebuildLinkGraph() {
+	/**
+	Function: rebuildLinkGraph
+	Description: Rebuild the link graph from every note in every notebook of every user
+	*/
+	graph := newLinkGraph()
+	for owner, notebooks := range Notebooks {
+		for title, notebook := range notebooks {
+			for _, note := range notebook {
+				graph.set(owner, title, note)
+			}
+		}
+	}
+	LinkGraph = graph
+}
+
+func sortedNotebookTitles(owner string) []string {
+	titles := make([]string, 0, len(Notebooks[owner]))
+	for title := range Notebooks[owner] {
+		titles = append(titles, title)
+	}
+	sort.Strings(titles)
+	return titles
+}
+
+func findNote(ref noteRef) (Note, bool) {
+	/**
+	Function: findNote
+	Description: Look up a note by owner, notebook and id
+	*/
+	for _, note := range Notebooks[ref.Owner][ref.Notebook] {
+		if note.Id == ref.Id {
+			return note, true
+		}
+	}
+	return Note{}, false
+}
+
+func resolveLink(owner string, target string) (string, Note, bool) {
+	/**
+	Function: resolveLink
+	Description: Find the note of a user a link points at, ids take precedence over titles
+	*/
+	titles := sortedNotebookTitles(owner)
+	target = strings.TrimSpace(target)
+
+	for _, title := range titles {
+		for _, note := range Notebooks[owner][title] {
+			if note.Id == target {
+				return title, note, true
+			}
+		}
+	}
+	for _, title := range titles {
+		for _, note := range Notebooks[owner][title] {
+			if strings.EqualFold(strings.TrimSpace(note.Title), target) {
+				return title, note, true
+			}
+		}
+	}
+	return "", Note{}, false
+}
+
+func resolveLinks(ref noteRef) []NoteLink {
+	/**
+	Function: resolveLinks
+	Description: Outgoing links of a note with the notes they point at
+	*/
+	links := []NoteLink{}
+	for _, target := range LinkGraph.links(ref) {
+		link := NoteLink{Text: target, Broken: true}
+		if notebookTitle, note, found := resolveLink(ref.Owner, target); found {
+			link.Notebook = notebookTitle
+			link.Id = note.Id
+			link.Title = note.Title
+			link.Broken = false
+		}
+		links = append(links, link)
+	}
+	return links
+}
+
+func rewriteLinks(r *http.Request, owner string, oldTitle string, newTitle string) {
+	/**
+	Function: rewriteLinks
+	Description: Point [[oldTitle]] links in every notebook of a user the requester may
+	             change at newTitle, keeping link labels
+	*/
+	currentTimeString := time.Now().Format("2006.01.02 15:04:05")
+	editor := requestUsername(r)
+
+	for _, ref := range LinkGraph.linking(owner, oldTitle) {
+		if !roleAllows(notebookRole(owner, ref.Notebook, editor), RoleEditor) {
+			continue
+		}
+		notebook := Notebooks[owner][ref.Notebook]
+		for i, note := range notebook {
+			if note.Id != ref.Id {
+				continue
+			}
+			body := wikiLinkPattern.ReplaceAllStringFunc(note.Body, func(link string) string {
+				match := wikiLinkPattern.FindStringSubmatch(link)
+				if normalizeLinkTarget(match[1]) != normalizeLinkTarget(oldTitle) {
+					return link
+				}
+				return "[[" + newTitle + match[2] + "]]"
+			})
+			if body != note.Body {
+				before := note
+				unindexNote(r.Context(), owner, ref.Notebook, note)
+				note.Body = body
+				note.LastModified = currentTimeString
+				notebook[i] = note
+				indexNote(r.Context(), owner, ref.Notebook, note)
+				audit(r, AuditEvent{Action: AuditNoteRewriteLinks, Owner: owner, Notebook: ref.Notebook, NoteId: note.Id}, before, note)
+			}
+		}
+	}
+}
+
+func noteLinks(w http.ResponseWriter, r *http.Request) {
+	/**
+	Function: noteLinks
+	Description: List the outgoing links of a note (based on id) in a notebook
+	*/
+	owner, notebooks, ok := ownerNotebooks(w, r, RoleViewer)
+	if !ok {
+		return
+	}
+
+	vars := mux.Vars(r)
+	title := vars["title"]
+	noteId := vars["noteId"]
+
+	if notebooks[title] == nil {
+		returnError(w, "Notebook \""+title+"\" does not exist")
+		return
+	}
+	ref := noteRef{Owner: owner, Notebook: title, Id: noteId}
+	if _, found := findNote(ref); !found {
+		returnError(w, "Note with id \""+noteId+"\" does not exist")
+		return
+	}
+
+	// a shared notebook may link into notebooks the user can't see
+	links := resolveLinks(ref)
+	username := requestUsername(r)
+	for i, link := range links {
+		if !link.Broken && !roleAllows(notebookRole(owner, link.Notebook, username), RoleViewer) {
+			links[i] = NoteLink{Text: link.Text}
+		}
+	}
+
+	json.NewEncoder(w).Encode(links)
+}
+
+func backlinks(w http.ResponseWriter, r *http.Request) {
+	/**
+	Function: backlinks
+	Description: List the notes linking to a note (based on id) in a notebook
+	*/
+	owner, notebooks, ok := ownerNotebooks(w, r, RoleViewer)
+	if !ok {
+		return
+	}
+
+	vars := mux.Vars(r)
+	title := vars["title"]
+	noteId := vars["noteId"]
+
+	if notebooks[title] == nil {
+		returnError(w, "Notebook \""+title+"\" does not exist")
+		return
+	}
+	target := noteRef{Owner: owner, Notebook: title, Id: noteId}
+	note, found := findNote(target)
+	if !found {
+		returnError(w, "Note with id \""+noteId+"\" does not exist")
+		return
+	}
+
+	// only count links that actually resolve to this note, another note
+	// may share the title or use the id
+	linkingNotes := []LinkedNote{}
+	username := requestUsername(r)
+	for _, ref := range LinkGraph.linking(owner, note.Id, note.Title) {
+		source, found := findNote(ref)
+		if !found || !roleAllows(notebookRole(owner, ref.Notebook, username), RoleViewer) {
+			continue
+		}
+		for _, link := range resolveLinks(ref) {
+			if link.Notebook == target.Notebook && link.Id == target.Id {
+				linkingNotes = append(linkingNotes, LinkedNote{Notebook: ref.Notebook, Id: source.Id, Title: source.Title})
+				break
+			}
+		}
+	}
+
+	json.NewEncoder(w).Encode(linkingNotes)
+}
+
+func brokenLinks(w http.ResponseWriter, r *http.Request) {
+	/**
+	Function: brokenLinks
+	Description: List links that do not point at any note, optionally only in one notebook
+	*/
+	owner, notebooks, ok := ownerNotebooks(w, r, RoleOwner)
+	if !ok {
+		return
+	}
+
+	notebookTitle := r.URL.Query().Get("notebook")
+	if notebookTitle != "" && notebooks[notebookTitle] == nil {
+		returnError(w, "Notebook \""+notebookTitle+"\" does not exist")
+		return
+	}
+
+	broken := []LinkedNote{}
+	for _, ref := range LinkGraph.sources(owner) {
+		if notebookTitle != "" && ref.Notebook != notebookTitle {
+			continue
+		}
+		source, found := findNote(ref)
+		if !found {
+			continue
+		}
+		for _, link := range resolveLinks(ref) {
+			if link.Broken {
+				broken = append(broken, LinkedNote{Notebook: ref.Notebook, Id: source.Id, Title: source.Title, Text: link.Text})
+			}
+		}
+	}
+
+	json.NewEncoder(w).Encode(broken)
+}
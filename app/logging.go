@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Logger writes the application and access logs, JSON lines on stderr
+// unless configured otherwise
+var Logger = slog.New(slog.NewJSONHandler(os.Stderr, nil))
+
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+func newLogger(config LogConfig, w io.Writer) *slog.Logger {
+	/**
+	Function: newLogger
+	Description: A logger with the level and format (json or text) of the configuration
+	*/
+	options := &slog.HandlerOptions{Level: logLevels[config.Level]}
+	if config.Format == "text" {
+		return slog.New(slog.NewTextHandler(w, options))
+	}
+	return slog.New(slog.NewJSONHandler(w, options))
+}
+
+func setupLogging(config LogConfig) {
+	Logger = newLogger(config, os.Stderr)
+	// messages of libraries using the log package end up in the same log
+	slog.SetDefault(Logger)
+}
+
+func fatal(message string, err error) {
+	Logger.Error(message, "error", err)
+	// os.Exit skips deferred calls, the spans leading up to the error are exported here
+	flushTracing()
+	os.Exit(1)
+}
+
+// requestLog collects what the access log line of a request needs from the
+// middlewares and handlers it passes through
+type requestLog struct {
+	user string
+}
+
+type requestLogKey struct{}
+
+func withRequestLog(r *http.Request) (*http.Request, *requestLog) {
+	entry := &requestLog{}
+	return r.WithContext(context.WithValue(r.Context(), requestLogKey{}, entry)), entry
+}
+
+func logRequestUser(r *http.Request, username string) {
+	if entry, ok := r.Context().Value(requestLogKey{}).(*requestLog); ok {
+		entry.user = username
+	}
+}
+
+func requestLogger(r *http.Request) *slog.Logger {
+	/**
+	Function: requestLogger
+	Description: The logger for messages about a request, they carry its request id
+	*/
+	return Logger.With("request_id", r.Header.Get(requestIdHeader))
+}
+
+func accessLog(next http.Handler) http.Handler {
+	/**
+	Function: accessLog
+	Description: Middleware writing one log line per request with its route, status,
+	             duration, response size, user, request id and trace id
+	*/
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		r, entry := withRequestLog(r)
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		level := slog.LevelInfo
+		if recorder.status >= 500 {
+			level = slog.LevelError
+		}
+		attributes := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("route", routeTemplate(r)),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", recorder.status),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.Int64("bytes", recorder.bytes),
+			slog.String("user", entry.user),
+			slog.String("client_ip", clientIP(r)),
+			slog.String("request_id", r.Header.Get(requestIdHeader)),
+		}
+		// traced requests can be found from their log line
+		if span := trace.SpanContextFromContext(r.Context()); span.IsValid() {
+			attributes = append(attributes, slog.String("trace_id", span.TraceID().String()))
+		}
+		Logger.LogAttrs(r.Context(), level, "request", attributes...)
+	})
+}
@@ -1,37 +1,55 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
-	"fmt"
+	"flag"
 	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 type Note struct {
-	Id           string   `json:"Id"`
-	Title        string   `json:"Title"`
-	Body         string   `json:"Body"`
-	Tags         []string `json:"Tags"`
-	Created      string   `json:"Created"`
-	LastModified string   `json:"LastModified"`
+	Id           string       `json:"Id"`
+	Title        string       `json:"Title"`
+	Body         string       `json:"Body"`
+	Format       string       `json:"Format,omitempty"`
+	Tags         []string     `json:"Tags"`
+	Attachments  []Attachment `json:"Attachments,omitempty"`
+	Comments     []Comment    `json:"Comments,omitempty"`
+	Created      string       `json:"Created"`
+	LastModified string       `json:"LastModified"`
 }
 
 // let's declare a global Notebooks hashmap that we can then populate
-// in our main function  to simulate a database
-var Notebooks map[string][]Note
+// in our main function  to simulate a database. Notebooks are kept per
+// owner (username -> notebook title -> notes) so users never see each
+// other's notes and can use the same notebook titles.
+var Notebooks map[string]map[string][]Note
+
+// notebooksMu guards Notebooks. lockNotebooks holds it for every request
+// except the unlockedRoutes, which lock around their own reads and writes
+var notebooksMu sync.RWMutex
 
 var idCounter int
 
 func healthcheck(w http.ResponseWriter, r *http.Request) {
 	/**
 	Function: healthcheck
-	Description: check if server is running
+	Description: check if server is running. Deprecated, it answers while the process is up
+	             like /livez and checks nothing, /readyz checks the stores
 	*/
 	io.WriteString(w, `{"alive": true}`)
 }
@@ -41,8 +59,12 @@ func listNotebooks(w http.ResponseWriter, r *http.Request) {
 	Function: listNotebooks
 	Description: Returns a list of all Notebook titles
 	*/
-	notebookTitles := make([]string, 0, len(Notebooks))
-	for title := range Notebooks {
+	_, notebooks, ok := ownerNotebooks(w, r, RoleOwner)
+	if !ok {
+		return
+	}
+	notebookTitles := make([]string, 0, len(notebooks))
+	for title := range notebooks {
 		notebookTitles = append(notebookTitles, title)
 	}
 	json.NewEncoder(w).Encode(notebookTitles)
@@ -53,15 +75,30 @@ func createNotebook(w http.ResponseWriter, r *http.Request) {
 	Function: createNotebook
 	Description: Creates a new notebook with a given title
 	*/
+	owner, notebooks, ok := ownerNotebooks(w, r, RoleOwner)
+	if !ok {
+		return
+	}
 
 	vars := mux.Vars(r)
 	title := vars["title"]
 
-	// add blank notebook
-	Notebooks[title] = []Note{}
+	// add blank notebook, replacing an existing one. The new notebook starts
+	// private, the shares and public links of the old one are dropped
+	var before interface{}
+	if notebooks[title] != nil {
+		before = notebooks[title]
+		Shares.removeNotebook(owner, title)
+		PublicLinks.removeNotebook(owner, title)
+	}
+	for _, note := range notebooks[title] {
+		unindexNote(r.Context(), owner, title, note)
+	}
+	notebooks[title] = []Note{}
+	audit(r, AuditEvent{Action: AuditNotebookCreate, Owner: owner, Notebook: title}, before, notebooks[title])
 
-	notebookTitles := make([]string, 0, len(Notebooks))
-	for title := range Notebooks {
+	notebookTitles := make([]string, 0, len(notebooks))
+	for title := range notebooks {
 		notebookTitles = append(notebookTitles, title)
 	}
 
@@ -73,20 +110,30 @@ func deleteNotebook(w http.ResponseWriter, r *http.Request) {
 	Function: deleteNotebook
 	Description: Deletes a notebook with a given title
 	*/
+	owner, notebooks, ok := ownerNotebooks(w, r, RoleOwner)
+	if !ok {
+		return
+	}
 
 	vars := mux.Vars(r)
 	title := vars["title"]
 
 	// delete notebook
-	if Notebooks[title] == nil {
+	if notebooks[title] == nil {
 		returnError(w, "Notebook \""+title+"\" does not exist")
 		return
 	}
-	delete(Notebooks, title)
+	for _, note := range notebooks[title] {
+		unindexNote(r.Context(), owner, title, note)
+	}
+	audit(r, AuditEvent{Action: AuditNotebookDelete, Owner: owner, Notebook: title}, notebooks[title], nil)
+	delete(notebooks, title)
+	Shares.removeNotebook(owner, title)
+	PublicLinks.removeNotebook(owner, title)
 
 	// return list of notebook titles
-	notebookTitles := make([]string, 0, len(Notebooks))
-	for title := range Notebooks {
+	notebookTitles := make([]string, 0, len(notebooks))
+	for title := range notebooks {
 		notebookTitles = append(notebookTitles, title)
 	}
 
@@ -98,11 +145,15 @@ func numberOfNotes(w http.ResponseWriter, r *http.Request) {
 	Function: numberOfNotes
 	Description: Get the number of notes in a notebook
 	*/
+	_, notebooks, ok := ownerNotebooks(w, r, RoleViewer)
+	if !ok {
+		return
+	}
 
 	vars := mux.Vars(r)
 	title := vars["title"]
 
-	numNotes := len(Notebooks[title])
+	numNotes := len(notebooks[title])
 
 	json.NewEncoder(w).Encode(numNotes)
 }
@@ -112,6 +163,10 @@ func listNotes(w http.ResponseWriter, r *http.Request) {
 	Function: listNotes
 	Description: List all notes in a notebook that match tags in body
 	*/
+	_, notebooks, ok := ownerNotebooks(w, r, RoleViewer)
+	if !ok {
+		return
+	}
 
 	vars := mux.Vars(r)
 	title := vars["title"]
@@ -123,7 +178,7 @@ func listNotes(w http.ResponseWriter, r *http.Request) {
 	json.Unmarshal(reqBody, &filter)
 
 	// get notebook
-	notebook := Notebooks[title]
+	notebook := notebooks[title]
 	if notebook == nil {
 		json.NewEncoder(w).Encode([]Note{})
 		return
@@ -131,7 +186,7 @@ func listNotes(w http.ResponseWriter, r *http.Request) {
 
 	// get valid notes
 	var filteredNotes []Note
-	for _, note := range Notebooks[title] {
+	for _, note := range notebooks[title] {
 		if isSubset(filter.Tags, note.Tags) {
 			filteredNotes = append(filteredNotes, note)
 		}
@@ -167,6 +222,10 @@ func createNote(w http.ResponseWriter, r *http.Request) {
 	Function: createNote
 	Description: Create a note in a notebook
 	*/
+	owner, notebooks, ok := ownerNotebooks(w, r, RoleEditor)
+	if !ok {
+		return
+	}
 
 	vars := mux.Vars(r)
 	title := vars["title"]
@@ -186,25 +245,38 @@ func createNote(w http.ResponseWriter, r *http.Request) {
 		returnError(w, "Need Tags to create note")
 		return
 	}
+	if !validFormat(note.Format) {
+		returnError(w, "Unsupported Format \""+note.Format+"\"")
+		return
+	}
+	if !checkNoteQuota(w, owner, note, true) {
+		return
+	}
 
 	currentTime := time.Now()
 	currentTimeString := currentTime.Format("2006.01.02 15:04:05")
 	note.Created = currentTimeString
 	note.LastModified = currentTimeString
+	note.Attachments = nil
+	note.Comments = nil
 	note.Id = strconv.Itoa(idCounter)
 	idCounter++
 
 	// get notebook
-	notebook := Notebooks[title]
+	notebook := notebooks[title]
 	if notebook == nil {
 		returnError(w, "Notebook \""+title+"\" does not exist")
 		return
 	}
 
 	// add Note to notebook
-	Notebooks[title] = append(Notebooks[title], note)
+	notebooks[title] = append(notebooks[title], note)
+	indexNote(r.Context(), owner, title, note)
+	audit(r, AuditEvent{Action: AuditNoteCreate, Owner: owner, Notebook: title, NoteId: note.Id}, nil, note)
 
-	json.NewEncoder(w).Encode(Notebooks[title])
+	// the whole notebook is returned, Location tells clients which note is new
+	w.Header().Set("Location", "/readNote/"+url.PathEscape(title)+"/"+note.Id)
+	json.NewEncoder(w).Encode(notebooks[title])
 }
 
 func updateNote(w http.ResponseWriter, r *http.Request) {
@@ -212,6 +284,10 @@ func updateNote(w http.ResponseWriter, r *http.Request) {
 	Function: updateNote
 	Description: Update a note (with a specific id) in a notebook
 	*/
+	owner, notebooks, ok := ownerNotebooks(w, r, RoleEditor)
+	if !ok {
+		return
+	}
 
 	vars := mux.Vars(r)
 	title := vars["title"]
@@ -233,13 +309,20 @@ func updateNote(w http.ResponseWriter, r *http.Request) {
 		returnError(w, "Need Tags to create note")
 		return
 	}
+	if !validFormat(note.Format) {
+		returnError(w, "Unsupported Format \""+note.Format+"\"")
+		return
+	}
+	if !checkNoteQuota(w, owner, note, false) {
+		return
+	}
 
 	currentTime := time.Now()
 	currentTimeString := currentTime.Format("2006.01.02 15:04:05")
 	note.LastModified = currentTimeString
 
 	// get notebook
-	notebook := Notebooks[title]
+	notebook := notebooks[title]
 	if notebook == nil {
 		returnError(w, "Notebook \""+title+"\" does not exist")
 		return
@@ -251,8 +334,18 @@ func updateNote(w http.ResponseWriter, r *http.Request) {
 		if noteItr.Id == noteId {
 			note.Id = noteItr.Id
 			note.Created = noteItr.Created
+			note.Attachments = noteItr.Attachments
+			note.Comments = noteItr.Comments
 			notebook[i] = note
+			unindexNote(r.Context(), owner, title, noteItr)
+			indexNote(r.Context(), owner, title, note)
 			noteUpdated = true
+			audit(r, AuditEvent{Action: AuditNoteUpdate, Owner: owner, Notebook: title, NoteId: note.Id}, noteItr, note)
+
+			// point links at the renamed note if requested
+			if r.URL.Query().Get("rewriteLinks") == "true" && noteItr.Title != note.Title {
+				rewriteLinks(r, owner, noteItr.Title, note.Title)
+			}
 			break
 		}
 	}
@@ -268,15 +361,19 @@ func updateNote(w http.ResponseWriter, r *http.Request) {
 func readNote(w http.ResponseWriter, r *http.Request) {
 	/**
 	Function: readNote
-	Description: Get a note (based on id) from a notebook
+	Description: Get a note (based on id) from a notebook as JSON, Markdown, HTML or plain text
 	*/
+	_, notebooks, ok := ownerNotebooks(w, r, RoleViewer)
+	if !ok {
+		return
+	}
 
 	vars := mux.Vars(r)
 	title := vars["title"]
 	noteId := vars["noteId"]
 
 	// get notebook
-	notebook := Notebooks[title]
+	notebook := notebooks[title]
 	if notebook == nil {
 		returnError(w, "Notebook \""+title+"\" does not exist")
 		return
@@ -298,7 +395,7 @@ func readNote(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	json.NewEncoder(w).Encode(readNoteBody)
+	writeNote(w, r, readNoteBody)
 }
 
 func deleteNote(w http.ResponseWriter, r *http.Request) {
@@ -306,13 +403,17 @@ func deleteNote(w http.ResponseWriter, r *http.Request) {
 	Function: deleteNote
 	Description: Delete a notes (with a specific id) in a notebook
 	*/
+	owner, notebooks, ok := ownerNotebooks(w, r, RoleEditor)
+	if !ok {
+		return
+	}
 
 	vars := mux.Vars(r)
 	title := vars["title"]
 	noteId := vars["noteId"]
 
 	// get notebook
-	notebook := Notebooks[title]
+	notebook := notebooks[title]
 	if notebook == nil {
 		returnError(w, "Notebook \""+title+"\" does not exist")
 		return
@@ -323,7 +424,9 @@ func deleteNote(w http.ResponseWriter, r *http.Request) {
 	for i, noteItr := range notebook {
 		if noteItr.Id == noteId {
 			notebook = append(notebook[:i], notebook[i+1:]...)
-			Notebooks[title] = notebook
+			notebooks[title] = notebook
+			unindexNote(r.Context(), owner, title, noteItr)
+			audit(r, AuditEvent{Action: AuditNoteDelete, Owner: owner, Notebook: title, NoteId: noteItr.Id}, noteItr, nil)
 			deleteNote = true
 			break
 		}
@@ -337,25 +440,185 @@ func deleteNote(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(notebook)
 }
 
+func ownerNotebooks(w http.ResponseWriter, r *http.Request, role string) (string, map[string][]Note, bool) {
+	/**
+	Function: ownerNotebooks
+	Description: The notebooks of the user making the request, or with ?owner= the
+	             notebooks of a user who shared the notebook of the request with at
+	             least the given role. Every handler reading or changing notes must
+	             go through this
+	*/
+	principal, ok := currentPrincipal(r)
+	if !ok || principal.User.Username == "" {
+		returnUnauthorized(w, "unauthorized: credentials required")
+		return "", nil, false
+	}
+
+	_, span := startSpan(r.Context(), "store.notebooks", attribute.String("nevernote.role", role))
+	defer span.End()
+	owner := principal.User.Username
+	if requested := r.URL.Query().Get("owner"); requested != "" && requested != owner {
+		title := mux.Vars(r)["title"]
+		if !roleAllows(notebookRole(requested, title, owner), role) {
+			returnError(w, "forbidden: notebook \""+title+"\" of \""+requested+"\" is not shared with you as "+role)
+			return "", nil, false
+		}
+		owner = requested
+	}
+	span.SetAttributes(attribute.String("nevernote.owner", owner))
+	notebooks := Notebooks[owner]
+	if notebooks == nil {
+		notebooks = make(map[string][]Note)
+		// reads only hold the read lock, the map is kept once something is written
+		if requiredScope(r) != ScopeRead {
+			Notebooks[owner] = notebooks
+		}
+	}
+	return owner, notebooks, true
+}
+
+func indexNote(ctx context.Context, owner string, notebookTitle string, note Note) {
+	/**
+	Function: indexNote
+	Description: Add a saved note to the tag index and link graph
+	*/
+	_, span := startSpan(ctx, "index.add", attribute.String("nevernote.notebook", notebookTitle), attribute.String("nevernote.note_id", note.Id))
+	defer span.End()
+	TagIndex.add(owner, notebookTitle, note.Tags)
+	LinkGraph.set(owner, notebookTitle, note)
+}
+
+func unindexNote(ctx context.Context, owner string, notebookTitle string, note Note) {
+	/**
+	Function: unindexNote
+	Description: Remove a note from the tag index and link graph before it is changed or deleted
+	*/
+	_, span := startSpan(ctx, "index.remove", attribute.String("nevernote.notebook", notebookTitle), attribute.String("nevernote.note_id", note.Id))
+	defer span.End()
+	TagIndex.remove(owner, notebookTitle, note.Tags)
+	LinkGraph.remove(owner, notebookTitle, note)
+}
+
+func rebuildIndexes() {
+	/**
+	Function: rebuildIndexes
+	Description: Rebuild the tag index and link graph from every notebook
+	*/
+	rebuildTagIndex()
+	rebuildLinkGraph()
+	indexesBuilt.Store(true)
+}
+
+// ErrorResponse is the body of every error returned by the API
+type ErrorResponse struct {
+	Status    int          `json:"Status"`
+	Error     string       `json:"Error"`
+	RequestId string       `json:"RequestId,omitempty"`
+	Details   []FieldError `json:"Details,omitempty"`
+}
+
 func returnError(out http.ResponseWriter, err string) {
 	/**
 	Function: returnError
 	Description: Returns an http error
 	*/
 	if strings.Contains(err, "unauthorized") {
-		http.Error(out, err, http.StatusUnauthorized)
+		returnStatusError(out, http.StatusUnauthorized, err)
+	} else if strings.Contains(err, "forbidden") {
+		returnStatusError(out, http.StatusForbidden, err)
 	} else {
-		http.Error(out, err, http.StatusInternalServerError)
+		returnStatusError(out, http.StatusInternalServerError, err)
 	}
 }
 
-func startServer() {
+func returnStatusError(out http.ResponseWriter, status int, err string) {
+	/**
+	Function: returnStatusError
+	Description: Returns an http error with the given status code as a JSON ErrorResponse
+	*/
+	out.Header().Set("Content-Type", "application/json; charset=utf-8")
+	out.Header().Set("X-Content-Type-Options", "nosniff")
+	out.WriteHeader(status)
+	// the request id set by the requestIds middleware ties the error to the logs
+	json.NewEncoder(out).Encode(ErrorResponse{Status: status, Error: err, RequestId: out.Header().Get(requestIdHeader)})
+}
+
+const requestIdHeader = "X-Request-ID"
+
+func requestIds(next http.Handler) http.Handler {
+	/**
+	Function: requestIds
+	Description: Middleware giving every request an X-Request-ID, the one sent by
+	             the client is kept so requests can be followed across services
+	*/
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIdHeader)
+		if id == "" || len(id) > 128 {
+			random := make([]byte, 16)
+			rand.Read(random)
+			id = hex.EncodeToString(random)
+			r.Header.Set(requestIdHeader, id)
+		}
+		w.Header().Set(requestIdHeader, id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// routes that stream or hash files, they lock Notebooks only while reading
+// or changing notes so a slow transfer does not hold up other requests
+var unlockedRoutes = map[string]bool{
+	"/addAttachments/{title}/{noteId}":                     true,
+	"/downloadAttachment/{title}/{noteId}/{attachmentId}":  true,
+	"/attachmentThumbnail/{title}/{noteId}/{attachmentId}": true,
+	"/attachUpload/{title}/{noteId}/{uploadId}":            true,
+	"/uploads":            true,
+	"/uploads/{uploadId}": true,
+}
+
+func lockNotebooks(next http.Handler) http.Handler {
+	/**
+	Function: lockNotebooks
+	Description: Middleware holding notebooksMu while a handler runs, the read lock
+	             for GET, HEAD and OPTIONS requests
+	*/
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil {
+			if template, err := route.GetPathTemplate(); err == nil && (unlockedRoutes[template] || healthRoutes[template]) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		if requiredScope(r) == ScopeRead {
+			notebooksMu.RLock()
+			defer notebooksMu.RUnlock()
+		} else {
+			notebooksMu.Lock()
+			defer notebooksMu.Unlock()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func newRouter() *mux.Router {
 	// creates a new instance of a mux router
 	myRouter := mux.NewRouter().StrictSlash(true)
 
 	// add routes
 	myRouter.HandleFunc("/healthcheck", healthcheck)
 
+	myRouter.HandleFunc("/livez", livez).Methods("GET", "HEAD")
+
+	myRouter.HandleFunc("/readyz", readyz).Methods("GET", "HEAD")
+
+	if Settings.Features.Metrics {
+		myRouter.Handle("/metrics", metricsHandler()).Methods("GET")
+	}
+
+	// the OpenAPI document is generated from the routes of myRouter
+	myRouter.HandleFunc("/openapi.json", openAPISpec(myRouter)).Methods("GET")
+
+	myRouter.HandleFunc("/docs", apiDocs).Methods("GET")
+
 	myRouter.HandleFunc("/listNotebooks", listNotebooks).Methods("GET")
 
 	myRouter.HandleFunc("/createNotebook/{title}", createNotebook).Methods("POST")
@@ -368,19 +631,180 @@ func startServer() {
 
 	myRouter.HandleFunc("/createNote/{title}", createNote).Methods("POST")
 
-	myRouter.HandleFunc("/updateNote/{title}/{noteId}", updateNote).Methods("UPDATE")
+	myRouter.HandleFunc("/updateNote/{title}/{noteId}", updateNote).Methods("UPDATE", "PUT")
 
 	myRouter.HandleFunc("/readNote/{title}/{noteId}", readNote).Methods("GET")
 
 	myRouter.HandleFunc("/deleteNote/{title}/{noteId}", deleteNote).Methods("DELETE")
 
-	log.Fatal(http.ListenAndServe(":5000", myRouter))
+	myRouter.HandleFunc("/renderNote/{title}/{noteId}", renderNote).Methods("GET")
+
+	myRouter.HandleFunc("/autocompleteTags", autocompleteTags).Methods("GET")
+
+	myRouter.HandleFunc("/noteLinks/{title}/{noteId}", noteLinks).Methods("GET")
+
+	myRouter.HandleFunc("/backlinks/{title}/{noteId}", backlinks).Methods("GET")
+
+	myRouter.HandleFunc("/brokenLinks", brokenLinks).Methods("GET")
+
+	myRouter.HandleFunc("/noteGraph", noteGraph).Methods("GET")
+
+	myRouter.HandleFunc("/addAttachments/{title}/{noteId}", addAttachments).Methods("POST")
+
+	myRouter.HandleFunc("/downloadAttachment/{title}/{noteId}/{attachmentId}", downloadAttachment).Methods("GET")
+
+	myRouter.HandleFunc("/deleteAttachment/{title}/{noteId}/{attachmentId}", deleteAttachment).Methods("DELETE")
+
+	myRouter.HandleFunc("/attachmentThumbnail/{title}/{noteId}/{attachmentId}", attachmentThumbnail).Methods("GET")
+
+	myRouter.HandleFunc("/collectBlobs", collectBlobs).Methods("POST")
+
+	// uploads, sharing and public links can be turned off in the configuration
+	if Settings.Features.Uploads {
+		myRouter.HandleFunc("/uploads", uploadOptions).Methods("OPTIONS")
+
+		myRouter.HandleFunc("/uploads", createUpload).Methods("POST")
+
+		myRouter.HandleFunc("/uploads/{uploadId}", uploadProgress).Methods("HEAD")
+
+		myRouter.HandleFunc("/uploads/{uploadId}", patchUpload).Methods("PATCH")
+
+		myRouter.HandleFunc("/uploads/{uploadId}", deleteUpload).Methods("DELETE")
+
+		myRouter.HandleFunc("/attachUpload/{title}/{noteId}/{uploadId}", attachUpload).Methods("POST")
+	}
+
+	myRouter.HandleFunc("/createUser", createUser).Methods("POST")
+
+	myRouter.HandleFunc("/createApiKey", createApiKey).Methods("POST")
+
+	myRouter.HandleFunc("/listApiKeys", listApiKeys).Methods("GET")
+
+	myRouter.HandleFunc("/revokeApiKey/{keyId}", revokeApiKey).Methods("DELETE")
+
+	myRouter.HandleFunc("/login", login).Methods("POST")
+
+	myRouter.HandleFunc("/refresh", refresh).Methods("POST")
+
+	myRouter.HandleFunc("/logout", logout).Methods("POST")
+
+	if Settings.Features.Sharing {
+		myRouter.HandleFunc("/addComment/{title}/{noteId}", addComment).Methods("POST")
+
+		myRouter.HandleFunc("/shareNotebook/{title}", shareNotebook).Methods("POST")
+
+		myRouter.HandleFunc("/updateShare/{title}/{username}", updateShare).Methods("UPDATE", "PUT")
+
+		myRouter.HandleFunc("/revokeShare/{title}/{username}", revokeShare).Methods("DELETE")
+
+		myRouter.HandleFunc("/listShares/{title}", listShares).Methods("GET")
+
+		myRouter.HandleFunc("/sharedWithMe", sharedWithMe).Methods("GET")
+	}
+
+	if Settings.Features.PublicLinks {
+		myRouter.HandleFunc("/createPublicLink/{title}", createPublicLink).Methods("POST")
+
+		myRouter.HandleFunc("/listPublicLinks/{title}", listPublicLinks).Methods("GET")
+
+		myRouter.HandleFunc("/revokePublicLink/{linkId}", revokePublicLink).Methods("DELETE")
+
+		myRouter.HandleFunc("/public/{token}", readPublicLink).Methods("GET", "HEAD")
+	}
+
+	myRouter.HandleFunc("/auditLog", auditLogEvents).Methods("GET")
+
+	myRouter.HandleFunc("/quota", showQuota).Methods("GET")
+
+	// every request is traced, logged and measured, only health routes answer while starting,
+	// every route except publicRoutes needs a password or API key, every
+	// client is rate limited, file transfers get longer deadlines and request
+	// bodies are limited in size and checked against the OpenAPI schema before
+	// the notebooks are locked
+	myRouter.Use(requestIds, traceRequests, accessLog, instrument, requireReady, authenticate, rateLimit, extendTransferDeadlines, limitRequestBodies, validateRequests, lockNotebooks)
+
+	return myRouter
+}
+
+func applySettings(config Config) {
+	/**
+	Function: applySettings
+	Description: Make the limits and lists of a loaded configuration take effect
+	*/
+	Settings = config
+	Quotas = Quota{
+		MaxNotes:           config.Limits.MaxNotes,
+		MaxBodyBytes:       config.Limits.MaxBodyBytes,
+		MaxAttachmentBytes: config.Limits.MaxAttachmentBytes,
+	}
+	DefaultRateLimit = RateLimit{Rate: config.Limits.RateLimit, Burst: config.Limits.RateLimitBurst}
+	Admins = parseAdmins(strings.Join(config.Auth.Admins, ","))
 }
 
 func main() {
-	fmt.Println("Rest API - Nevernote")
+	config, printConfig, err := loadConfig(os.Args[1:], os.Getenv, os.Stderr)
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if printConfig {
+		if err := writeConfig(os.Stdout, config); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	applySettings(config)
+	// errors before this point go to stderr as plain text
+	setupLogging(Settings.Log)
+	Logger.Info("Rest API - Nevernote", "listen", Settings.Listen, "storage", Settings.Storage.Path)
+	shutdownTracing, err = setupTracing(context.Background(), Settings.Tracing)
+	if err != nil {
+		fatal("could not set up tracing", err)
+	}
+	registerHealthChecks()
+	startServer(openStores)
+}
 
-	Notebooks = make(map[string][]Note)
+func openStores() error {
+	/**
+	Function: openStores
+	Description: Load the stores from the storage path, the server is not ready until they are
+	*/
+	Notebooks = make(map[string]map[string][]Note)
 	idCounter = 0
-	startServer()
+	rebuildIndexes()
+
+	var err error
+	Blobs, err = newBlobStore(filepath.Join(Settings.Storage.Path, blobDir))
+	if err != nil {
+		return err
+	}
+	Uploads, err = newUploadStore(filepath.Join(Settings.Storage.Path, uploadDir))
+	if err != nil {
+		return err
+	}
+
+	// sessions only survive restarts when signing keys are configured,
+	// the configuration has been validated so the keys parse
+	keys, _ := parseSigningKeys(Settings.Auth.JWTKeys)
+	if len(keys) == 0 {
+		key, err := randomKey()
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+	for i, key := range keys {
+		SigningKeys.add(key, i == 0)
+	}
+
+	// public links are kept in memory and lost on restart like the notes they
+	// point to, the key only signs their tokens
+	linkKey, _ := parseLinkKey(Settings.Auth.LinkKey)
+	PublicLinks = newPublicLinkStore(linkKey)
+
+	Audit, err = openAuditLog(filepath.Join(Settings.Storage.Path, auditPath))
+	return err
 }
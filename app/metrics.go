@@ -0,0 +1,181 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics is the registry served at /metrics
+var Metrics = newMetricsRegistry()
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nevernote_http_requests_total",
+		Help: "HTTP requests by method, route template and status code.",
+	}, []string{"method", "route", "status"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "nevernote_http_request_duration_seconds",
+		Help:    "Time to answer HTTP requests by method and route template.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	httpResponseBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nevernote_http_response_bytes_total",
+		Help: "Bytes of HTTP response bodies by method and route template.",
+	}, []string{"method", "route"})
+
+	httpRequestsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "nevernote_http_requests_in_flight",
+		Help: "HTTP requests being answered.",
+	})
+)
+
+func newMetricsRegistry() *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests,
+		httpRequestDuration,
+		httpResponseBytes,
+		httpRequestsInFlight,
+		newDomainCollector(),
+	)
+	return registry
+}
+
+// domainCollector reports the size of the stored data when /metrics is scraped
+type domainCollector struct {
+	users, notebooks, notes, bodyBytes, attachmentBytes, indexTags, indexLinks, auditEvents *prometheus.Desc
+}
+
+func newDomainCollector() *domainCollector {
+	return &domainCollector{
+		users:           prometheus.NewDesc("nevernote_users", "Users with notebooks.", nil, nil),
+		notebooks:       prometheus.NewDesc("nevernote_notebooks", "Notebooks of every user.", nil, nil),
+		notes:           prometheus.NewDesc("nevernote_notes", "Notes in every notebook.", nil, nil),
+		bodyBytes:       prometheus.NewDesc("nevernote_note_body_bytes", "Bytes of every note body.", nil, nil),
+		attachmentBytes: prometheus.NewDesc("nevernote_attachment_bytes", "Bytes of every attachment, counted once per note.", nil, nil),
+		indexTags:       prometheus.NewDesc("nevernote_index_tags", "Distinct tags in the tag index.", nil, nil),
+		indexLinks:      prometheus.NewDesc("nevernote_index_links", "Links between notes in the link graph.", nil, nil),
+		auditEvents:     prometheus.NewDesc("nevernote_audit_events", "Events in the audit log.", nil, nil),
+	}
+}
+
+func (collector *domainCollector) Describe(descs chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{collector.users, collector.notebooks, collector.notes, collector.bodyBytes,
+		collector.attachmentBytes, collector.indexTags, collector.indexLinks, collector.auditEvents} {
+		descs <- desc
+	}
+}
+
+func (collector *domainCollector) Collect(metrics chan<- prometheus.Metric) {
+	/**
+	Function: Collect
+	Description: Count notebooks, notes, body and attachment bytes and the size of the indexes
+	*/
+	// /metrics is not locked by lockNotebooks, the handlers may be writing
+	notebooksMu.RLock()
+	defer notebooksMu.RUnlock()
+	var notebooks, notes, bodyBytes, attachmentBytes int
+	for _, userNotebooks := range Notebooks {
+		notebooks += len(userNotebooks)
+		for _, notebook := range userNotebooks {
+			notes += len(notebook)
+			for _, note := range notebook {
+				bodyBytes += len(note.Body)
+				for _, attachment := range note.Attachments {
+					attachmentBytes += int(attachment.Size)
+				}
+			}
+		}
+	}
+
+	gauge := func(desc *prometheus.Desc, value int) {
+		metrics <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(value))
+	}
+	gauge(collector.users, len(Notebooks))
+	gauge(collector.notebooks, notebooks)
+	gauge(collector.notes, notes)
+	gauge(collector.bodyBytes, bodyBytes)
+	gauge(collector.attachmentBytes, attachmentBytes)
+	gauge(collector.indexTags, TagIndex.size())
+	gauge(collector.indexLinks, LinkGraph.size())
+	gauge(collector.auditEvents, Audit.length())
+}
+
+// statusRecorder remembers the status code and body size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	if recorder.status == 0 {
+		recorder.status = status
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *statusRecorder) Write(p []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	n, err := recorder.ResponseWriter.Write(p)
+	recorder.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the flusher and deadlines of the connection
+func (recorder *statusRecorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
+
+func routeTemplate(r *http.Request) string {
+	/**
+	Function: routeTemplate
+	Description: The path template of the matched route (ex. /readNote/{title}/{noteId}), so
+	             metrics and logs don't get a label per note
+	*/
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return "unmatched"
+}
+
+func instrument(next http.Handler) http.Handler {
+	/**
+	Function: instrument
+	Description: Middleware counting requests and timing them per route template
+	*/
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		httpRequestsInFlight.Inc()
+		defer httpRequestsInFlight.Dec()
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		route := routeTemplate(r)
+		httpRequests.WithLabelValues(r.Method, route, strconv.Itoa(recorder.status)).Inc()
+		httpRequestDuration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+		httpResponseBytes.WithLabelValues(r.Method, route).Add(float64(recorder.bytes))
+	})
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(Metrics, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"html"
+	"html/template"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/microcosm-cc/bluemonday"
+)
+
+// media types a note can be returned as by readNote
+const (
+	mediaJSON     = "application/json"
+	mediaMarkdown = "text/markdown"
+	mediaHTML     = "text/html"
+	mediaText     = "text/plain"
+)
+
+var noteMediaTypes = []string{mediaJSON, mediaMarkdown, mediaHTML, mediaText}
+
+var notePageTemplate = template.Must(template.New("note").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+</head>
+<body>
+<article>
+<h1>{{.Title}}</h1>
+<p>{{range $i, $tag := .Tags}}{{if $i}}, {{end}}<span class="tag">{{$tag}}</span>{{end}}</p>
+<p><small>Created {{.Created}} &middot; Last modified {{.LastModified}}</small></p>
+{{.Body}}
+</article>
+</body>
+</html>
+`))
+
+func negotiateMediaType(accept string, offers []string) string {
+	/**
+	Function: negotiateMediaType
+	Description: Pick the offer best matching an Accept header, the first offer
+	             when the header is empty and "" when nothing is acceptable
+	*/
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+
+	type mediaRange struct {
+		mediaType string
+		q         float64
+	}
+
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		if mediaType == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			key, value, found := strings.Cut(strings.TrimSpace(param), "=")
+			if found && strings.TrimSpace(key) == "q" {
+				parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+				if err == nil {
+					q = parsed
+				}
+			}
+		}
+		ranges = append(ranges, mediaRange{mediaType: mediaType, q: q})
+	}
+
+	// an offer is refused when the most specific range matching it has q=0,
+	// ex. text/html in "text/html;q=0, */*"
+	refused := map[string]bool{}
+	for _, offer := range offers {
+		best := 0
+		for _, mr := range ranges {
+			if specificity := mediaRangeMatch(mr.mediaType, offer); specificity > best {
+				best = specificity
+				refused[offer] = mr.q <= 0
+			}
+		}
+	}
+
+	// most preferred ranges first, keeping the client's order for ties
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].q > ranges[j].q
+	})
+
+	for _, mr := range ranges {
+		if mr.q <= 0 {
+			break
+		}
+		for _, offer := range offers {
+			if !refused[offer] && mediaRangeMatch(mr.mediaType, offer) > 0 {
+				return offer
+			}
+		}
+	}
+	return ""
+}
+
+func mediaRangeMatch(mediaRange string, mediaType string) int {
+	/**
+	Function: mediaRangeMatch
+	Description: How specifically a media range matches a media type, 3 for the type itself,
+	             2 for a wildcard subtype, 1 for any type and 0 when it does not match
+	*/
+	switch {
+	case mediaRange == mediaType:
+		return 3
+	case mediaRange == "*/*":
+		return 1
+	case strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(mediaRange, "*")):
+		return 2
+	}
+	return 0
+}
+
+func writeNote(w http.ResponseWriter, r *http.Request, note Note) {
+	/**
+	Function: writeNote
+	Description: Write a note in the representation requested by the Accept header
+	*/
+	w.Header().Set("Vary", "Accept")
+
+	switch negotiateMediaType(r.Header.Get("Accept"), noteMediaTypes) {
+	case mediaJSON:
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(note)
+	case mediaMarkdown:
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		io.WriteString(w, noteMarkdown(note))
+	case mediaHTML:
+		page, err := notePage(note)
+		if err != nil {
+			returnError(w, "Could not render note \""+note.Id+"\": "+err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, page)
+	case mediaText:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, notePlainText(note))
+	default:
+		returnStatusError(w, http.StatusNotAcceptable, "Note can only be returned as "+strings.Join(noteMediaTypes, ", "))
+	}
+}
+
+func noteMarkdown(note Note) string {
+	/**
+	Function: noteMarkdown
+	Description: Markdown document with the note metadata as YAML front matter
+	*/
+	var buf strings.Builder
+	buf.WriteString("---\n")
+	buf.WriteString("id: " + strconv.Quote(note.Id) + "\n")
+	buf.WriteString("title: " + strconv.Quote(note.Title) + "\n")
+	if note.Format != "" {
+		buf.WriteString("format: " + strconv.Quote(note.Format) + "\n")
+	}
+	if len(note.Tags) == 0 {
+		buf.WriteString("tags: []\n")
+	} else {
+		buf.WriteString("tags:\n")
+		for _, tag := range note.Tags {
+			buf.WriteString("  - " + strconv.Quote(tag) + "\n")
+		}
+	}
+	buf.WriteString("created: " + strconv.Quote(note.Created) + "\n")
+	buf.WriteString("lastModified: " + strconv.Quote(note.LastModified) + "\n")
+	buf.WriteString("---\n\n")
+	buf.WriteString(note.Body)
+	if !strings.HasSuffix(note.Body, "\n") {
+		buf.WriteString("\n")
+	}
+	return buf.String()
+}
+
+func notePage(note Note) (string, error) {
+	/**
+	Function: notePage
+	Description: Standalone HTML page with the rendered note body
+	*/
+	rendered, err := renderBody(note)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	err = notePageTemplate.Execute(&buf, struct {
+		Note
+		Body template.HTML
+	}{note, template.HTML(rendered)})
+	return buf.String(), err
+}
+
+func notePlainText(note Note) string {
+	/**
+	Function: notePlainText
+	Description: Plain text version of a note, html bodies have their markup stripped
+	*/
+	body := note.Body
+	if note.Format == FormatHTML {
+		body = html.UnescapeString(bluemonday.StrictPolicy().Sanitize(body))
+	}
+
+	var buf strings.Builder
+	buf.WriteString(note.Title + "\n")
+	buf.WriteString("Tags: " + strings.Join(note.Tags, ", ") + "\n")
+	buf.WriteString("Created: " + note.Created + "\n")
+	buf.WriteString("Last Modified: " + note.LastModified + "\n\n")
+	buf.WriteString(body)
+	if !strings.HasSuffix(body, "\n") {
+		buf.WriteString("\n")
+	}
+	return buf.String()
+}
@@ -0,0 +1,694 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// Schema is a JSON Schema as used by OpenAPI 3.1. Request bodies are
+// validated against the schema of their operation, only the keywords below
+// are supported.
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	MinLength            int                `json:"minLength,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	// Pattern compiled by patternSchema, so requests don't compile it again
+	pattern *regexp.Regexp
+}
+
+// FieldError is a problem with one field of a request body, Field is the
+// path of the field (ex. Tags[1])
+type FieldError struct {
+	Field   string `json:"Field"`
+	Message string `json:"Message"`
+}
+
+// apiParameter is a query parameter of an operation
+type apiParameter struct {
+	Name        string
+	Description string
+	Schema      *Schema
+}
+
+// apiOperation documents a route for /openapi.json. Operations are looked
+// up by method and path template, so the document only lists the routes
+// registered in newRouter.
+type apiOperation struct {
+	Id      string
+	Summary string
+	Tag     string
+	Query   []apiParameter
+	// JSON request body, checked by validateRequests before the handler runs
+	Body *Schema
+	// media type of other request bodies, they are not validated
+	BodyType string
+	// success status, 200 when not set
+	Status int
+	// a value of the type of the JSON response, nil when there is no body
+	Response interface{}
+	// media types returned instead of JSON or next to it
+	Produces []string
+	// kept for old clients, documented as deprecated
+	Deprecated bool
+}
+
+func stringSchema(description string) *Schema {
+	return &Schema{Type: "string", Description: description}
+}
+
+func requiredString(description string) *Schema {
+	return &Schema{Type: "string", Description: description, MinLength: 1}
+}
+
+func patternSchema(pattern string, description string) *Schema {
+	return &Schema{Type: "string", Description: description, Pattern: pattern, pattern: regexp.MustCompile(pattern)}
+}
+
+func enumSchema(values ...string) *Schema {
+	return &Schema{Type: "string", Enum: values}
+}
+
+func objectSchema(required []string, properties map[string]*Schema) *Schema {
+	return &Schema{Type: "object", Required: required, Properties: properties}
+}
+
+var zero = 0.0
+
+var noteSchema = objectSchema([]string{"Title", "Body", "Tags"}, map[string]*Schema{
+	"Title":  requiredString("title of the note, [[Title]] in other notes links to it"),
+	"Body":   requiredString("contents of the note"),
+	"Format": {Type: "string", Enum: []string{"", FormatPlain, FormatMarkdown, FormatHTML}, Description: "format of the body, plain when empty"},
+	"Tags":   {Type: "array", Items: stringSchema("")},
+})
+
+var ownerParameter = apiParameter{"owner", "user who shared the notebook with you, your own notebooks when empty", stringSchema("")}
+
+var notebookParameter = apiParameter{"notebook", "only this notebook", stringSchema("")}
+
+var noteMediaTypeList = []string{"text/markdown", "text/html", "text/plain"}
+
+// apiOperations are keyed by method and path template. UPDATE routes are
+// documented as PUT, OpenAPI has no custom methods.
+var apiOperations = map[string]apiOperation{
+	"GET /healthcheck":  {Id: "healthcheck", Summary: "Check that the server is up, deprecated in favour of /livez and /readyz", Tag: "Health", Deprecated: true},
+	"GET /livez":        {Id: "livez", Summary: "Liveness probe", Tag: "Health", Response: HealthReport{}},
+	"HEAD /livez":       {Id: "livezHead", Summary: "Liveness probe without a body", Tag: "Health"},
+	"GET /readyz":       {Id: "readyz", Summary: "Readiness probe, runs every health check", Tag: "Health", Response: HealthReport{}},
+	"HEAD /readyz":      {Id: "readyzHead", Summary: "Readiness probe without a body", Tag: "Health"},
+	"GET /metrics":      {Id: "metrics", Summary: "Prometheus metrics", Tag: "Health", Produces: []string{"text/plain"}},
+	"GET /openapi.json": {Id: "openAPISpec", Summary: "This document", Tag: "Documentation"},
+	"GET /docs":         {Id: "apiDocs", Summary: "Browsable documentation of the API", Tag: "Documentation", Produces: []string{"text/html"}},
+
+	"GET /listNotebooks":             {Id: "listNotebooks", Summary: "List the titles of your notebooks", Tag: "Notebooks", Response: []string{}},
+	"POST /createNotebook/{title}":   {Id: "createNotebook", Summary: "Create a notebook", Tag: "Notebooks", Response: []string{}},
+	"DELETE /deleteNotebook/{title}": {Id: "deleteNotebook", Summary: "Delete a notebook and its notes", Tag: "Notebooks", Response: []string{}},
+	"GET /numberOfNotes/{title}":     {Id: "numberOfNotes", Summary: "Count the notes of a notebook", Tag: "Notebooks", Query: []apiParameter{ownerParameter}, Response: 0},
+
+	"GET /listNotes/{title}": {
+		Id: "listNotes", Summary: "List the notes of a notebook having every tag of the body", Tag: "Notes",
+		Query:    []apiParameter{ownerParameter},
+		Body:     objectSchema(nil, map[string]*Schema{"Tags": {Type: "array", Items: stringSchema("")}}),
+		Response: []Note{},
+	},
+	"POST /createNote/{title}": {
+		Id: "createNote", Summary: "Create a note, the Location header is the URL of the new note", Tag: "Notes",
+		Query: []apiParameter{ownerParameter}, Body: noteSchema, Response: []Note{},
+	},
+	"PUT /updateNote/{title}/{noteId}": {
+		Id: "updateNote", Summary: "Replace a note, also accepted with the UPDATE method", Tag: "Notes",
+		Query: []apiParameter{ownerParameter, {"rewriteLinks", "point [[links]] to the old title at the new one", enumSchema("true", "false")}},
+		Body:  noteSchema, Response: []Note{},
+	},
+	"GET /readNote/{title}/{noteId}":      {Id: "readNote", Summary: "Read a note, as JSON, Markdown, HTML or plain text depending on Accept", Tag: "Notes", Query: []apiParameter{ownerParameter}, Response: Note{}, Produces: noteMediaTypeList},
+	"DELETE /deleteNote/{title}/{noteId}": {Id: "deleteNote", Summary: "Delete a note", Tag: "Notes", Query: []apiParameter{ownerParameter}, Response: []Note{}},
+	"GET /renderNote/{title}/{noteId}":    {Id: "renderNote", Summary: "Render the body of a note as sanitized HTML", Tag: "Notes", Query: []apiParameter{ownerParameter}, Produces: []string{"text/html"}},
+	"GET /autocompleteTags": {
+		Id: "autocompleteTags", Summary: "Complete a tag from its prefix, most used first", Tag: "Notes",
+		Query: []apiParameter{
+			{"prefix", "start of the tag, case insensitive", stringSchema("")},
+			notebookParameter,
+			{"limit", "most suggestions returned", &Schema{Type: "integer", Minimum: &zero}},
+		},
+		Response: []TagSuggestion{},
+	},
+
+	"GET /noteLinks/{title}/{noteId}": {Id: "noteLinks", Summary: "List the [[links]] of a note", Tag: "Links", Query: []apiParameter{ownerParameter}, Response: []NoteLink{}},
+	"GET /backlinks/{title}/{noteId}": {Id: "backlinks", Summary: "List the notes linking to a note", Tag: "Links", Query: []apiParameter{ownerParameter}, Response: []LinkedNote{}},
+	"GET /brokenLinks":                {Id: "brokenLinks", Summary: "List links to notes that do not exist", Tag: "Links", Query: []apiParameter{notebookParameter}, Response: []LinkedNote{}},
+	"GET /noteGraph": {
+		Id: "noteGraph", Summary: "Graph of the links and tags of your notes", Tag: "Links",
+		Query: []apiParameter{
+			notebookParameter,
+			{"tag", "only notes with this tag, can be repeated", stringSchema("")},
+			{"format", "JSON Graph Format or Graphviz", enumSchema("json", "dot")},
+		},
+		Response: NoteGraph{}, Produces: []string{"text/vnd.graphviz"},
+	},
+
+	"POST /addAttachments/{title}/{noteId}":                    {Id: "addAttachments", Summary: "Attach the files of a multipart upload to a note", Tag: "Attachments", Query: []apiParameter{ownerParameter}, BodyType: "multipart/form-data", Response: Note{}},
+	"GET /downloadAttachment/{title}/{noteId}/{attachmentId}":  {Id: "downloadAttachment", Summary: "Download an attachment, supports Range requests", Tag: "Attachments", Query: []apiParameter{ownerParameter}, Produces: []string{"application/octet-stream"}},
+	"DELETE /deleteAttachment/{title}/{noteId}/{attachmentId}": {Id: "deleteAttachment", Summary: "Remove an attachment from a note", Tag: "Attachments", Query: []apiParameter{ownerParameter}, Response: Note{}},
+	"GET /attachmentThumbnail/{title}/{noteId}/{attachmentId}": {
+		Id: "attachmentThumbnail", Summary: "Download a thumbnail of an image attachment", Tag: "Attachments",
+		Query:    []apiParameter{ownerParameter, {"size", "medium when empty", enumSchema("small", "medium", "large")}},
+		Produces: []string{"image/png", "image/jpeg"},
+	},
+	"POST /collectBlobs": {Id: "collectBlobs", Summary: "Delete stored files no note refers to, admins only", Tag: "Attachments", Response: BlobCollection{}},
+
+	"OPTIONS /uploads":           {Id: "uploadOptions", Summary: "tus capabilities of the server", Tag: "Uploads", Status: http.StatusNoContent},
+	"POST /uploads":              {Id: "createUpload", Summary: "Start a tus upload of Upload-Length bytes, chunks go to the Location header", Tag: "Uploads", Status: http.StatusCreated},
+	"HEAD /uploads/{uploadId}":   {Id: "uploadProgress", Summary: "Upload-Offset of an upload to resume from", Tag: "Uploads"},
+	"PATCH /uploads/{uploadId}":  {Id: "patchUpload", Summary: "Send a chunk starting at Upload-Offset", Tag: "Uploads", BodyType: "application/offset+octet-stream", Status: http.StatusNoContent},
+	"DELETE /uploads/{uploadId}": {Id: "deleteUpload", Summary: "Abandon an upload", Tag: "Uploads", Status: http.StatusNoContent},
+	"POST /attachUpload/{title}/{noteId}/{uploadId}": {
+		Id: "attachUpload", Summary: "Attach a finished upload to a note after checking its SHA-256", Tag: "Uploads",
+		Query:    []apiParameter{ownerParameter},
+		Body:     objectSchema([]string{"SHA256"}, map[string]*Schema{"SHA256": patternSchema("^[0-9a-fA-F]{64}$", "hex SHA-256 of the whole upload")}),
+		Response: Note{},
+	},
+
+	"POST /createUser": {
+		Id: "createUser", Summary: "Register a user", Tag: "Users",
+		Body: objectSchema([]string{"Username", "Password"}, map[string]*Schema{
+			"Username": patternSchema("^[^\\s/:]+$", "no spaces, slashes or colons"),
+			"Password": {Type: "string", MinLength: 8},
+		}),
+		Status: http.StatusCreated, Response: User{},
+	},
+	"POST /createApiKey": {
+		Id: "createApiKey", Summary: "Issue an API key, the key is only returned once", Tag: "Users",
+		Body: objectSchema([]string{"Name"}, map[string]*Schema{
+			"Name":   requiredString("what the key is used for"),
+			"Scopes": {Type: "array", Items: enumSchema(ScopeRead, ScopeWrite, ScopeKeys), Description: "the scopes of the API key making the request when empty, otherwise read and write"},
+		}),
+		Status: http.StatusCreated, Response: NewAPIKey{},
+	},
+	"GET /listApiKeys":             {Id: "listApiKeys", Summary: "List your API keys", Tag: "Users", Response: []APIKey{}},
+	"DELETE /revokeApiKey/{keyId}": {Id: "revokeApiKey", Summary: "Revoke an API key", Tag: "Users", Response: APIKey{}},
+	"GET /quota":                   {Id: "showQuota", Summary: "Your quota and how much of it is used", Tag: "Users", Response: QuotaReport{}},
+	"GET /auditLog": {
+		Id: "auditLogEvents", Summary: "Query the audit log, admins only", Tag: "Users",
+		Query: []apiParameter{
+			{"actor", "", stringSchema("")}, {"action", "", stringSchema("")}, {"owner", "", stringSchema("")},
+			notebookParameter, {"noteId", "", stringSchema("")},
+			{"since", "", stringSchema("2006.01.02 15:04:05")}, {"until", "", stringSchema("2006.01.02 15:04:05")},
+			{"format", "jsonl exports every event, one per line", enumSchema("json", "jsonl")},
+			{"limit", "", &Schema{Type: "integer", Minimum: &zero}},
+		},
+		Response: []AuditEvent{}, Produces: []string{"application/x-ndjson"},
+	},
+
+	"POST /login": {
+		Id: "login", Summary: "Exchange a username and password for session tokens", Tag: "Sessions",
+		Body:     objectSchema([]string{"Username", "Password"}, map[string]*Schema{"Username": requiredString(""), "Password": requiredString("")}),
+		Response: SessionTokens{},
+	},
+	"POST /refresh": {
+		Id: "refresh", Summary: "Exchange a refresh token for new session tokens", Tag: "Sessions",
+		Body:     objectSchema([]string{"RefreshToken"}, map[string]*Schema{"RefreshToken": requiredString("")}),
+		Response: SessionTokens{},
+	},
+	"POST /logout": {
+		Id: "logout", Summary: "Revoke the access token and, if given, the refresh token", Tag: "Sessions",
+		Body:   objectSchema(nil, map[string]*Schema{"RefreshToken": stringSchema("")}),
+		Status: http.StatusNoContent,
+	},
+
+	"POST /addComment/{title}/{noteId}": {
+		Id: "addComment", Summary: "Comment on a note", Tag: "Sharing",
+		Query:  []apiParameter{ownerParameter},
+		Body:   objectSchema([]string{"Body"}, map[string]*Schema{"Body": requiredString("")}),
+		Status: http.StatusCreated, Response: Note{},
+	},
+	"POST /shareNotebook/{title}": {
+		Id: "shareNotebook", Summary: "Share a notebook with a user", Tag: "Sharing",
+		Body: objectSchema([]string{"Username", "Role"}, map[string]*Schema{
+			"Username": requiredString(""),
+			"Role":     enumSchema(RoleViewer, RoleCommenter, RoleEditor),
+		}),
+		Status: http.StatusCreated, Response: ShareGrant{},
+	},
+	"PUT /updateShare/{title}/{username}": {
+		Id: "updateShare", Summary: "Change the role of a user, also accepted with the UPDATE method", Tag: "Sharing",
+		Body:     objectSchema([]string{"Role"}, map[string]*Schema{"Role": enumSchema(RoleViewer, RoleCommenter, RoleEditor)}),
+		Response: ShareGrant{},
+	},
+	"DELETE /revokeShare/{title}/{username}": {Id: "revokeShare", Summary: "Stop sharing a notebook with a user", Tag: "Sharing", Response: ShareGrant{}},
+	"GET /listShares/{title}":                {Id: "listShares", Summary: "List the users a notebook is shared with", Tag: "Sharing", Response: []ShareGrant{}},
+	"GET /sharedWithMe":                      {Id: "sharedWithMe", Summary: "List the notebooks shared with you", Tag: "Sharing", Response: []ShareGrant{}},
+
+	"POST /createPublicLink/{title}": {
+		Id: "createPublicLink", Summary: "Create a read only public link to a notebook or a note", Tag: "Public links",
+		Body: objectSchema(nil, map[string]*Schema{
+			"NoteId":    stringSchema("only this note, the whole notebook when empty"),
+			"ExpiresIn": {Type: "integer", Minimum: &zero, Description: "seconds, never expires when 0"},
+			"Password":  stringSchema("needed to open the link"),
+		}),
+		Status: http.StatusCreated, Response: PublicLink{},
+	},
+	"GET /listPublicLinks/{title}":      {Id: "listPublicLinks", Summary: "List the public links of a notebook", Tag: "Public links", Response: []PublicLink{}},
+	"DELETE /revokePublicLink/{linkId}": {Id: "revokePublicLink", Summary: "Revoke a public link", Tag: "Public links", Response: PublicLink{}},
+	"GET /public/{token}":               {Id: "readPublicLink", Summary: "Open a public link, a note or a notebook", Tag: "Public links", Response: PublicNotebook{}, Produces: []string{"text/html"}},
+	"HEAD /public/{token}":              {Id: "readPublicLinkHead", Summary: "Check a public link", Tag: "Public links"},
+}
+
+func apiMethod(method string) string {
+	if method == "UPDATE" {
+		return http.MethodPut
+	}
+	return method
+}
+
+func routeOperation(route *mux.Route, method string) (apiOperation, string, bool) {
+	/**
+	Function: routeOperation
+	Description: The documented operation of a route for a method, and its path template
+	*/
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return apiOperation{}, "", false
+	}
+	operation, found := apiOperations[apiMethod(method)+" "+template]
+	return operation, template, found
+}
+
+func routeMethods(route *mux.Route) []string {
+	methods, err := route.GetMethods()
+	if err != nil {
+		// routes without methods answer every method, like /healthcheck
+		return []string{http.MethodGet}
+	}
+	return methods
+}
+
+func undocumentedRoutes(router *mux.Router) []string {
+	/**
+	Function: undocumentedRoutes
+	Description: The routes of the router that have no operation in apiOperations
+	*/
+	var missing []string
+	router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		for _, method := range routeMethods(route) {
+			if _, template, found := routeOperation(route, method); !found {
+				missing = append(missing, method+" "+template)
+			}
+		}
+		return nil
+	})
+	return missing
+}
+
+// schemaRegistry holds the schemas of named types, referenced from the
+// operations as #/components/schemas/Name
+type schemaRegistry map[string]*Schema
+
+func (registry schemaRegistry) schemaOf(t reflect.Type) *Schema {
+	/**
+	Function: schemaOf
+	Description: The schema of the JSON encoding of a Go type
+	*/
+	switch t.Kind() {
+	case reflect.Pointer:
+		return registry.schemaOf(t.Elem())
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &Schema{Type: "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte"}
+		}
+		return &Schema{Type: "array", Items: registry.schemaOf(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: registry.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return registry.structSchema(t)
+		}
+		if _, found := registry[t.Name()]; !found {
+			registry[t.Name()] = &Schema{}
+			*registry[t.Name()] = *registry.structSchema(t)
+		}
+		return &Schema{Ref: "#/components/schemas/" + t.Name()}
+	}
+	return &Schema{}
+}
+
+func (registry schemaRegistry) structSchema(t reflect.Type) *Schema {
+	schema := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		// the fields of embedded structs are encoded as fields of the outer struct
+		if field.Anonymous && name == "" {
+			embedded := registry.structSchema(field.Type)
+			for property, propertySchema := range embedded.Properties {
+				schema.Properties[property] = propertySchema
+			}
+			schema.Required = append(schema.Required, embedded.Required...)
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		schema.Properties[name] = registry.schemaOf(field.Type)
+		if !strings.Contains(options, "omitempty") {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+	return schema
+}
+
+var pathParameterPattern = regexp.MustCompile(`\{(\w+)\}`)
+
+func openAPIDocument(router *mux.Router) map[string]interface{} {
+	/**
+	Function: openAPIDocument
+	Description: The OpenAPI 3.1 document of the routes registered on the router
+	*/
+	schemas := schemaRegistry{}
+	errorResponse := map[string]interface{}{
+		"description": "error",
+		"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": schemas.schemaOf(reflect.TypeOf(ErrorResponse{}))}},
+	}
+	authenticated := []map[string][]string{{"basicAuth": {}}, {"bearerAuth": {}}, {"apiKey": {}}}
+
+	paths := make(map[string]map[string]interface{})
+	router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		for _, method := range routeMethods(route) {
+			if method == "UPDATE" {
+				// documented with its PUT alias
+				continue
+			}
+			operation, template, found := routeOperation(route, method)
+			if !found {
+				continue
+			}
+
+			var parameters []map[string]interface{}
+			for _, match := range pathParameterPattern.FindAllStringSubmatch(template, -1) {
+				parameters = append(parameters, map[string]interface{}{"name": match[1], "in": "path", "required": true, "schema": stringSchema("")})
+			}
+			for _, parameter := range operation.Query {
+				parameters = append(parameters, map[string]interface{}{"name": parameter.Name, "in": "query", "description": parameter.Description, "schema": parameter.Schema})
+			}
+
+			status := operation.Status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			content := map[string]interface{}{}
+			if operation.Response != nil {
+				content["application/json"] = map[string]interface{}{"schema": schemas.schemaOf(reflect.TypeOf(operation.Response))}
+			}
+			for _, mediaType := range operation.Produces {
+				content[mediaType] = map[string]interface{}{"schema": stringSchema("")}
+			}
+			success := map[string]interface{}{"description": http.StatusText(status)}
+			if len(content) > 0 && method != http.MethodHead {
+				success["content"] = content
+			}
+			responses := map[string]interface{}{strconv.Itoa(status): success, "default": errorResponse}
+
+			document := map[string]interface{}{
+				"operationId": operation.Id,
+				"summary":     operation.Summary,
+				"tags":        []string{operation.Tag},
+				"responses":   responses,
+			}
+			if len(parameters) > 0 {
+				document["parameters"] = parameters
+			}
+			if operation.Deprecated {
+				document["deprecated"] = true
+			}
+			if operation.Body != nil {
+				document["requestBody"] = map[string]interface{}{
+					"content": map[string]interface{}{"application/json": map[string]interface{}{"schema": operation.Body}},
+				}
+				responses["400"] = map[string]interface{}{
+					"description": "the body does not match the schema, Details lists the fields",
+					"content":     errorResponse["content"],
+				}
+			} else if operation.BodyType != "" {
+				document["requestBody"] = map[string]interface{}{
+					"required": true,
+					"content":  map[string]interface{}{operation.BodyType: map[string]interface{}{}},
+				}
+			}
+			if publicRoutes[template] {
+				document["security"] = []map[string][]string{}
+			}
+
+			if paths[template] == nil {
+				paths[template] = make(map[string]interface{})
+			}
+			paths[template][strings.ToLower(method)] = document
+		}
+		return nil
+	})
+
+	return map[string]interface{}{
+		"openapi": "3.1.0",
+		"info": map[string]interface{}{
+			"title":       "Nevernote API",
+			"version":     "1.0.0",
+			"description": "Notebooks of notes with tags, links, attachments and sharing. Errors are returned as ErrorResponse.",
+		},
+		"paths":    paths,
+		"security": authenticated,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"basicAuth":  map[string]string{"type": "http", "scheme": "basic"},
+				"bearerAuth": map[string]string{"type": "http", "scheme": "bearer", "description": "session access token or API key"},
+				"apiKey":     map[string]string{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+			},
+		},
+	}
+}
+
+func openAPISpec(router *mux.Router) http.HandlerFunc {
+	/**
+	Function: openAPISpec
+	Description: Serve the OpenAPI document of the router, generated from its routes
+	*/
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(openAPIDocument(router))
+	}
+}
+
+//go:embed openapi.html
+var apiDocsPage []byte
+
+func apiDocs(w http.ResponseWriter, r *http.Request) {
+	/**
+	Function: apiDocs
+	Description: A page listing the operations of /openapi.json
+	*/
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(apiDocsPage)
+}
+
+func (schema *Schema) validate(value interface{}, field string) []FieldError {
+	/**
+	Function: validate
+	Description: Check a decoded JSON value (numbers as json.Number) against the schema
+	*/
+	problem := func(message string) []FieldError {
+		return []FieldError{{Field: field, Message: message}}
+	}
+	if value == nil {
+		// null is the same as a missing field, required fields are checked by their object
+		return nil
+	}
+
+	switch schema.Type {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return problem("must be an object")
+		}
+		var problems []FieldError
+		for _, name := range schema.Required {
+			if object[name] == nil {
+				problems = append(problems, FieldError{Field: joinField(field, name), Message: "is required"})
+			}
+		}
+		names := make([]string, 0, len(schema.Properties))
+		for name := range schema.Properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			problems = append(problems, schema.Properties[name].validate(object[name], joinField(field, name))...)
+		}
+		return problems
+
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return problem("must be an array")
+		}
+		var problems []FieldError
+		for i, item := range items {
+			if schema.Items != nil {
+				problems = append(problems, schema.Items.validate(item, field+"["+strconv.Itoa(i)+"]")...)
+			}
+		}
+		return problems
+
+	case "string":
+		text, ok := value.(string)
+		if !ok {
+			return problem("must be a string")
+		}
+		if utf8.RuneCountInString(text) < schema.MinLength {
+			if schema.MinLength == 1 {
+				return problem("must not be empty")
+			}
+			return problem("must be at least " + strconv.Itoa(schema.MinLength) + " characters")
+		}
+		if schema.pattern != nil && !schema.pattern.MatchString(text) {
+			return problem("must match " + schema.Pattern)
+		}
+		if len(schema.Enum) > 0 && !contains(schema.Enum, text) {
+			return problem("must be one of " + quoteAll(schema.Enum))
+		}
+
+	case "integer", "number":
+		number, ok := value.(json.Number)
+		if !ok {
+			return problem("must be a number")
+		}
+		parsed, err := number.Float64()
+		if err != nil {
+			return problem("must be a number")
+		}
+		if _, err := number.Int64(); schema.Type == "integer" && err != nil {
+			return problem("must be an integer")
+		}
+		if schema.Minimum != nil && parsed < *schema.Minimum {
+			return problem("must be at least " + strconv.FormatFloat(*schema.Minimum, 'f', -1, 64))
+		}
+
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return problem("must be true or false")
+		}
+	}
+	return nil
+}
+
+func joinField(parent string, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "." + name
+}
+
+func contains(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+func quoteAll(values []string) string {
+	quoted := make([]string, len(values))
+	for i, value := range values {
+		quoted[i] = strconv.Quote(value)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+func returnValidationError(out http.ResponseWriter, message string, details []FieldError) {
+	out.Header().Set("Content-Type", "application/json; charset=utf-8")
+	out.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(out).Encode(ErrorResponse{Status: http.StatusBadRequest, Error: message, RequestId: out.Header().Get(requestIdHeader), Details: details})
+}
+
+func validateRequests(next http.Handler) http.Handler {
+	/**
+	Function: validateRequests
+	Description: Middleware checking JSON request bodies against the schema of their
+	             operation, answering 400 with the problem of every field
+	*/
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := mux.CurrentRoute(r)
+		if route == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		operation, _, found := routeOperation(route, r.Method)
+		if !found || operation.Body == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			returnStatusError(w, http.StatusRequestEntityTooLarge, "Request body exceeds "+strconv.FormatInt(tooLarge.Limit, 10)+" bytes")
+			return
+		}
+		if err != nil {
+			returnValidationError(w, "Could not read the request body: "+err.Error(), nil)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		// handlers take an empty body for an empty object
+		var value interface{} = map[string]interface{}{}
+		if len(bytes.TrimSpace(body)) > 0 {
+			decoder := json.NewDecoder(bytes.NewReader(body))
+			decoder.UseNumber()
+			if err := decoder.Decode(&value); err != nil {
+				returnValidationError(w, "Request body is not valid JSON: "+err.Error(), nil)
+				return
+			}
+		}
+		if problems := operation.Body.validate(value, ""); len(problems) > 0 {
+			returnValidationError(w, "Request body does not match the schema of "+operation.Id, problems)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PublicLink gives read only access to a note, or a whole notebook when
+// NoteId is empty, to anybody who has the link. The link is the id of the
+// PublicLink signed with the server link key, so links can't be guessed or
+// pointed at other notes.
+type PublicLink struct {
+	Id           string `json:"Id"`
+	Owner        string `json:"Owner"`
+	Notebook     string `json:"Notebook"`
+	NoteId       string `json:"NoteId,omitempty"`
+	Url          string `json:"Url"`
+	Expires      string `json:"Expires,omitempty"`
+	HasPassword  bool   `json:"HasPassword"`
+	PasswordHash []byte `json:"-"`
+	Created      string `json:"Created"`
+	AccessCount  int    `json:"AccessCount"`
+	LastAccessed string `json:"LastAccessed,omitempty"`
+	Revoked      bool   `json:"Revoked"`
+
+	expires time.Time
+}
+
+// PublicNotebook is a notebook shared by a public link
+type PublicNotebook struct {
+	Title string `json:"Title"`
+	Notes []Note `json:"Notes"`
+}
+
+type publicLinkStore struct {
+	mu    sync.Mutex
+	key   []byte
+	links map[string]*PublicLink
+}
+
+// PublicLinks holds every public link, signed with NEVERNOTE_LINK_KEY or a
+// random key when it is not configured
+var PublicLinks = newPublicLinkStore(nil)
+
+const publicLinkPath = "/public/"
+
+var (
+	errPublicLinkNotFound = errors.New("Public link does not exist")
+	errPublicLinkExpired  = errors.New("Public link has expired")
+	errPublicLinkPassword = errors.New("unauthorized: public link needs a password")
+)
+
+var publicNotebookTemplate = template.Must(template.New("notebook").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{range .Notes}}<article>
+<h2>{{.Title}}</h2>
+<p>{{range $i, $tag := .Tags}}{{if $i}}, {{end}}<span class="tag">{{$tag}}</span>{{end}}</p>
+<p><small>Created {{.Created}} &middot; Last modified {{.LastModified}}</small></p>
+{{.Body}}
+</article>
+{{end}}</body>
+</html>
+`))
+
+func newPublicLinkStore(key []byte) *publicLinkStore {
+	if key == nil {
+		key = make([]byte, 32)
+		rand.Read(key)
+	}
+	return &publicLinkStore{key: key, links: make(map[string]*PublicLink)}
+}
+
+func parseLinkKey(config string) ([]byte, error) {
+	/**
+	Function: parseLinkKey
+	Description: Decode the base64 public link key, nil when it is not configured
+	*/
+	if config == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(config)
+	if err != nil {
+		return nil, errors.New("public link key is not valid base64")
+	}
+	if len(key) < 32 {
+		return nil, errors.New("public link key must be at least 32 bytes")
+	}
+	return key, nil
+}
+
+func (store *publicLinkStore) signature(link *PublicLink) string {
+	mac := hmac.New(sha256.New, store.key)
+	io.WriteString(mac, strings.Join([]string{link.Id, link.Owner, link.Notebook, link.NoteId, link.Expires}, "\n"))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (store *publicLinkStore) create(owner string, notebookTitle string, noteId string, ttl time.Duration, password string) (PublicLink, error) {
+	/**
+	Function: create
+	Description: Create a public link to a note or notebook, optionally expiring after ttl
+	             and protected by a password
+	*/
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return PublicLink{}, err
+	}
+	link := &PublicLink{
+		Id:       hex.EncodeToString(random),
+		Owner:    owner,
+		Notebook: notebookTitle,
+		NoteId:   noteId,
+		Created:  time.Now().Format("2006.01.02 15:04:05"),
+	}
+	if ttl > 0 {
+		link.expires = time.Now().Add(ttl)
+		link.Expires = link.expires.Format("2006.01.02 15:04:05")
+	}
+	if password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return PublicLink{}, err
+		}
+		link.PasswordHash = hash
+		link.HasPassword = true
+	}
+	link.Url = publicLinkPath + link.Id + "." + store.signature(link)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.links[link.Id] = link
+	return *link, nil
+}
+
+func (store *publicLinkStore) open(token string, password string) (PublicLink, error) {
+	/**
+	Function: open
+	Description: Check the signature, expiry and password of a public link and count the access
+	*/
+	id, signature, found := strings.Cut(token, ".")
+	if !found {
+		return PublicLink{}, errPublicLinkNotFound
+	}
+
+	// the checks use a copy, the password is compared without holding the lock
+	store.mu.Lock()
+	stored := store.links[id]
+	var link PublicLink
+	if stored != nil {
+		link = *stored
+	}
+	store.mu.Unlock()
+	if stored == nil || link.Revoked || !hmac.Equal([]byte(signature), []byte(store.signature(&link))) {
+		return PublicLink{}, errPublicLinkNotFound
+	}
+	if !link.expires.IsZero() && time.Now().After(link.expires) {
+		return PublicLink{}, errPublicLinkExpired
+	}
+	if link.HasPassword && (password == "" || bcrypt.CompareHashAndPassword(link.PasswordHash, []byte(password)) != nil) {
+		return PublicLink{}, errPublicLinkPassword
+	}
+
+	// the link may have been revoked while the password was compared
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if stored.Revoked {
+		return PublicLink{}, errPublicLinkNotFound
+	}
+	stored.AccessCount++
+	stored.LastAccessed = time.Now().Format("2006.01.02 15:04:05")
+	return *stored, nil
+}
+
+func (store *publicLinkStore) revoke(owner string, id string) (PublicLink, bool) {
+	/**
+	Function: revoke
+	Description: Revoke a public link of a user, it stops working immediately
+	*/
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	link := store.links[id]
+	if link == nil || link.Owner != owner {
+		return PublicLink{}, false
+	}
+	link.Revoked = true
+	return *link, true
+}
+
+func (store *publicLinkStore) list(owner string, notebookTitle string) []PublicLink {
+	/**
+	Function: list
+	Description: Public links to a notebook and its notes, oldest first
+	*/
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	links := []PublicLink{}
+	for _, link := range store.links {
+		if link.Owner == owner && link.Notebook == notebookTitle {
+			links = append(links, *link)
+		}
+	}
+	sort.Slice(links, func(i, j int) bool {
+		if links[i].Created != links[j].Created {
+			return links[i].Created < links[j].Created
+		}
+		return links[i].Id < links[j].Id
+	})
+	return links
+}
+
+func (store *publicLinkStore) removeNotebook(owner string, notebookTitle string) {
+	/**
+	Function: removeNotebook
+	Description: Drop the public links of a deleted or replaced notebook
+	*/
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for id, link := range store.links {
+		if link.Owner == owner && link.Notebook == notebookTitle {
+			delete(store.links, id)
+		}
+	}
+}
+
+func createPublicLink(w http.ResponseWriter, r *http.Request) {
+	/**
+	Function: createPublicLink
+	Description: Create a read only public link to a notebook or one of its notes
+	*/
+	owner, notebooks, ok := ownerNotebooks(w, r, RoleOwner)
+	if !ok {
+		return
+	}
+	title := mux.Vars(r)["title"]
+
+	reqBody, _ := ioutil.ReadAll(r.Body)
+	var request struct {
+		NoteId    string `json:"NoteId"`
+		ExpiresIn int    `json:"ExpiresIn"`
+		Password  string `json:"Password"`
+	}
+	json.Unmarshal(reqBody, &request)
+
+	if notebooks[title] == nil {
+		returnError(w, "Notebook \""+title+"\" does not exist")
+		return
+	}
+	if request.NoteId != "" {
+		if _, found := findNoteIndex(notebooks, title, request.NoteId); !found {
+			returnError(w, "Note with id \""+request.NoteId+"\" does not exist")
+			return
+		}
+	}
+	if request.ExpiresIn < 0 {
+		returnStatusError(w, http.StatusBadRequest, "ExpiresIn must not be negative")
+		return
+	}
+
+	link, err := PublicLinks.create(owner, title, request.NoteId, time.Duration(request.ExpiresIn)*time.Second, request.Password)
+	if err != nil {
+		returnError(w, "Could not create public link: "+err.Error())
+		return
+	}
+
+	audit(r, AuditEvent{Action: AuditPublicLinkCreate, Owner: owner, Notebook: title, NoteId: link.NoteId, Target: link.Id}, nil, link)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(link)
+}
+
+func listPublicLinks(w http.ResponseWriter, r *http.Request) {
+	/**
+	Function: listPublicLinks
+	Description: List the public links to a notebook and its notes with their access counts
+	*/
+	owner, notebooks, ok := ownerNotebooks(w, r, RoleOwner)
+	if !ok {
+		return
+	}
+	title := mux.Vars(r)["title"]
+	if notebooks[title] == nil {
+		returnError(w, "Notebook \""+title+"\" does not exist")
+		return
+	}
+	json.NewEncoder(w).Encode(PublicLinks.list(owner, title))
+}
+
+func revokePublicLink(w http.ResponseWriter, r *http.Request) {
+	/**
+	Function: revokePublicLink
+	Description: Revoke a public link of the current user
+	*/
+	owner, _, ok := ownerNotebooks(w, r, RoleOwner)
+	if !ok {
+		return
+	}
+	linkId := mux.Vars(r)["linkId"]
+
+	link, found := PublicLinks.revoke(owner, linkId)
+	if !found {
+		returnStatusError(w, http.StatusNotFound, "Public link with id \""+linkId+"\" does not exist")
+		return
+	}
+	before := link
+	before.Revoked = false
+	audit(r, AuditEvent{Action: AuditPublicLinkRevoke, Owner: owner, Notebook: link.Notebook, NoteId: link.NoteId, Target: link.Id}, before, link)
+
+	json.NewEncoder(w).Encode(link)
+}
+
+func publicLinkPassword(r *http.Request) string {
+	/**
+	Function: publicLinkPassword
+	Description: Password given for a public link, browsers send it with Basic
+	             authentication (any username) and scripts in X-Link-Password
+	*/
+	if password := r.Header.Get("X-Link-Password"); password != "" {
+		return password
+	}
+	if _, password, ok := r.BasicAuth(); ok {
+		return password
+	}
+	return ""
+}
+
+func readPublicLink(w http.ResponseWriter, r *http.Request) {
+	/**
+	Function: readPublicLink
+	Description: Read the note or notebook of a public link without an account
+	*/
+	link, err := PublicLinks.open(mux.Vars(r)["token"], publicLinkPassword(r))
+	switch err {
+	case nil:
+	case errPublicLinkPassword:
+		w.Header().Set("WWW-Authenticate", `Basic realm="nevernote public link"`)
+		returnStatusError(w, http.StatusUnauthorized, err.Error())
+		return
+	case errPublicLinkExpired:
+		returnStatusError(w, http.StatusGone, err.Error())
+		return
+	default:
+		returnStatusError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	// public pages are never cached by shared caches, the link may be revoked
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("X-Robots-Tag", "noindex")
+
+	notebook := Notebooks[link.Owner][link.Notebook]
+	if link.NoteId != "" {
+		for _, note := range notebook {
+			if note.Id == link.NoteId {
+				writeNote(w, r, publicNote(note))
+				return
+			}
+		}
+		returnStatusError(w, http.StatusNotFound, errPublicLinkNotFound.Error())
+		return
+	}
+	if notebook == nil {
+		returnStatusError(w, http.StatusNotFound, errPublicLinkNotFound.Error())
+		return
+	}
+	writePublicNotebook(w, r, link.Notebook, notebook)
+}
+
+func publicNote(note Note) Note {
+	/**
+	Function: publicNote
+	Description: The parts of a note shown on public links, comments and attachments stay private
+	*/
+	note.Comments = nil
+	note.Attachments = nil
+	return note
+}
+
+func writePublicNotebook(w http.ResponseWriter, r *http.Request, title string, notebook []Note) {
+	/**
+	Function: writePublicNotebook
+	Description: Write a notebook of a public link as JSON or as an HTML page
+	*/
+	w.Header().Set("Vary", "Accept")
+
+	notes := make([]Note, 0, len(notebook))
+	for _, note := range notebook {
+		notes = append(notes, publicNote(note))
+	}
+
+	switch negotiateMediaType(r.Header.Get("Accept"), []string{mediaJSON, mediaHTML}) {
+	case mediaJSON:
+		json.NewEncoder(w).Encode(PublicNotebook{title, notes})
+	case mediaHTML:
+		type renderedNote struct {
+			Note
+			Body template.HTML
+		}
+		page := struct {
+			Title string
+			Notes []renderedNote
+		}{Title: title}
+		for _, note := range notes {
+			rendered, err := renderBody(note)
+			if err != nil {
+				returnError(w, "Could not render note \""+note.Id+"\": "+err.Error())
+				return
+			}
+			page.Notes = append(page.Notes, renderedNote{note, template.HTML(rendered)})
+		}
+
+		var buf bytes.Buffer
+		if err := publicNotebookTemplate.Execute(&buf, page); err != nil {
+			returnError(w, "Could not render notebook \""+title+"\": "+err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		buf.WriteTo(w)
+	default:
+		returnStatusError(w, http.StatusNotAcceptable, "Notebook can only be returned as "+mediaJSON+", "+mediaHTML)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// Quota limits how much a user can store, 0 means unlimited. Notes and
+// attachments count against the owner of the notebook they are stored in,
+// also when they are added by somebody the notebook is shared with.
+type Quota struct {
+	MaxNotes           int   `json:"MaxNotes"`
+	MaxBodyBytes       int64 `json:"MaxBodyBytes"`
+	MaxAttachmentBytes int64 `json:"MaxAttachmentBytes"`
+}
+
+// Quotas applies to every user, set from the limits of the configuration
+var Quotas Quota
+
+// QuotaUsage is what a user currently stores
+type QuotaUsage struct {
+	Notes           int   `json:"Notes"`
+	AttachmentBytes int64 `json:"AttachmentBytes"`
+}
+
+// QuotaReport is the quota of a user and how much of it is used
+type QuotaReport struct {
+	Limits Quota      `json:"Limits"`
+	Usage  QuotaUsage `json:"Usage"`
+}
+
+var errQuotaExceeded = errors.New("attachment quota exceeded")
+
+func quotaUsage(owner string) QuotaUsage {
+	/**
+	Function: quotaUsage
+	Description: Count the notes and attachment bytes stored in the notebooks of owner
+	*/
+	var usage QuotaUsage
+	for _, notes := range Notebooks[owner] {
+		usage.Notes += len(notes)
+		for _, note := range notes {
+			for _, attachment := range note.Attachments {
+				usage.AttachmentBytes += attachment.Size
+			}
+		}
+	}
+	return usage
+}
+
+func remainingAttachmentBytes(owner string) int64 {
+	/**
+	Function: remainingAttachmentBytes
+	Description: How many attachment bytes owner can still store, -1 when unlimited
+	*/
+	if Quotas.MaxAttachmentBytes == 0 {
+		return -1
+	}
+	remaining := Quotas.MaxAttachmentBytes - quotaUsage(owner).AttachmentBytes
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+func fitsAttachmentQuota(owner string, size int64) bool {
+	/**
+	Function: fitsAttachmentQuota
+	Description: Determine if owner can store size more attachment bytes
+	*/
+	remaining := remainingAttachmentBytes(owner)
+	return remaining < 0 || size <= remaining
+}
+
+func checkNoteQuota(w http.ResponseWriter, owner string, note Note, isNew bool) bool {
+	/**
+	Function: checkNoteQuota
+	Description: Reject a note that is too big (413) or that would exceed the note quota of owner (403)
+	*/
+	if Quotas.MaxBodyBytes > 0 && int64(len(note.Body)) > Quotas.MaxBodyBytes {
+		returnStatusError(w, http.StatusRequestEntityTooLarge, "Body exceeds "+strconv.FormatInt(Quotas.MaxBodyBytes, 10)+" bytes")
+		return false
+	}
+	if isNew && Quotas.MaxNotes > 0 && quotaUsage(owner).Notes >= Quotas.MaxNotes {
+		returnError(w, "forbidden: quota of "+strconv.Itoa(Quotas.MaxNotes)+" notes reached")
+		return false
+	}
+	return true
+}
+
+func returnAttachmentQuotaExceeded(w http.ResponseWriter) {
+	returnStatusError(w, http.StatusRequestEntityTooLarge, "Attachments exceed the quota of "+strconv.FormatInt(Quotas.MaxAttachmentBytes, 10)+" bytes")
+}
+
+// quotaReader fails with errQuotaExceeded once more than remaining bytes are read
+type quotaReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (reader *quotaReader) Read(p []byte) (int, error) {
+	if reader.remaining < 0 {
+		return reader.r.Read(p)
+	}
+	// read one byte past the quota to notice when it is exceeded
+	if int64(len(p)) > reader.remaining+1 {
+		p = p[:reader.remaining+1]
+	}
+	n, err := reader.r.Read(p)
+	if int64(n) > reader.remaining {
+		return 0, errQuotaExceeded
+	}
+	reader.remaining -= int64(n)
+	return n, err
+}
+
+func showQuota(w http.ResponseWriter, r *http.Request) {
+	/**
+	Function: showQuota
+	Description: Show the quotas of the current user and how much of them is used
+	*/
+	username := requestUsername(r)
+	if username == "" {
+		returnUnauthorized(w, "unauthorized: credentials required")
+		return
+	}
+	json.NewEncoder(w).Encode(QuotaReport{Quotas, quotaUsage(username)})
+}
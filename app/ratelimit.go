@@ -0,0 +1,222 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// RateLimit is a token bucket: Burst requests can be made at once and the
+// bucket refills with Rate requests per second
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// DefaultRateLimit applies to every route without its own limit in RouteRateLimits
+var DefaultRateLimit = RateLimit{Rate: 20, Burst: 40}
+
+// RouteRateLimits are stricter limits for routes that are expensive or that
+// scripts tend to hammer, keyed by route path template. Each of them has its
+// own bucket per client, every other route shares the default bucket.
+var RouteRateLimits = map[string]RateLimit{
+	"/createNote/{title}":                       {Rate: 2, Burst: 20},
+	"/updateNote/{title}/{noteId}":              {Rate: 5, Burst: 20},
+	"/addAttachments/{title}/{noteId}":          {Rate: 1, Burst: 5},
+	"/createPublicLink/{title}":                 {Rate: 0.2, Burst: 5},
+	"/public/{token}":                           {Rate: 5, Burst: 20},
+	"/createUser":                               {Rate: 0.1, Burst: 3},
+	"/login":                                    {Rate: 0.2, Burst: 5},
+	"/refresh":                                  {Rate: 1, Burst: 10},
+	"/collectBlobs":                             {Rate: 0.1, Burst: 1},
+	"/attachUpload/{title}/{noteId}/{uploadId}": {Rate: 1, Burst: 5},
+}
+
+// FailedAuthRateLimit slows down guessing passwords and keys, every request
+// with wrong credentials takes a token from the bucket of its IP address. The
+// username tried is not counted, anyone could lock a user out with it
+var FailedAuthRateLimit = RateLimit{Rate: 0.1, Burst: 10}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	limit  RateLimit
+}
+
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// RateLimits holds the token buckets of every client
+var RateLimits = newRateLimiter()
+
+// how often buckets that have refilled are dropped
+const rateLimitSweepInterval = time.Minute
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*tokenBucket), lastSweep: time.Now()}
+}
+
+// rateLimitResult describes a bucket after taking a token from it
+type rateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+func (limiter *rateLimiter) take(key string, limit RateLimit, now time.Time) rateLimitResult {
+	/**
+	Function: take
+	Description: Take a token from the bucket of key if there is one
+	*/
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	if now.Sub(limiter.lastSweep) > rateLimitSweepInterval {
+		limiter.sweep(now)
+	}
+
+	bucket := limiter.buckets[key]
+	if bucket == nil {
+		bucket = &tokenBucket{tokens: float64(limit.Burst), last: now}
+		limiter.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(float64(limit.Burst), bucket.tokens+now.Sub(bucket.last).Seconds()*limit.Rate)
+	bucket.last = now
+	bucket.limit = limit
+
+	result := rateLimitResult{Limit: limit.Burst}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = secondsUntil(1-bucket.tokens, limit.Rate)
+	}
+	result.Remaining = int(bucket.tokens)
+	result.Reset = secondsUntil(float64(limit.Burst)-bucket.tokens, limit.Rate)
+	return result
+}
+
+func (limiter *rateLimiter) exhausted(key string, limit RateLimit, now time.Time) (bool, time.Duration) {
+	/**
+	Function: exhausted
+	Description: Whether the bucket of key is empty, without taking a token
+	*/
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	bucket := limiter.buckets[key]
+	if bucket == nil {
+		return false, 0
+	}
+	tokens := math.Min(float64(limit.Burst), bucket.tokens+now.Sub(bucket.last).Seconds()*limit.Rate)
+	if tokens >= 1 {
+		return false, 0
+	}
+	return true, secondsUntil(1-tokens, limit.Rate)
+}
+
+func (limiter *rateLimiter) sweep(now time.Time) {
+	// an empty bucket is full again Burst/Rate seconds after it was last used,
+	// from then on it is the same as a new bucket
+	for key, bucket := range limiter.buckets {
+		if bucket.limit.Rate > 0 && now.Sub(bucket.last).Seconds() >= float64(bucket.limit.Burst)/bucket.limit.Rate {
+			delete(limiter.buckets, key)
+		}
+	}
+	limiter.lastSweep = now
+}
+
+func failedAuthKey(r *http.Request) string {
+	return "failedAuth ip:" + clientIP(r)
+}
+
+func failedAuthLimited(w http.ResponseWriter, key string) bool {
+	/**
+	Function: failedAuthLimited
+	Description: Answer 429 when the failed authentication bucket is empty, checked before
+	             credentials are verified so a guess does not cost a password hash
+	*/
+	if limited, retryAfter := RateLimits.exhausted(key, FailedAuthRateLimit, time.Now()); limited {
+		returnTooManyRequests(w, retryAfter)
+		return true
+	}
+	return false
+}
+
+func recordFailedAuth(key string) {
+	RateLimits.take(key, FailedAuthRateLimit, time.Now())
+}
+
+func secondsUntil(tokens float64, rate float64) time.Duration {
+	if tokens <= 0 {
+		return 0
+	}
+	if rate <= 0 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(math.Ceil(tokens/rate)) * time.Second
+}
+
+func rateLimitClient(r *http.Request) string {
+	/**
+	Function: rateLimitClient
+	Description: Who a request is counted against, its API key, its user or its IP address
+	*/
+	if principal, ok := currentPrincipal(r); ok {
+		if principal.Key != nil {
+			return "key:" + principal.Key.Id
+		}
+		if principal.User.Username != "" {
+			return "user:" + principal.User.Username
+		}
+	}
+	return "ip:" + clientIP(r)
+}
+
+func writeRateLimitHeaders(w http.ResponseWriter, result rateLimitResult) {
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(int(result.Reset.Seconds())))
+}
+
+func returnTooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Max(1, retryAfter.Seconds()))))
+	returnStatusError(w, http.StatusTooManyRequests, "Too many requests, retry in "+strconv.Itoa(int(math.Max(1, retryAfter.Seconds())))+" seconds")
+}
+
+func rateLimit(next http.Handler) http.Handler {
+	/**
+	Function: rateLimit
+	Description: Middleware limiting the requests of every client with token buckets,
+	             answering 429 with Retry-After once a bucket is empty
+	*/
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		template := "*"
+		limit := DefaultRateLimit
+		if route := mux.CurrentRoute(r); route != nil {
+			if path, err := route.GetPathTemplate(); err == nil {
+				if routeLimit, found := RouteRateLimits[path]; found {
+					template = path
+					limit = routeLimit
+				}
+			}
+		}
+
+		result := RateLimits.take(rateLimitClient(r)+" "+template, limit, time.Now())
+		writeRateLimitHeaders(w, result)
+		if !result.Allowed {
+			returnTooManyRequests(w, result.RetryAfter)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
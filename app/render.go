@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	xhtml "golang.org/x/net/html"
+)
+
+// supported values for Note.Format, an empty format is treated as plain text
+const (
+	FormatPlain    = "plain"
+	FormatMarkdown = "markdown"
+	FormatHTML     = "html"
+)
+
+// markdown renderer with GitHub flavoured extensions (tables, task lists,
+// strikethrough and autolinks). Raw HTML inside markdown is left out of the
+// output since html.WithUnsafe is not set, the sanitizer only cleans up what
+// markdown itself produces, ex. links with unsafe urls.
+var markdownRenderer = goldmark.New(
+	goldmark.WithExtensions(extension.GFM),
+)
+
+// htmlSanitizer strips scripts, event handler attributes and unsafe urls
+// from rendered markdown and user supplied html bodies, use sanitizeHTML
+// so inputs other than checkboxes are removed as well
+var htmlSanitizer = newHTMLSanitizer()
+
+func newHTMLSanitizer() *bluemonday.Policy {
+	/**
+	Function: newHTMLSanitizer
+	Description: User generated content policy that also keeps GFM task list checkboxes.
+	             The policy can't require type="checkbox", an input left with only
+	             checked or disabled is removed by sanitizeHTML
+	*/
+	policy := bluemonday.UGCPolicy()
+	policy.AllowAttrs("type").Matching(regexp.MustCompile(`^checkbox$`)).OnElements("input")
+	policy.AllowAttrs("checked", "disabled").OnElements("input")
+	return policy
+}
+
+func sanitizeHTML(body string) string {
+	/**
+	Function: sanitizeHTML
+	Description: Sanitize html with htmlSanitizer and drop every input that is not a checkbox
+	*/
+	sanitized := htmlSanitizer.Sanitize(body)
+	if !strings.Contains(sanitized, "<input") {
+		return sanitized
+	}
+
+	var buf strings.Builder
+	tokenizer := xhtml.NewTokenizer(strings.NewReader(sanitized))
+	for {
+		switch tokenizer.Next() {
+		case xhtml.ErrorToken:
+			return buf.String()
+		case xhtml.StartTagToken, xhtml.SelfClosingTagToken:
+			if token := tokenizer.Token(); token.Data == "input" && !isCheckbox(token) {
+				continue
+			}
+		}
+		buf.Write(tokenizer.Raw())
+	}
+}
+
+func isCheckbox(token xhtml.Token) bool {
+	/**
+	Function: isCheckbox
+	Description: Determine if an input token has type="checkbox"
+	*/
+	for _, attr := range token.Attr {
+		if attr.Key == "type" && attr.Val == "checkbox" {
+			return true
+		}
+	}
+	return false
+}
+
+func validFormat(format string) bool {
+	/**
+	Function: validFormat
+	Description: Determine if a note body format is supported
+	*/
+	switch format {
+	case "", FormatPlain, FormatMarkdown, FormatHTML:
+		return true
+	}
+	return false
+}
+
+func renderBody(note Note) (string, error) {
+	/**
+	Function: renderBody
+	Description: Render a note body to sanitized HTML based on its format
+	*/
+	switch note.Format {
+	case FormatMarkdown:
+		var buf bytes.Buffer
+		if err := markdownRenderer.Convert([]byte(note.Body), &buf); err != nil {
+			return "", err
+		}
+		return sanitizeHTML(buf.String()), nil
+	case FormatHTML:
+		return sanitizeHTML(note.Body), nil
+	default:
+		return "<pre>" + html.EscapeString(note.Body) + "</pre>", nil
+	}
+}
+
+func renderNote(w http.ResponseWriter, r *http.Request) {
+	/**
+	Function: renderNote
+	Description: Get a note (based on id) from a notebook rendered as sanitized HTML
+	*/
+	_, notebooks, ok := ownerNotebooks(w, r, RoleViewer)
+	if !ok {
+		return
+	}
+
+	vars := mux.Vars(r)
+	title := vars["title"]
+	noteId := vars["noteId"]
+
+	// get notebook
+	notebook := notebooks[title]
+	if notebook == nil {
+		returnError(w, "Notebook \""+title+"\" does not exist")
+		return
+	}
+
+	for _, noteItr := range notebook {
+		if noteItr.Id == noteId {
+			rendered, err := renderBody(noteItr)
+			if err != nil {
+				returnError(w, "Could not render note \""+noteId+"\": "+err.Error())
+				return
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			io.WriteString(w, rendered)
+			return
+		}
+	}
+
+	returnError(w, "Note with id \""+noteId+"\" does not exist")
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// routes whose bodies are streamed to disk, their size is limited by the
+// attachment quota and the upload size instead of limits.max_request_bytes
+var streamingRoutes = map[string]bool{
+	"/addAttachments/{title}/{noteId}": true,
+	"/uploads/{uploadId}":              true,
+}
+
+// routes that transfer whole files, they get timeouts.stream to read the
+// request and write the response instead of timeouts.read and timeouts.write
+var transferRoutes = map[string]bool{
+	"/addAttachments/{title}/{noteId}":                    true,
+	"/uploads/{uploadId}":                                 true,
+	"/downloadAttachment/{title}/{noteId}/{attachmentId}": true,
+}
+
+func extendTransferDeadlines(next http.Handler) http.Handler {
+	/**
+	Function: extendTransferDeadlines
+	Description: Middleware moving the read and write deadlines of the connection to
+	             timeouts.stream from now for the transferRoutes
+	*/
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil {
+			if template, err := route.GetPathTemplate(); err == nil && transferRoutes[template] {
+				// the zero time is no deadline at all
+				var deadline time.Time
+				if stream := time.Duration(Settings.Timeouts.Stream); stream > 0 {
+					deadline = time.Now().Add(stream)
+				}
+				controller := http.NewResponseController(w)
+				// not supported by recorders in tests, the server timeouts apply then
+				controller.SetReadDeadline(deadline)
+				controller.SetWriteDeadline(deadline)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func limitRequestBodies(next http.Handler) http.Handler {
+	/**
+	Function: limitRequestBodies
+	Description: Middleware rejecting request bodies over limits.max_request_bytes (413)
+	*/
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil {
+			if template, err := route.GetPathTemplate(); err == nil && streamingRoutes[template] {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		limit := Settings.Limits.MaxRequestBytes
+		if r.ContentLength > limit {
+			returnStatusError(w, http.StatusRequestEntityTooLarge, "Request body exceeds "+strconv.FormatInt(limit, 10)+" bytes")
+			return
+		}
+		// bodies without a Content-Length are cut off at the limit
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func newServer(config Config) *http.Server {
+	/**
+	Function: newServer
+	Description: The HTTP server with the timeouts and header limit of the configuration
+	*/
+	return &http.Server{
+		Addr:              config.Listen,
+		Handler:           newRouter(),
+		ReadHeaderTimeout: time.Duration(config.Timeouts.ReadHeader),
+		ReadTimeout:       time.Duration(config.Timeouts.Read),
+		WriteTimeout:      time.Duration(config.Timeouts.Write),
+		IdleTimeout:       time.Duration(config.Timeouts.Idle),
+		MaxHeaderBytes:    config.Limits.MaxHeaderBytes,
+	}
+}
+
+func runServer(ctx context.Context, server *http.Server, listener net.Listener, shutdownTimeout time.Duration) error {
+	/**
+	Function: runServer
+	Description: Serve until ctx is done, then stop accepting connections and wait up to
+	             shutdownTimeout for the requests in progress to finish
+	*/
+	served := make(chan error, 1)
+	go func() {
+		if server.TLSConfig != nil {
+			// the certificate comes from server.TLSConfig
+			served <- server.ServeTLS(listener, "", "")
+		} else {
+			served <- server.Serve(listener)
+		}
+	}()
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	// load balancers stop sending requests once /readyz fails
+	Readiness.set(StateDraining)
+	if drain := time.Duration(Settings.Timeouts.Drain); drain > 0 {
+		Logger.Info("draining", "delay", drain.String())
+		time.Sleep(drain)
+	}
+
+	Logger.Info("shutting down, finishing the requests in progress")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		// requests still running after the timeout are cut off
+		server.Close()
+		return errors.New("requests in progress did not finish in " + shutdownTimeout.String() + ": " + err.Error())
+	}
+	if err := <-served; err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func closeStores() {
+	/**
+	Function: closeStores
+	Description: Flush and close the files of the stores and export the last spans before exiting
+	*/
+	if err := Audit.close(); err != nil {
+		Logger.Error("could not close the audit log", "error", err)
+	}
+	if err := Uploads.close(); err != nil {
+		Logger.Error("could not close the uploads", "error", err)
+	}
+	if err := Blobs.close(); err != nil {
+		Logger.Error("could not close the blob store", "error", err)
+	}
+	flushTracing()
+}
+
+func startServer(openStores func() error) {
+	/**
+	Function: startServer
+	Description: Serve the API until SIGINT or SIGTERM, then drain requests and close the stores.
+	             The health routes answer while openStores loads the stores
+	*/
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	server := newServer(Settings)
+	if Settings.TLS.CertFile != "" {
+		reloader, err := newCertReloader(Settings.TLS)
+		if err != nil {
+			fatal("could not load the TLS certificate", err)
+		}
+		server.TLSConfig = reloader.tlsConfig()
+		go reloader.watch(ctx)
+	}
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		fatal("could not listen", err)
+	}
+
+	Readiness.set(StateStarting)
+	storesLoading.Store(true)
+	loaded := make(chan struct{})
+	go func() {
+		defer close(loaded)
+		if err := openStores(); err != nil {
+			fatal("could not open the stores", err)
+		}
+		go Uploads.sweep(ctx)
+		// requests use the stores from here on
+		storesLoading.Store(false)
+		if Readiness.get() == StateStarting {
+			Readiness.set(StateReady)
+		}
+		Logger.Info("ready", "listen", listener.Addr().String())
+	}()
+
+	err = runServer(ctx, server, listener, time.Duration(Settings.Timeouts.Shutdown))
+	// a server stopped while starting closes the stores once they are open
+	<-loaded
+	closeStores()
+	if err != nil {
+		fatal("could not shut down cleanly", err)
+	}
+	Logger.Info("stopped")
+}
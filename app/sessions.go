@@ -0,0 +1,351 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Sessions use short lived signed access tokens and longer lived refresh
+// tokens. Both are HS256 JWTs carrying the id of the signing key in the
+// "kid" header so keys can be rotated without logging everybody out.
+
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 7 * 24 * time.Hour
+
+	tokenUseAccess  = "access"
+	tokenUseRefresh = "refresh"
+
+	tokenIssuer = "nevernote"
+)
+
+type sessionClaims struct {
+	TokenUse string `json:"token_use"`
+	jwt.RegisteredClaims
+}
+
+type signingKey struct {
+	Id     string
+	Secret []byte
+}
+
+type keyRing struct {
+	mu      sync.RWMutex
+	current string
+	keys    map[string]signingKey
+}
+
+// SigningKeys signs new tokens with the current key and verifies tokens
+// signed by any key still in the ring
+var SigningKeys = newKeyRing()
+
+type revocationList struct {
+	mu      sync.Mutex
+	revoked map[string]time.Time
+}
+
+// RevokedTokens holds the ids of tokens that were logged out or refreshed
+// until they would have expired anyway
+var RevokedTokens = newRevocationList()
+
+var errInvalidToken = errors.New("unauthorized: invalid or expired token")
+
+func newKeyRing() *keyRing {
+	return &keyRing{keys: make(map[string]signingKey)}
+}
+
+func randomKey() (signingKey, error) {
+	id := make([]byte, 4)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return signingKey{}, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return signingKey{}, err
+	}
+	return signingKey{Id: hex.EncodeToString(id), Secret: secret}, nil
+}
+
+func parseSigningKeys(config string) ([]signingKey, error) {
+	/**
+	Function: parseSigningKeys
+	Description: Parse comma separated "kid:base64 secret" pairs, the first key signs new tokens
+	*/
+	var keys []signingKey
+	for _, pair := range strings.Split(config, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		id, encoded, found := strings.Cut(pair, ":")
+		if !found || id == "" {
+			return nil, errors.New("signing key \"" + pair + "\" must look like kid:base64secret")
+		}
+		secret, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, errors.New("signing key \"" + id + "\" is not valid base64")
+		}
+		if len(secret) < 32 {
+			return nil, errors.New("signing key \"" + id + "\" must be at least 32 bytes")
+		}
+		keys = append(keys, signingKey{Id: id, Secret: secret})
+	}
+	return keys, nil
+}
+
+func (ring *keyRing) add(key signingKey, makeCurrent bool) {
+	/**
+	Function: add
+	Description: Add a key for verification, optionally signing new tokens with it
+	*/
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+	ring.keys[key.Id] = key
+	if makeCurrent || ring.current == "" {
+		ring.current = key.Id
+	}
+}
+
+func (ring *keyRing) sign(claims sessionClaims) (string, error) {
+	ring.mu.RLock()
+	key, ok := ring.keys[ring.current]
+	ring.mu.RUnlock()
+	if !ok {
+		return "", errors.New("no signing key configured")
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = key.Id
+	return token.SignedString(key.Secret)
+}
+
+func (ring *keyRing) verify(tokenString string, tokenUse string) (*sessionClaims, error) {
+	/**
+	Function: verify
+	Description: Check the signature, expiry and use of a token and that it was not revoked
+	*/
+	claims := &sessionClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		id, _ := token.Header["kid"].(string)
+		ring.mu.RLock()
+		defer ring.mu.RUnlock()
+		key, ok := ring.keys[id]
+		if !ok {
+			return nil, errors.New("unknown signing key")
+		}
+		return key.Secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithIssuer(tokenIssuer), jwt.WithExpirationRequired())
+	if err != nil || claims.TokenUse != tokenUse || RevokedTokens.isRevoked(claims.ID) {
+		return nil, errInvalidToken
+	}
+	return claims, nil
+}
+
+func newRevocationList() *revocationList {
+	return &revocationList{revoked: make(map[string]time.Time)}
+}
+
+func (list *revocationList) revoke(claims *sessionClaims) bool {
+	/**
+	Function: revoke
+	Description: Reject a token until it expires, dropping entries that already expired.
+	             Returns false if the token was already revoked
+	*/
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	if _, revoked := list.revoked[claims.ID]; revoked {
+		return false
+	}
+
+	now := time.Now()
+	for id, expires := range list.revoked {
+		if expires.Before(now) {
+			delete(list.revoked, id)
+		}
+	}
+	list.revoked[claims.ID] = claims.ExpiresAt.Time
+	return true
+}
+
+func (list *revocationList) isRevoked(id string) bool {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	_, revoked := list.revoked[id]
+	return revoked
+}
+
+// SessionTokens is returned by login and refresh
+type SessionTokens struct {
+	AccessToken  string `json:"AccessToken"`
+	RefreshToken string `json:"RefreshToken"`
+	TokenType    string `json:"TokenType"`
+	ExpiresIn    int    `json:"ExpiresIn"`
+}
+
+func issueTokens(username string) (SessionTokens, error) {
+	/**
+	Function: issueTokens
+	Description: Sign a new access and refresh token pair for a user
+	*/
+	now := time.Now()
+	newClaims := func(tokenUse string, ttl time.Duration) (sessionClaims, error) {
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			return sessionClaims{}, err
+		}
+		return sessionClaims{
+			TokenUse: tokenUse,
+			RegisteredClaims: jwt.RegisteredClaims{
+				ID:        hex.EncodeToString(id),
+				Issuer:    tokenIssuer,
+				Subject:   username,
+				IssuedAt:  jwt.NewNumericDate(now),
+				ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+			},
+		}, nil
+	}
+
+	accessClaims, err := newClaims(tokenUseAccess, accessTokenTTL)
+	if err != nil {
+		return SessionTokens{}, err
+	}
+	refreshClaims, err := newClaims(tokenUseRefresh, refreshTokenTTL)
+	if err != nil {
+		return SessionTokens{}, err
+	}
+
+	access, err := SigningKeys.sign(accessClaims)
+	if err != nil {
+		return SessionTokens{}, err
+	}
+	refresh, err := SigningKeys.sign(refreshClaims)
+	if err != nil {
+		return SessionTokens{}, err
+	}
+	return SessionTokens{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(accessTokenTTL.Seconds()),
+	}, nil
+}
+
+func authenticateToken(token string) (Principal, error) {
+	/**
+	Function: authenticateToken
+	Description: Find the user of a session access token
+	*/
+	claims, err := SigningKeys.verify(token, tokenUseAccess)
+	if err != nil {
+		return Principal{}, err
+	}
+	user, found := Accounts.user(claims.Subject)
+	if !found {
+		return Principal{}, errInvalidToken
+	}
+	return Principal{User: user, Session: claims}, nil
+}
+
+func login(w http.ResponseWriter, r *http.Request) {
+	/**
+	Function: login
+	Description: Exchange a username and password for session tokens
+	*/
+	reqBody, _ := ioutil.ReadAll(r.Body)
+	var request struct {
+		Username string `json:"Username"`
+		Password string `json:"Password"`
+	}
+	json.Unmarshal(reqBody, &request)
+
+	failedAuth := failedAuthKey(r)
+	if failedAuthLimited(w, failedAuth) {
+		return
+	}
+	user, err := Accounts.checkPassword(request.Username, request.Password)
+	if err != nil {
+		recordFailedAuth(failedAuth)
+		returnUnauthorized(w, err.Error())
+		return
+	}
+
+	tokens, err := issueTokens(user.Username)
+	if err != nil {
+		returnError(w, "Could not issue tokens: "+err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func refresh(w http.ResponseWriter, r *http.Request) {
+	/**
+	Function: refresh
+	Description: Exchange a refresh token for new session tokens, the old refresh token stops working
+	*/
+	reqBody, _ := ioutil.ReadAll(r.Body)
+	var request struct {
+		RefreshToken string `json:"RefreshToken"`
+	}
+	json.Unmarshal(reqBody, &request)
+
+	claims, err := SigningKeys.verify(request.RefreshToken, tokenUseRefresh)
+	if err != nil {
+		returnUnauthorized(w, err.Error())
+		return
+	}
+	if _, found := Accounts.user(claims.Subject); !found {
+		returnUnauthorized(w, errInvalidToken.Error())
+		return
+	}
+	// a refresh token can only be used once, even by concurrent requests
+	if !RevokedTokens.revoke(claims) {
+		returnUnauthorized(w, errInvalidToken.Error())
+		return
+	}
+
+	tokens, err := issueTokens(claims.Subject)
+	if err != nil {
+		returnError(w, "Could not issue tokens: "+err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func logout(w http.ResponseWriter, r *http.Request) {
+	/**
+	Function: logout
+	Description: Revoke the access token of the request and, if given, its refresh token
+	*/
+	principal, ok := currentPrincipal(r)
+	if !ok || principal.Session == nil {
+		returnUnauthorized(w, "unauthorized: logout needs a session access token")
+		return
+	}
+
+	reqBody, _ := ioutil.ReadAll(r.Body)
+	var request struct {
+		RefreshToken string `json:"RefreshToken"`
+	}
+	json.Unmarshal(reqBody, &request)
+
+	if request.RefreshToken != "" {
+		claims, err := SigningKeys.verify(request.RefreshToken, tokenUseRefresh)
+		if err == nil && claims.Subject == principal.User.Username {
+			RevokedTokens.revoke(claims)
+		}
+	}
+	RevokedTokens.revoke(principal.Session)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Notebook roles, each role can do everything the roles before it can.
+// Viewers read notes, commenters also comment on them and editors also
+// create, change and delete notes. Only the owner manages the notebook itself
+// and who it is shared with.
+const (
+	RoleViewer    = "viewer"
+	RoleCommenter = "commenter"
+	RoleEditor    = "editor"
+	RoleOwner     = "owner"
+)
+
+var roleRank = map[string]int{
+	RoleViewer:    1,
+	RoleCommenter: 2,
+	RoleEditor:    3,
+	RoleOwner:     4,
+}
+
+// ShareGrant gives a user a role on a notebook of another user
+type ShareGrant struct {
+	Owner    string `json:"Owner"`
+	Notebook string `json:"Notebook"`
+	Username string `json:"Username"`
+	Role     string `json:"Role"`
+	Created  string `json:"Created"`
+}
+
+// sharedNotebook identifies a notebook, titles are only unique per owner
+type sharedNotebook struct {
+	Owner    string
+	Notebook string
+}
+
+type shareStore struct {
+	mu sync.Mutex
+	// notebook -> username -> grant
+	grants map[sharedNotebook]map[string]*ShareGrant
+}
+
+// Shares holds who every notebook is shared with
+var Shares = newShareStore()
+
+func newShareStore() *shareStore {
+	return &shareStore{grants: make(map[sharedNotebook]map[string]*ShareGrant)}
+}
+
+func validShareRole(role string) bool {
+	return role == RoleViewer || role == RoleCommenter || role == RoleEditor
+}
+
+func roleAllows(role string, required string) bool {
+	return role != "" && roleRank[role] >= roleRank[required]
+}
+
+func (store *shareStore) grant(owner string, notebookTitle string, username string, role string) ShareGrant {
+	/**
+	Function: grant
+	Description: Share a notebook with a user or change the role of an existing share
+	*/
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	notebook := sharedNotebook{Owner: owner, Notebook: notebookTitle}
+	if store.grants[notebook] == nil {
+		store.grants[notebook] = make(map[string]*ShareGrant)
+	}
+	grant := store.grants[notebook][username]
+	if grant == nil {
+		grant = &ShareGrant{
+			Owner:    owner,
+			Notebook: notebookTitle,
+			Username: username,
+			Created:  time.Now().Format("2006.01.02 15:04:05"),
+		}
+		store.grants[notebook][username] = grant
+	}
+	grant.Role = role
+	return *grant
+}
+
+func (store *shareStore) revoke(owner string, notebookTitle string, username string) (ShareGrant, bool) {
+	/**
+	Function: revoke
+	Description: Stop sharing a notebook with a user
+	*/
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	notebook := sharedNotebook{Owner: owner, Notebook: notebookTitle}
+	grant := store.grants[notebook][username]
+	if grant == nil {
+		return ShareGrant{}, false
+	}
+	delete(store.grants[notebook], username)
+	if len(store.grants[notebook]) == 0 {
+		delete(store.grants, notebook)
+	}
+	return *grant, true
+}
+
+func (store *shareStore) removeNotebook(owner string, notebookTitle string) {
+	/**
+	Function: removeNotebook
+	Description: Drop every share of a deleted or replaced notebook so a new notebook with
+	             the same title starts private
+	*/
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.grants, sharedNotebook{Owner: owner, Notebook: notebookTitle})
+}
+
+func (store *shareStore) role(owner string, notebookTitle string, username string) string {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if grant := store.grants[sharedNotebook{Owner: owner, Notebook: notebookTitle}][username]; grant != nil {
+		return grant.Role
+	}
+	return ""
+}
+
+func (store *shareStore) list(owner string, notebookTitle string) []ShareGrant {
+	/**
+	Function: list
+	Description: Everybody a notebook is shared with, sorted by username
+	*/
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	grants := []ShareGrant{}
+	for _, grant := range store.grants[sharedNotebook{Owner: owner, Notebook: notebookTitle}] {
+		grants = append(grants, *grant)
+	}
+	sort.Slice(grants, func(i, j int) bool { return grants[i].Username < grants[j].Username })
+	return grants
+}
+
+func (store *shareStore) sharedWith(username string) []ShareGrant {
+	/**
+	Function: sharedWith
+	Description: Every notebook shared with a user, sorted by owner and title
+	*/
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	grants := []ShareGrant{}
+	for _, users := range store.grants {
+		if grant := users[username]; grant != nil {
+			grants = append(grants, *grant)
+		}
+	}
+	sort.Slice(grants, func(i, j int) bool {
+		if grants[i].Owner != grants[j].Owner {
+			return grants[i].Owner < grants[j].Owner
+		}
+		return grants[i].Notebook < grants[j].Notebook
+	})
+	return grants
+}
+
+func notebookRole(owner string, notebookTitle string, username string) string {
+	/**
+	Function: notebookRole
+	Description: The role of a user on a notebook, owners have every permission
+	*/
+	if username == owner {
+		return RoleOwner
+	}
+	return Shares.role(owner, notebookTitle, username)
+}
+
+func requestUsername(r *http.Request) string {
+	principal, _ := currentPrincipal(r)
+	return principal.User.Username
+}
+
+func shareableNotebook(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	/**
+	Function: shareableNotebook
+	Description: The owner and title of a notebook of the current user whose shares are managed
+	*/
+	owner, notebooks, ok := ownerNotebooks(w, r, RoleOwner)
+	if !ok {
+		return "", "", false
+	}
+	title := mux.Vars(r)["title"]
+	if notebooks[title] == nil {
+		returnStatusError(w, http.StatusNotFound, "Notebook \""+title+"\" does not exist")
+		return "", "", false
+	}
+	return owner, title, true
+}
+
+func shareNotebook(w http.ResponseWriter, r *http.Request) {
+	/**
+	Function: shareNotebook
+	Description: Invite a user to a notebook as viewer, commenter or editor
+	*/
+	owner, title, ok := shareableNotebook(w, r)
+	if !ok {
+		return
+	}
+
+	reqBody, _ := ioutil.ReadAll(r.Body)
+	var request struct {
+		Username string `json:"Username"`
+		Role     string `json:"Role"`
+	}
+	json.Unmarshal(reqBody, &request)
+
+	if !validShareRole(request.Role) {
+		returnStatusError(w, http.StatusBadRequest, "Unsupported role \""+request.Role+"\", use one of viewer, commenter, editor")
+		return
+	}
+	if request.Username == owner {
+		returnStatusError(w, http.StatusBadRequest, "Cannot share a notebook with its owner")
+		return
+	}
+	if _, found := Accounts.user(request.Username); !found {
+		returnStatusError(w, http.StatusNotFound, "User \""+request.Username+"\" does not exist")
+		return
+	}
+	if Shares.role(owner, title, request.Username) != "" {
+		returnStatusError(w, http.StatusConflict, "Notebook \""+title+"\" is already shared with \""+request.Username+"\"")
+		return
+	}
+
+	grant := Shares.grant(owner, title, request.Username, request.Role)
+	audit(r, AuditEvent{Action: AuditShareCreate, Owner: owner, Notebook: title, Target: grant.Username}, nil, grant)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(grant)
+}
+
+func updateShare(w http.ResponseWriter, r *http.Request) {
+	/**
+	Function: updateShare
+	Description: Change the role of a user a notebook is shared with
+	*/
+	owner, title, ok := shareableNotebook(w, r)
+	if !ok {
+		return
+	}
+	username := mux.Vars(r)["username"]
+
+	reqBody, _ := ioutil.ReadAll(r.Body)
+	var request struct {
+		Role string `json:"Role"`
+	}
+	json.Unmarshal(reqBody, &request)
+
+	if !validShareRole(request.Role) {
+		returnStatusError(w, http.StatusBadRequest, "Unsupported role \""+request.Role+"\", use one of viewer, commenter, editor")
+		return
+	}
+	previousRole := Shares.role(owner, title, username)
+	if previousRole == "" {
+		returnStatusError(w, http.StatusNotFound, "Notebook \""+title+"\" is not shared with \""+username+"\"")
+		return
+	}
+
+	grant := Shares.grant(owner, title, username, request.Role)
+	before := grant
+	before.Role = previousRole
+	audit(r, AuditEvent{Action: AuditShareUpdate, Owner: owner, Notebook: title, Target: username}, before, grant)
+
+	json.NewEncoder(w).Encode(grant)
+}
+
+func revokeShare(w http.ResponseWriter, r *http.Request) {
+	/**
+	Function: revokeShare
+	Description: Stop sharing a notebook with a user
+	*/
+	owner, title, ok := shareableNotebook(w, r)
+	if !ok {
+		return
+	}
+	username := mux.Vars(r)["username"]
+
+	grant, found := Shares.revoke(owner, title, username)
+	if !found {
+		returnStatusError(w, http.StatusNotFound, "Notebook \""+title+"\" is not shared with \""+username+"\"")
+		return
+	}
+	audit(r, AuditEvent{Action: AuditShareRevoke, Owner: owner, Notebook: title, Target: username}, grant, nil)
+
+	json.NewEncoder(w).Encode(grant)
+}
+
+func listShares(w http.ResponseWriter, r *http.Request) {
+	/**
+	Function: listShares
+	Description: List the users a notebook is shared with and their roles
+	*/
+	owner, title, ok := shareableNotebook(w, r)
+	if !ok {
+		return
+	}
+	json.NewEncoder(w).Encode(Shares.list(owner, title))
+}
+
+func sharedWithMe(w http.ResponseWriter, r *http.Request) {
+	/**
+	Function: sharedWithMe
+	Description: List the notebooks of other users shared with the current user
+	*/
+	username := requestUsername(r)
+	if username == "" {
+		returnUnauthorized(w, "unauthorized: credentials required")
+		return
+	}
+	json.NewEncoder(w).Encode(Shares.sharedWith(username))
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// TagSuggestion is a single autocomplete result
+type TagSuggestion struct {
+	Tag   string `json:"Tag"`
+	Count int    `json:"Count"`
+}
+
+// tagTrieNode is a node in the tag prefix index. Tags are keyed by their
+// lowercase form so that completion is case insensitive, while the original
+// spelling of every tag is kept on the terminal node.
+type tagTrieNode struct {
+	children map[rune]*tagTrieNode
+	// tag spelling -> notebook -> number of notes using the tag
+	tags map[string]map[tagScope]int
+}
+
+// tagScope is a notebook of a user, tags are only suggested to their owner
+type tagScope struct {
+	Owner    string
+	Notebook string
+}
+
+type tagIndex struct {
+	mu   sync.Mutex
+	root *tagTrieNode
+}
+
+// TagIndex holds usage counts for every tag so that autocomplete does not
+// need to scan all notes on every keystroke
+var TagIndex = newTagIndex()
+
+const defaultTagSuggestions = 10
+
+func newTagIndex() *tagIndex {
+	return &tagIndex{root: newTagTrieNode()}
+}
+
+func newTagTrieNode() *tagTrieNode {
+	return &tagTrieNode{children: make(map[rune]*tagTrieNode)}
+}
+
+func (idx *tagIndex) add(owner string, notebookTitle string, tags []string) {
+	/**
+	Function: add
+	Description: Count one more use of each tag in a notebook
+	*/
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	scope := tagScope{Owner: owner, Notebook: notebookTitle}
+	for _, tag := range uniqueTags(tags) {
+		node := idx.root
+		for _, r := range strings.ToLower(tag) {
+			child := node.children[r]
+			if child == nil {
+				child = newTagTrieNode()
+				node.children[r] = child
+			}
+			node = child
+		}
+		if node.tags == nil {
+			node.tags = make(map[string]map[tagScope]int)
+		}
+		if node.tags[tag] == nil {
+			node.tags[tag] = make(map[tagScope]int)
+		}
+		node.tags[tag][scope]++
+	}
+}
+
+func (idx *tagIndex) remove(owner string, notebookTitle string, tags []string) {
+	/**
+	Function: remove
+	Description: Count one less use of each tag in a notebook, pruning empty branches
+	*/
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	scope := tagScope{Owner: owner, Notebook: notebookTitle}
+	for _, tag := range uniqueTags(tags) {
+		path := []*tagTrieNode{idx.root}
+		keys := []rune(strings.ToLower(tag))
+		node := idx.root
+		for _, r := range keys {
+			node = node.children[r]
+			if node == nil {
+				break
+			}
+			path = append(path, node)
+		}
+		if node == nil || node.tags[tag] == nil {
+			continue
+		}
+
+		node.tags[tag][scope]--
+		if node.tags[tag][scope] <= 0 {
+			delete(node.tags[tag], scope)
+		}
+		if len(node.tags[tag]) == 0 {
+			delete(node.tags, tag)
+		}
+
+		// prune nodes that no longer lead to any tag
+		for i := len(path) - 1; i > 0; i-- {
+			if len(path[i].tags) > 0 || len(path[i].children) > 0 {
+				break
+			}
+			delete(path[i-1].children, keys[i-1])
+		}
+	}
+}
+
+func (idx *tagIndex) complete(owner string, prefix string, notebookTitle string, limit int) []TagSuggestion {
+	/**
+	Function: complete
+	Description: Returns the most used tags of a user starting with prefix, optionally scoped to a notebook
+	*/
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	suggestions := []TagSuggestion{}
+
+	node := idx.root
+	for _, r := range strings.ToLower(prefix) {
+		node = node.children[r]
+		if node == nil {
+			return suggestions
+		}
+	}
+
+	stack := []*tagTrieNode{node}
+	for len(stack) > 0 {
+		node = stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		for tag, counts := range node.tags {
+			count := 0
+			for scope, n := range counts {
+				if scope.Owner == owner && (notebookTitle == "" || scope.Notebook == notebookTitle) {
+					count += n
+				}
+			}
+			if count > 0 {
+				suggestions = append(suggestions, TagSuggestion{Tag: tag, Count: count})
+			}
+		}
+		for _, child := range node.children {
+			stack = append(stack, child)
+		}
+	}
+
+	sort.Slice(suggestions, func(i, j int) bool {
+		if suggestions[i].Count != suggestions[j].Count {
+			return suggestions[i].Count > suggestions[j].Count
+		}
+		return suggestions[i].Tag < suggestions[j].Tag
+	})
+
+	if limit > 0 && len(suggestions) > limit {
+		suggestions = suggestions[:limit]
+	}
+	return suggestions
+}
+
+func (idx *tagIndex) size() int {
+	/**
+	Function: size
+	Description: Number of distinct tags in the index
+	*/
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	size := 0
+	stack := []*tagTrieNode{idx.root}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		size += len(node.tags)
+		for _, child := range node.children {
+			stack = append(stack, child)
+		}
+	}
+	return size
+}
+
+func uniqueTags(tags []string) []string {
+	/**
+	Function: uniqueTags
+	Description: Drop duplicate and empty tags so a note is only counted once per tag
+	*/
+	seen := make(map[string]bool, len(tags))
+	var unique []string
+	for _, tag := range tags {
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		unique = append(unique, tag)
+	}
+	return unique
+}
+
+func rebuildTagIndex() {
+	/**
+	Function: rebuildTagIndex
+	Description: Rebuild the tag index from every note in every notebook of every user
+	*/
+	index := newTagIndex()
+	for owner, notebooks := range Notebooks {
+		for title, notebook := range notebooks {
+			for _, note := range notebook {
+				index.add(owner, title, note.Tags)
+			}
+		}
+	}
+	TagIndex = index
+}
+
+func autocompleteTags(w http.ResponseWriter, r *http.Request) {
+	/**
+	Function: autocompleteTags
+	Description: Suggest the most frequently used tags matching a prefix
+	*/
+	owner, notebooks, ok := ownerNotebooks(w, r, RoleOwner)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	notebookTitle := query.Get("notebook")
+
+	limit := defaultTagSuggestions
+	if query.Get("limit") != "" {
+		parsed, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || parsed <= 0 {
+			returnError(w, "Invalid limit \""+query.Get("limit")+"\"")
+			return
+		}
+		limit = parsed
+	}
+
+	if notebookTitle != "" && notebooks[notebookTitle] == nil {
+		returnError(w, "Notebook \""+notebookTitle+"\" does not exist")
+		return
+	}
+
+	json.NewEncoder(w).Encode(TagIndex.complete(owner, prefix, notebookTitle, limit))
+}
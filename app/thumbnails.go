@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/image/draw"
+)
+
+// thumbnailSizes is the longest side in pixels of each generated thumbnail
+var thumbnailSizes = map[string]int{
+	"small":  64,
+	"medium": 256,
+	"large":  1024,
+}
+
+const defaultThumbnailSize = "medium"
+
+// images with more pixels than this are not decoded to protect against
+// decompression bombs
+const maxImagePixels = 50000000
+
+var errImageTooLarge = errors.New("image is too large to generate thumbnails")
+
+func isImageType(contentType string) bool {
+	switch contentType {
+	case "image/png", "image/jpeg", "image/gif":
+		return true
+	}
+	return false
+}
+
+func sniffContentType(ctx context.Context, sum string) (string, error) {
+	/**
+	Function: sniffContentType
+	Description: Detect the MIME type of a stored blob from its first bytes
+	*/
+	blob, err := Blobs.open(ctx, sum)
+	if err != nil {
+		return "", err
+	}
+	defer blob.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(blob, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	return http.DetectContentType(head[:n]), nil
+}
+
+func decodeImage(ctx context.Context, sum string) (image.Image, error) {
+	/**
+	Function: decodeImage
+	Description: Decode a stored PNG, JPEG or GIF (first frame) after checking its dimensions
+	*/
+	blob, err := Blobs.open(ctx, sum)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+
+	config, _, err := image.DecodeConfig(blob)
+	if err != nil {
+		return nil, err
+	}
+	if config.Width*config.Height > maxImagePixels {
+		return nil, errImageTooLarge
+	}
+
+	if _, err := blob.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(blob)
+	return img, err
+}
+
+func thumbnail(img image.Image, maxSide int) image.Image {
+	/**
+	Function: thumbnail
+	Description: Scale an image down so its longest side is maxSide, keeping the aspect ratio
+	*/
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= maxSide && height <= maxSide {
+		return img
+	}
+
+	if width >= height {
+		height = max(1, height*maxSide/width)
+		width = maxSide
+	} else {
+		width = max(1, width*maxSide/height)
+		height = maxSide
+	}
+
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), img, bounds, draw.Over, nil)
+	return scaled
+}
+
+func encodeThumbnail(img image.Image, contentType string) ([]byte, error) {
+	/**
+	Function: encodeThumbnail
+	Description: Encode photos as JPEG and everything else as PNG to keep transparency
+	*/
+	var buf bytes.Buffer
+	var err error
+	if contentType == "image/jpeg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	return buf.Bytes(), err
+}
+
+func inspectAttachment(ctx context.Context, attachment *Attachment) (err error) {
+	/**
+	Function: inspectAttachment
+	Description: Sniff the MIME type of an attachment and, for images, record the
+	             dimensions and store thumbnails in the blob store
+	*/
+	ctx, span := startSpan(ctx, "attachment.inspect", attribute.String("blob.sha256", attachment.SHA256))
+	defer func() { endSpan(span, err) }()
+
+	detected, err := sniffContentType(ctx, attachment.SHA256)
+	if err != nil {
+		return err
+	}
+	attachment.DetectedType = detected
+	if attachment.ContentType == "" || attachment.ContentType == "application/octet-stream" {
+		attachment.ContentType = detected
+	}
+	if !isImageType(detected) {
+		return nil
+	}
+
+	img, err := decodeImage(ctx, attachment.SHA256)
+	if err != nil {
+		return err
+	}
+	attachment.Width = img.Bounds().Dx()
+	attachment.Height = img.Bounds().Dy()
+
+	attachment.Thumbnails = make(map[string]string, len(thumbnailSizes))
+	for name, maxSide := range thumbnailSizes {
+		encoded, err := encodeThumbnail(thumbnail(img, maxSide), detected)
+		if err != nil {
+			return err
+		}
+		sum, _, err := Blobs.put(ctx, bytes.NewReader(encoded))
+		if err != nil {
+			return err
+		}
+		attachment.Thumbnails[name] = sum
+	}
+	return nil
+}
+
+func attachmentThumbnail(w http.ResponseWriter, r *http.Request) {
+	/**
+	Function: attachmentThumbnail
+	Description: Download a thumbnail of an image attachment (size small, medium or large)
+	*/
+	vars := mux.Vars(r)
+	title := vars["title"]
+	noteId := vars["noteId"]
+	attachmentId := vars["attachmentId"]
+
+	size := r.URL.Query().Get("size")
+	if size == "" {
+		size = defaultThumbnailSize
+	}
+	if _, ok := thumbnailSizes[size]; !ok {
+		names := make([]string, 0, len(thumbnailSizes))
+		for name := range thumbnailSizes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		returnError(w, "Unsupported thumbnail size \""+size+"\", use one of "+strings.Join(names, ", "))
+		return
+	}
+
+	attachment, ok := readAttachment(w, r, title, noteId, attachmentId)
+	if !ok {
+		return
+	}
+	sum := attachment.Thumbnails[size]
+	if sum == "" {
+		returnError(w, "Attachment with id \""+attachmentId+"\" has no thumbnails")
+		return
+	}
+
+	blob, err := Blobs.open(r.Context(), sum)
+	if err != nil {
+		returnError(w, "Could not open thumbnail: "+err.Error())
+		return
+	}
+	defer blob.Close()
+	info, err := blob.Stat()
+	if err != nil {
+		returnError(w, "Could not open thumbnail: "+err.Error())
+		return
+	}
+
+	contentType := "image/png"
+	if attachment.DetectedType == "image/jpeg" {
+		contentType = "image/jpeg"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", "\""+sum+"\"")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	http.ServeContent(w, r, "", info.ModTime(), blob)
+}
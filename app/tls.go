@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// TLS versions for tls.min_version
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// client certificate policies for tls.client_auth. Clients with a verified
+// certificate are authenticated as the user named by its common name.
+var tlsClientAuth = map[string]tls.ClientAuthType{
+	"none":    tls.NoClientCert,
+	"request": tls.VerifyClientCertIfGiven,
+	"require": tls.RequireAndVerifyClientCert,
+}
+
+// how often the certificate files are checked for changes
+const certReloadInterval = 10 * time.Second
+
+func tlsCipherSuite(name string) (uint16, bool) {
+	/**
+	Function: tlsCipherSuite
+	Description: The id of a secure TLS 1.2 cipher suite by its name (ex. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256)
+	*/
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
+
+// certReloader serves the certificate and client CAs last read from their
+// files, so they can be replaced without restarting the server
+type certReloader struct {
+	config TLSConfig
+
+	mu          sync.RWMutex
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+	modified    map[string]time.Time
+}
+
+func newCertReloader(config TLSConfig) (*certReloader, error) {
+	reloader := &certReloader{config: config}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+func (reloader *certReloader) files() []string {
+	files := []string{reloader.config.CertFile, reloader.config.KeyFile}
+	if reloader.config.ClientCAFile != "" {
+		files = append(files, reloader.config.ClientCAFile)
+	}
+	return files
+}
+
+func (reloader *certReloader) reload() error {
+	/**
+	Function: reload
+	Description: Read the certificate, key and client CAs again, keeping the old ones if they are invalid
+	*/
+	modified := make(map[string]time.Time)
+	for _, file := range reloader.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modified[file] = info.ModTime()
+	}
+
+	certificate, err := tls.LoadX509KeyPair(reloader.config.CertFile, reloader.config.KeyFile)
+	if err != nil {
+		return err
+	}
+	var clientCAs *x509.CertPool
+	if reloader.config.ClientCAFile != "" {
+		pem, err := os.ReadFile(reloader.config.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return errors.New("no certificates in " + reloader.config.ClientCAFile)
+		}
+	}
+
+	reloader.mu.Lock()
+	defer reloader.mu.Unlock()
+	reloader.certificate = &certificate
+	reloader.clientCAs = clientCAs
+	reloader.modified = modified
+	return nil
+}
+
+func (reloader *certReloader) changed() bool {
+	reloader.mu.RLock()
+	defer reloader.mu.RUnlock()
+	for _, file := range reloader.files() {
+		info, err := os.Stat(file)
+		if err != nil || !info.ModTime().Equal(reloader.modified[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (reloader *certReloader) watch(ctx context.Context) {
+	/**
+	Function: watch
+	Description: Reload the certificate when its files change or on SIGHUP until ctx is done
+	*/
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	ticker := time.NewTicker(certReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !reloader.changed() {
+				continue
+			}
+		case <-hangup:
+		}
+		if err := reloader.reload(); err != nil {
+			Logger.Error("could not reload the TLS certificate, still serving the old one", "error", err)
+			continue
+		}
+		Logger.Info("reloaded the TLS certificate", "cert_file", reloader.config.CertFile)
+	}
+}
+
+func (reloader *certReloader) tlsConfig() *tls.Config {
+	/**
+	Function: tlsConfig
+	Description: The TLS settings of the server, every handshake uses the current certificate and client CAs
+	*/
+	base := &tls.Config{
+		MinVersion: tlsVersions[reloader.config.MinVersion],
+		ClientAuth: tlsClientAuth[reloader.config.ClientAuth],
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	for _, name := range reloader.config.Ciphers {
+		id, _ := tlsCipherSuite(name)
+		base.CipherSuites = append(base.CipherSuites, id)
+	}
+
+	config := base.Clone()
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		reloader.mu.RLock()
+		defer reloader.mu.RUnlock()
+		current := base.Clone()
+		current.Certificates = []tls.Certificate{*reloader.certificate}
+		current.ClientCAs = reloader.clientCAs
+		return current, nil
+	}
+	// for servers that only look for GetCertificate
+	config.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		reloader.mu.RLock()
+		defer reloader.mu.RUnlock()
+		return reloader.certificate, nil
+	}
+	return config
+}
+
+func clientCertificateUser(r *http.Request) (User, bool, error) {
+	/**
+	Function: clientCertificateUser
+	Description: The user named by the common name of a verified client certificate, if the request has one
+	*/
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return User{}, false, nil
+	}
+	username := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	user, found := Accounts.user(username)
+	if !found {
+		return User{}, true, errors.New("unauthorized: no user \"" + username + "\" for the client certificate")
+	}
+	return user, true, nil
+}
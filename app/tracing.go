@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "nevernote"
+
+// tracer starts the spans of the server. Until setupTracing installs an
+// exporter it is a no-op, so spans cost next to nothing.
+var tracer = otel.Tracer(tracerName)
+
+// shutdownTracing exports the spans not sent yet, main sets it to the function
+// returned by setupTracing
+var shutdownTracing = func(context.Context) error { return nil }
+
+// propagator reads and writes the W3C traceparent and tracestate headers
+var propagator = propagation.TraceContext{}
+
+func newTracerProvider(config TracingConfig, exporter sdktrace.SpanExporter) *sdktrace.TracerProvider {
+	/**
+	Function: newTracerProvider
+	Description: A tracer provider batching spans to exporter, sampling config.SampleRatio
+	             of new traces and following the decision of the caller for the others
+	*/
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", config.ServiceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+	)
+}
+
+func setupTracing(ctx context.Context, config TracingConfig) (func(context.Context) error, error) {
+	/**
+	Function: setupTracing
+	Description: Export spans over OTLP/HTTP to tracing.endpoint, returning a function that
+	             flushes the spans not exported yet. Tracing is a no-op without an endpoint
+	*/
+	otel.SetTextMapPropagator(propagator)
+	if config.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(config.Endpoint))
+	if err != nil {
+		return nil, err
+	}
+	provider := newTracerProvider(config, exporter)
+	otel.SetTracerProvider(provider)
+	tracer = provider.Tracer(tracerName)
+	return provider.Shutdown, nil
+}
+
+func flushTracing() {
+	/**
+	Function: flushTracing
+	Description: Export the spans of the last requests before exiting
+	*/
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(ctx); err != nil {
+		Logger.Error("could not export the remaining spans", "error", err)
+	}
+}
+
+func startSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+func endSpan(span trace.Span, err error) {
+	/**
+	Function: endSpan
+	Description: End a span, marking it failed when err is set
+	*/
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func traceRequests(next http.Handler) http.Handler {
+	/**
+	Function: traceRequests
+	Description: Middleware starting a span for every request, continuing the trace of
+	             the traceparent header sent by the client
+	*/
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		route := routeTemplate(r)
+		ctx, span := tracer.Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("http.route", route),
+				attribute.String("url.path", r.URL.Path),
+				attribute.String("client.address", clientIP(r)),
+				attribute.String("nevernote.request_id", r.Header.Get(requestIdHeader)),
+			),
+		)
+		defer span.End()
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		span.SetAttributes(
+			attribute.Int("http.response.status_code", recorder.status),
+			attribute.Int64("http.response.body.size", recorder.bytes),
+		)
+		if recorder.status >= 500 {
+			span.SetStatus(codes.Error, strconv.Itoa(recorder.status))
+		}
+	})
+}
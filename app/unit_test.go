@@ -1,14 +1,80 @@
 package main
 
 import (
+	"app/client"
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math/big"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
+const testUser = "hamlet"
+
+// withTestUser authenticates a request as testUser like the authenticate middleware would
+func withTestUser(req *http.Request) *http.Request {
+	return withPrincipal(req, Principal{User: User{Username: testUser}})
+}
+
+const testPassword = "get thee to a nunnery"
+
+// withTestAccounts replaces Accounts with the given users, all with testPassword, and returns a
+// function serving a request on router with basic credentials for a user, or without credentials
+// when the username is empty. setHeaders change the request before it is served
+func withTestAccounts(t *testing.T, router http.Handler, usernames ...string) func(username string, method string, url string, body string, setHeaders ...func(*http.Request)) *httptest.ResponseRecorder {
+	t.Helper()
+	Accounts = newAccountStore()
+	for _, username := range usernames {
+		if _, err := Accounts.createUser(username, testPassword); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return func(username string, method string, url string, body string, setHeaders ...func(*http.Request)) *httptest.ResponseRecorder {
+		t.Helper()
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if username != "" {
+			req.SetBasicAuth(username, testPassword)
+		}
+		for _, setHeader := range setHeaders {
+			setHeader(req)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+}
+
 func Test_Healthcheck(t *testing.T) {
 	req, err := http.NewRequest("GET", "/healthcheck", nil)
 	if err != nil {
@@ -31,12 +97,12 @@ func Test_Healthcheck(t *testing.T) {
 }
 
 func Test_ListNotebooks(t *testing.T) {
-	Notebooks = make(map[string][]Note)
-	Notebooks["English"] = []Note{
+	Notebooks = map[string]map[string][]Note{testUser: {}}
+	Notebooks[testUser]["English"] = []Note{
 		Note{Id: "1", Title: "Hamlet", Body: "This is Hamlet", Tags: []string{"Classics", "Shakespeare"}, Created: "HamletCreated", LastModified: "HamletModified"},
 		Note{Id: "2", Title: "Animal Farm", Body: "Farm of Animals", Tags: []string{"Classics"}, Created: "AnimalCreated", LastModified: "AnimalModified"},
 	}
-	Notebooks["Math"] = []Note{
+	Notebooks[testUser]["Math"] = []Note{
 		Note{Id: "1", Title: "Algebra", Body: "PEMDAS", Tags: []string{"HS"}, Created: "AlgebraCreated", LastModified: "AlgebraModified"},
 	}
 
@@ -46,7 +112,7 @@ func Test_ListNotebooks(t *testing.T) {
 	}
 	rr := httptest.NewRecorder()
 	handler := http.HandlerFunc(listNotebooks)
-	handler.ServeHTTP(rr, req)
+	handler.ServeHTTP(rr, withTestUser(req))
 	if status := rr.Code; status != http.StatusOK {
 		t.Errorf("handler returned wrong status code: got %v want %v",
 			status, http.StatusOK)
@@ -63,7 +129,7 @@ func Test_ListNotebooks(t *testing.T) {
 }
 
 func Test_CreateNotebook(t *testing.T) {
-	Notebooks = make(map[string][]Note)
+	Notebooks = map[string]map[string][]Note{testUser: {}}
 	req, err := http.NewRequest("POST", "/createNotebook/Science", nil)
 	if err != nil {
 		t.Fatal(err)
@@ -74,7 +140,7 @@ func Test_CreateNotebook(t *testing.T) {
 	// Need to create a router that we can pass the request through so that the vars will be added to the context
 	router := mux.NewRouter()
 	router.HandleFunc("/createNotebook/{title}", createNotebook)
-	router.ServeHTTP(rr, req)
+	router.ServeHTTP(rr, withTestUser(req))
 
 	// In this case, our MetricsHandler returns a non-200 response
 	// for a route variable it doesn't know about.
@@ -92,12 +158,12 @@ func Test_CreateNotebook(t *testing.T) {
 }
 
 func Test_DeleteNotebook(t *testing.T) {
-	Notebooks = make(map[string][]Note)
-	Notebooks["English"] = []Note{
+	Notebooks = map[string]map[string][]Note{testUser: {}}
+	Notebooks[testUser]["English"] = []Note{
 		Note{Id: "1", Title: "Hamlet", Body: "This is Hamlet", Tags: []string{"Classics", "Shakespeare"}, Created: "HamletCreated", LastModified: "HamletModified"},
 		Note{Id: "2", Title: "Animal Farm", Body: "Farm of Animals", Tags: []string{"Classics"}, Created: "AnimalCreated", LastModified: "AnimalModified"},
 	}
-	Notebooks["Math"] = []Note{
+	Notebooks[testUser]["Math"] = []Note{
 		Note{Id: "1", Title: "Algebra", Body: "PEMDAS", Tags: []string{"HS"}, Created: "AlgebraCreated", LastModified: "AlgebraModified"},
 	}
 
@@ -111,7 +177,7 @@ func Test_DeleteNotebook(t *testing.T) {
 	// Need to create a router that we can pass the request through so that the vars will be added to the context
 	router := mux.NewRouter()
 	router.HandleFunc("/deleteNotebook/{title}", deleteNotebook)
-	router.ServeHTTP(rr, req)
+	router.ServeHTTP(rr, withTestUser(req))
 
 	// In this case, our MetricsHandler returns a non-200 response
 	// for a route variable it doesn't know about.
@@ -129,8 +195,8 @@ func Test_DeleteNotebook(t *testing.T) {
 }
 
 func Test_NumberOfNotes(t *testing.T) {
-	Notebooks = make(map[string][]Note)
-	Notebooks["English"] = []Note{
+	Notebooks = map[string]map[string][]Note{testUser: {}}
+	Notebooks[testUser]["English"] = []Note{
 		Note{Id: "1", Title: "Hamlet", Body: "This is Hamlet", Tags: []string{"Classics", "Shakespeare"}, Created: "HamletCreated", LastModified: "HamletModified"},
 		Note{Id: "2", Title: "Animal Farm", Body: "Farm of Animals", Tags: []string{"Classics"}, Created: "AnimalCreated", LastModified: "AnimalModified"},
 	}
@@ -145,7 +211,7 @@ func Test_NumberOfNotes(t *testing.T) {
 	// Need to create a router that we can pass the request through so that the vars will be added to the context
 	router := mux.NewRouter()
 	router.HandleFunc("/numberOfNotes/{title}", numberOfNotes)
-	router.ServeHTTP(rr, req)
+	router.ServeHTTP(rr, withTestUser(req))
 
 	// In this case, our MetricsHandler returns a non-200 response
 	// for a route variable it doesn't know about.
@@ -163,8 +229,8 @@ func Test_NumberOfNotes(t *testing.T) {
 }
 
 func Test_ListNotes(t *testing.T) {
-	Notebooks = make(map[string][]Note)
-	Notebooks["English"] = []Note{
+	Notebooks = map[string]map[string][]Note{testUser: {}}
+	Notebooks[testUser]["English"] = []Note{
 		Note{Id: "1", Title: "Hamlet", Body: "This is Hamlet", Tags: []string{"Classics", "Shakespeare"}, Created: "HamletCreated", LastModified: "HamletModified"},
 		Note{Id: "2", Title: "Animal Farm", Body: "Farm of Animals", Tags: []string{"Classics"}, Created: "AnimalCreated", LastModified: "AnimalModified"},
 	}
@@ -182,7 +248,7 @@ func Test_ListNotes(t *testing.T) {
 	// Need to create a router that we can pass the request through so that the vars will be added to the context
 	router := mux.NewRouter()
 	router.HandleFunc("/listNotes/{title}", listNotes)
-	router.ServeHTTP(rr, req)
+	router.ServeHTTP(rr, withTestUser(req))
 
 	// In this case, our MetricsHandler returns a non-200 response
 	// for a route variable it doesn't know about.
@@ -200,8 +266,8 @@ func Test_ListNotes(t *testing.T) {
 }
 
 func Test_CreateNote(t *testing.T) {
-	Notebooks = make(map[string][]Note)
-	Notebooks["English"] = []Note{}
+	Notebooks = map[string]map[string][]Note{testUser: {}}
+	Notebooks[testUser]["English"] = []Note{}
 
 	data := []byte(`{"Title": "Hamlet", "Body": "This is Hamlet", "Tags": ["Classics", "Shakespeare"], "Created": "HamletCreated", "LastModified": "HamletModified"}`)
 
@@ -216,7 +282,7 @@ func Test_CreateNote(t *testing.T) {
 	// Need to create a router that we can pass the request through so that the vars will be added to the context
 	router := mux.NewRouter()
 	router.HandleFunc("/createNote/{title}", createNote)
-	router.ServeHTTP(rr, req)
+	router.ServeHTTP(rr, withTestUser(req))
 
 	// In this case, our MetricsHandler returns a non-200 response
 	// for a route variable it doesn't know about.
@@ -231,11 +297,16 @@ func Test_CreateNote(t *testing.T) {
 		t.Errorf("handler returned unexpected body: got %v want %v",
 			rr.Body.String(), expected)
 	}
+
+	// Location points at the new note
+	if location := rr.Header().Get("Location"); location != "/readNote/English/"+Notebooks[testUser]["English"][0].Id {
+		t.Errorf("handler returned wrong Location: got %v", location)
+	}
 }
 
 func Test_UpdateNote(t *testing.T) {
-	Notebooks = make(map[string][]Note)
-	Notebooks["English"] = []Note{
+	Notebooks = map[string]map[string][]Note{testUser: {}}
+	Notebooks[testUser]["English"] = []Note{
 		Note{Id: "1", Title: "Hamlet", Body: "This is Hamlet", Tags: []string{"Classics", "Shakespeare"}, Created: "HamletCreated", LastModified: "HamletModified"},
 	}
 
@@ -252,7 +323,7 @@ func Test_UpdateNote(t *testing.T) {
 	// Need to create a router that we can pass the request through so that the vars will be added to the context
 	router := mux.NewRouter()
 	router.HandleFunc("/updateNote/{title}/{noteId}", updateNote)
-	router.ServeHTTP(rr, req)
+	router.ServeHTTP(rr, withTestUser(req))
 
 	// In this case, our MetricsHandler returns a non-200 response
 	// for a route variable it doesn't know about.
@@ -270,8 +341,8 @@ func Test_UpdateNote(t *testing.T) {
 }
 
 func Test_ReadNote(t *testing.T) {
-	Notebooks = make(map[string][]Note)
-	Notebooks["English"] = []Note{
+	Notebooks = map[string]map[string][]Note{testUser: {}}
+	Notebooks[testUser]["English"] = []Note{
 		Note{Id: "1", Title: "Hamlet", Body: "This is Hamlet", Tags: []string{"Classics", "Shakespeare"}, Created: "HamletCreated", LastModified: "HamletModified"},
 		Note{Id: "2", Title: "Animal Farm", Body: "Farm of Animals", Tags: []string{"Classics"}, Created: "AnimalCreated", LastModified: "AnimalModified"},
 	}
@@ -286,7 +357,7 @@ func Test_ReadNote(t *testing.T) {
 	// Need to create a router that we can pass the request through so that the vars will be added to the context
 	router := mux.NewRouter()
 	router.HandleFunc("/readNote/{title}/{noteId}", readNote)
-	router.ServeHTTP(rr, req)
+	router.ServeHTTP(rr, withTestUser(req))
 
 	// In this case, our MetricsHandler returns a non-200 response
 	// for a route variable it doesn't know about.
@@ -304,8 +375,8 @@ func Test_ReadNote(t *testing.T) {
 }
 
 func Test_DeleteNote(t *testing.T) {
-	Notebooks = make(map[string][]Note)
-	Notebooks["English"] = []Note{
+	Notebooks = map[string]map[string][]Note{testUser: {}}
+	Notebooks[testUser]["English"] = []Note{
 		Note{Id: "1", Title: "Hamlet", Body: "This is Hamlet", Tags: []string{"Classics", "Shakespeare"}, Created: "HamletCreated", LastModified: "HamletModified"},
 		Note{Id: "2", Title: "Animal Farm", Body: "Farm of Animals", Tags: []string{"Classics"}, Created: "AnimalCreated", LastModified: "AnimalModified"},
 	}
@@ -320,7 +391,7 @@ func Test_DeleteNote(t *testing.T) {
 	// Need to create a router that we can pass the request through so that the vars will be added to the context
 	router := mux.NewRouter()
 	router.HandleFunc("/deleteNote/{title}/{noteId}", deleteNote)
-	router.ServeHTTP(rr, req)
+	router.ServeHTTP(rr, withTestUser(req))
 
 	// In this case, our MetricsHandler returns a non-200 response
 	// for a route variable it doesn't know about.
@@ -336,3 +407,2185 @@ func Test_DeleteNote(t *testing.T) {
 			rr.Body.String(), expected)
 	}
 }
+
+func Test_AutocompleteTags(t *testing.T) {
+	Notebooks = map[string]map[string][]Note{testUser: {}}
+	Notebooks[testUser]["English"] = []Note{
+		Note{Id: "1", Title: "Hamlet", Body: "This is Hamlet", Tags: []string{"Classics", "Shakespeare"}, Created: "HamletCreated", LastModified: "HamletModified"},
+		Note{Id: "2", Title: "Animal Farm", Body: "Farm of Animals", Tags: []string{"Classics"}, Created: "AnimalCreated", LastModified: "AnimalModified"},
+	}
+	Notebooks[testUser]["Math"] = []Note{
+		Note{Id: "3", Title: "Algebra", Body: "PEMDAS", Tags: []string{"Calculation"}, Created: "AlgebraCreated", LastModified: "AlgebraModified"},
+	}
+	rebuildTagIndex()
+
+	req, err := http.NewRequest("GET", "/autocompleteTags?prefix=c", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(autocompleteTags)
+	handler.ServeHTTP(rr, withTestUser(req))
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	// Check the response body is what we expect.
+	expected := "[{\"Tag\":\"Classics\",\"Count\":2},{\"Tag\":\"Calculation\",\"Count\":1}]\n"
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v",
+			rr.Body.String(), expected)
+	}
+
+	// Scoped to a notebook only counts tags used in that notebook
+	req, err = http.NewRequest("GET", "/autocompleteTags?prefix=Ca&notebook=English", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, withTestUser(req))
+
+	expected = "[]\n"
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v",
+			rr.Body.String(), expected)
+	}
+}
+
+func Test_TagIndexFollowsNoteChanges(t *testing.T) {
+	Notebooks = map[string]map[string][]Note{testUser: {}}
+	Notebooks[testUser]["English"] = []Note{
+		Note{Id: "1", Title: "Hamlet", Body: "This is Hamlet", Tags: []string{"Classics", "Shakespeare"}, Created: "HamletCreated", LastModified: "HamletModified"},
+	}
+	rebuildTagIndex()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/updateNote/{title}/{noteId}", updateNote)
+	router.HandleFunc("/deleteNote/{title}/{noteId}", deleteNote)
+
+	data := []byte(`{"Title": "Hamlet", "Body": "This is Hamlet", "Tags": ["Tragedy"]}`)
+	req, err := http.NewRequest("UPDATE", "/updateNote/English/1", bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, withTestUser(req))
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	if got := TagIndex.complete(testUser, "s", "", 10); len(got) != 0 {
+		t.Errorf("tag index kept replaced tags: got %v", got)
+	}
+	if got := TagIndex.complete(testUser, "t", "English", 10); len(got) != 1 || got[0].Tag != "Tragedy" {
+		t.Errorf("tag index missing updated tags: got %v", got)
+	}
+
+	req, err = http.NewRequest("DELETE", "/deleteNote/English/1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, withTestUser(req))
+
+	if got := TagIndex.complete(testUser, "", "", 10); len(got) != 0 {
+		t.Errorf("tag index kept tags of deleted note: got %v", got)
+	}
+}
+
+func Test_RenderNote(t *testing.T) {
+	Notebooks = map[string]map[string][]Note{testUser: {}}
+	Notebooks[testUser]["English"] = []Note{
+		Note{Id: "1", Title: "Hamlet", Body: "# Hamlet\n\n| Act | Scene |\n| --- | --- |\n| 1 | 2 |\n\n- [x] read\n- [ ] review\n\n<script>alert(1)</script>", Format: FormatMarkdown, Tags: []string{"Classics"}, Created: "HamletCreated", LastModified: "HamletModified"},
+		Note{Id: "2", Title: "Animal Farm", Body: "<p onclick=\"steal()\">Farm of <b>Animals</b></p><img src=\"javascript:alert(1)\"><input type=\"text\" disabled><input checked><input><input type=\"checkbox\" checked>", Format: FormatHTML, Tags: []string{"Classics"}, Created: "AnimalCreated", LastModified: "AnimalModified"},
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/renderNote/{title}/{noteId}", renderNote)
+
+	req, err := http.NewRequest("GET", "/renderNote/English/1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, withTestUser(req))
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	// Check the markdown was rendered with tables and task lists, without the script
+	body := rr.Body.String()
+	for _, expected := range []string{"<h1>Hamlet</h1>", "<table>", "<td>1</td>", "<input checked=\"\" disabled=\"\" type=\"checkbox\"", "<input disabled=\"\" type=\"checkbox\""} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("handler returned unexpected body: got %v want %v", body, expected)
+		}
+	}
+	if strings.Contains(body, "<script>") {
+		t.Errorf("handler did not strip script: got %v", body)
+	}
+
+	req, err = http.NewRequest("GET", "/renderNote/English/2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, withTestUser(req))
+
+	// Check dangerous attributes and inputs other than checkboxes were stripped from the html body
+	expected := "<p>Farm of <b>Animals</b></p><input type=\"checkbox\" checked=\"\">"
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v",
+			rr.Body.String(), expected)
+	}
+}
+
+func Test_CreateNoteUnsupportedFormat(t *testing.T) {
+	Notebooks = map[string]map[string][]Note{testUser: {}}
+	Notebooks[testUser]["English"] = []Note{}
+
+	data := []byte(`{"Title": "Hamlet", "Body": "This is Hamlet", "Format": "rtf", "Tags": ["Classics"]}`)
+
+	req, err := http.NewRequest("POST", "/createNote/English", bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/createNote/{title}", createNote)
+	router.ServeHTTP(rr, withTestUser(req))
+
+	if status := rr.Code; status != http.StatusInternalServerError {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusInternalServerError)
+	}
+	if len(Notebooks[testUser]["English"]) != 0 {
+		t.Errorf("note with unsupported format was saved: %v", Notebooks[testUser]["English"])
+	}
+}
+
+func Test_ReadNoteAccept(t *testing.T) {
+	Notebooks = map[string]map[string][]Note{testUser: {}}
+	Notebooks[testUser]["English"] = []Note{
+		Note{Id: "1", Title: "Hamlet", Body: "To be, or **not** to be", Format: FormatMarkdown, Tags: []string{"Classics", "Shakespeare"}, Created: "HamletCreated", LastModified: "HamletModified"},
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/readNote/{title}/{noteId}", readNote)
+
+	tests := []struct {
+		accept      string
+		status      int
+		contentType string
+		expected    string
+	}{
+		{"text/markdown", http.StatusOK, "text/markdown; charset=utf-8", "---\nid: \"1\"\ntitle: \"Hamlet\"\nformat: \"markdown\"\ntags:\n  - \"Classics\"\n  - \"Shakespeare\"\ncreated: \"HamletCreated\"\nlastModified: \"HamletModified\"\n---\n\nTo be, or **not** to be\n"},
+		{"text/plain", http.StatusOK, "text/plain; charset=utf-8", "Hamlet\nTags: Classics, Shakespeare\nCreated: HamletCreated\nLast Modified: HamletModified\n\nTo be, or **not** to be\n"},
+		{"text/html;q=0.9, application/json;q=0.1", http.StatusOK, "text/html; charset=utf-8", "<p>To be, or <strong>not</strong> to be</p>"},
+		{"*/*", http.StatusOK, "application/json; charset=utf-8", "\"Id\":\"1\",\"Title\":\"Hamlet\""},
+		{"", http.StatusOK, "application/json; charset=utf-8", "\"Id\":\"1\",\"Title\":\"Hamlet\""},
+		{"image/png", http.StatusNotAcceptable, "", ""},
+		// q=0 refuses a type also when a wildcard would match it
+		{"application/json;q=0, */*", http.StatusOK, "text/markdown; charset=utf-8", "To be, or **not** to be"},
+		{"text/*;q=0, */*;q=0.5", http.StatusOK, "application/json; charset=utf-8", "\"Id\":\"1\""},
+		{"text/markdown, text/*;q=0", http.StatusOK, "text/markdown; charset=utf-8", "---\nid: \"1\""},
+		{"application/json;q=0, text/*;q=0, */*", http.StatusNotAcceptable, "", ""},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", "/readNote/English/1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", test.accept)
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, withTestUser(req))
+
+		if status := rr.Code; status != test.status {
+			t.Errorf("handler returned wrong status code for %v: got %v want %v",
+				test.accept, status, test.status)
+		}
+		if test.contentType != "" && rr.Header().Get("Content-Type") != test.contentType {
+			t.Errorf("handler returned wrong content type for %v: got %v want %v",
+				test.accept, rr.Header().Get("Content-Type"), test.contentType)
+		}
+		if !strings.Contains(rr.Body.String(), test.expected) {
+			t.Errorf("handler returned unexpected body for %v: got %v want %v",
+				test.accept, rr.Body.String(), test.expected)
+		}
+	}
+}
+
+func Test_NoteLinks(t *testing.T) {
+	Notebooks = map[string]map[string][]Note{testUser: {}}
+	Notebooks[testUser]["English"] = []Note{
+		Note{Id: "1", Title: "Hamlet", Body: "See [[animal farm]] and [[Macbeth|the Scottish play]]", Tags: []string{"Classics", "Shakespeare"}, Created: "HamletCreated", LastModified: "HamletModified"},
+		Note{Id: "2", Title: "Animal Farm", Body: "Farm of Animals, unlike [[1]]", Tags: []string{"Classics"}, Created: "AnimalCreated", LastModified: "AnimalModified"},
+	}
+	rebuildIndexes()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/noteLinks/{title}/{noteId}", noteLinks)
+	router.HandleFunc("/backlinks/{title}/{noteId}", backlinks)
+	router.HandleFunc("/brokenLinks", brokenLinks)
+
+	tests := []struct {
+		url      string
+		expected string
+	}{
+		{"/noteLinks/English/1", "[{\"Text\":\"animal farm\",\"Notebook\":\"English\",\"Id\":\"2\",\"Title\":\"Animal Farm\",\"Broken\":false},{\"Text\":\"Macbeth\",\"Broken\":true}]\n"},
+		{"/backlinks/English/1", "[{\"Notebook\":\"English\",\"Id\":\"2\",\"Title\":\"Animal Farm\"}]\n"},
+		{"/backlinks/English/2", "[{\"Notebook\":\"English\",\"Id\":\"1\",\"Title\":\"Hamlet\"}]\n"},
+		{"/brokenLinks", "[{\"Notebook\":\"English\",\"Id\":\"1\",\"Title\":\"Hamlet\",\"Text\":\"Macbeth\"}]\n"},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", test.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, withTestUser(req))
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Errorf("handler returned wrong status code for %v: got %v want %v",
+				test.url, status, http.StatusOK)
+		}
+		if rr.Body.String() != test.expected {
+			t.Errorf("handler returned unexpected body for %v: got %v want %v",
+				test.url, rr.Body.String(), test.expected)
+		}
+	}
+}
+
+func Test_UpdateNoteRewriteLinks(t *testing.T) {
+	Notebooks = map[string]map[string][]Note{testUser: {}}
+	Notebooks[testUser]["English"] = []Note{
+		Note{Id: "1", Title: "Hamlet", Body: "This is Hamlet", Tags: []string{"Classics", "Shakespeare"}, Created: "HamletCreated", LastModified: "HamletModified"},
+	}
+	Notebooks[testUser]["Drama"] = []Note{
+		Note{Id: "2", Title: "Tragedies", Body: "Start with [[hamlet|the Dane]] then [[Othello]]", Tags: []string{"Shakespeare"}, Created: "TragediesCreated", LastModified: "TragediesModified"},
+	}
+	rebuildIndexes()
+
+	data := []byte(`{"Title": "Hamlet, Prince of Denmark", "Body": "This is Hamlet", "Tags": ["Classics", "Shakespeare"]}`)
+
+	req, err := http.NewRequest("UPDATE", "/updateNote/English/1?rewriteLinks=true", bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/updateNote/{title}/{noteId}", updateNote)
+	router.ServeHTTP(rr, withTestUser(req))
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	expected := "Start with [[Hamlet, Prince of Denmark|the Dane]] then [[Othello]]"
+	if Notebooks[testUser]["Drama"][0].Body != expected {
+		t.Errorf("links were not rewritten: got %v want %v",
+			Notebooks[testUser]["Drama"][0].Body, expected)
+	}
+	if refs := LinkGraph.linking(testUser, "Hamlet, Prince of Denmark"); len(refs) != 1 || refs[0].Notebook != "Drama" {
+		t.Errorf("link graph was not updated: got %v", refs)
+	}
+}
+
+func Test_NoteGraph(t *testing.T) {
+	Notebooks = map[string]map[string][]Note{testUser: {}}
+	Notebooks[testUser]["English"] = []Note{
+		Note{Id: "1", Title: "Hamlet", Body: "Compare with [[Animal Farm]]", Tags: []string{"Shakespeare"}, Created: "HamletCreated", LastModified: "HamletModified"},
+		Note{Id: "2", Title: "Animal Farm", Body: "Farm of Animals", Tags: []string{"Orwell"}, Created: "AnimalCreated", LastModified: "AnimalModified"},
+	}
+	Notebooks[testUser]["Math"] = []Note{
+		Note{Id: "3", Title: "Algebra", Body: "PEMDAS", Tags: []string{"HS"}, Created: "AlgebraCreated", LastModified: "AlgebraModified"},
+	}
+	rebuildIndexes()
+
+	req, err := http.NewRequest("GET", "/noteGraph?notebook=English&format=dot", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(noteGraph)
+	handler.ServeHTTP(rr, withTestUser(req))
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	// Check the response body is what we expect.
+	expected := "digraph nevernote {\n" +
+		"  \"note:English/1\" [label=\"Hamlet\", shape=box];\n" +
+		"  \"note:English/2\" [label=\"Animal Farm\", shape=box];\n" +
+		"  \"tag:Orwell\" [label=\"#Orwell\", shape=ellipse];\n" +
+		"  \"tag:Shakespeare\" [label=\"#Shakespeare\", shape=ellipse];\n" +
+		"  \"note:English/1\" -> \"tag:Shakespeare\" [label=\"tagged\", style=dashed];\n" +
+		"  \"note:English/2\" -> \"tag:Orwell\" [label=\"tagged\", style=dashed];\n" +
+		"  \"note:English/1\" -> \"note:English/2\" [label=\"links\", style=solid];\n" +
+		"}\n"
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v",
+			rr.Body.String(), expected)
+	}
+
+	// Filtering by tag drops the notes without it along with their links
+	req, err = http.NewRequest("GET", "/noteGraph?tag=Shakespeare", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, withTestUser(req))
+
+	expected = "{\"graph\":{\"directed\":true,\"nodes\":{\"note:English/1\":{\"label\":\"Hamlet\",\"metadata\":{\"id\":\"1\",\"notebook\":\"English\",\"type\":\"note\"}},\"tag:Shakespeare\":{\"label\":\"Shakespeare\",\"metadata\":{\"type\":\"tag\"}}},\"edges\":[{\"source\":\"note:English/1\",\"target\":\"tag:Shakespeare\",\"relation\":\"tagged\"}]}}\n"
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v",
+			rr.Body.String(), expected)
+	}
+
+	// Carriage returns and newlines in labels become DOT line breaks
+	expected = "\"Act \\\"I\\\"\\nScene\\nii\\n\\\\\""
+	if quoted := dotQuote("Act \"I\"\r\nScene\rii\n\\"); quoted != expected {
+		t.Errorf("dotQuote returned unexpected label: got %v want %v", quoted, expected)
+	}
+}
+
+func newUploadRequest(t *testing.T, url string, filename string, contents string) *http.Request {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte(contents))
+	writer.Close()
+
+	req, err := http.NewRequest("POST", url, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+func Test_Attachments(t *testing.T) {
+	var err error
+	Blobs, err = newBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Notebooks = map[string]map[string][]Note{testUser: {}}
+	Notebooks[testUser]["English"] = []Note{
+		Note{Id: "1", Title: "Hamlet", Body: "This is Hamlet", Tags: []string{"Classics", "Shakespeare"}, Created: "HamletCreated", LastModified: "HamletModified"},
+		Note{Id: "2", Title: "Animal Farm", Body: "Farm of Animals", Tags: []string{"Classics"}, Created: "AnimalCreated", LastModified: "AnimalModified"},
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/addAttachments/{title}/{noteId}", addAttachments)
+	router.HandleFunc("/downloadAttachment/{title}/{noteId}/{attachmentId}", downloadAttachment)
+	router.HandleFunc("/deleteAttachment/{title}/{noteId}/{attachmentId}", deleteAttachment)
+
+	// The same file attached to two notes is only stored once
+	for _, noteId := range []string{"1", "2"} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, withTestUser(newUploadRequest(t, "/addAttachments/English/"+noteId, "act1.txt", "Who's there?")))
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v: %v",
+				status, http.StatusOK, rr.Body.String())
+		}
+	}
+
+	hamlet := Notebooks[testUser]["English"][0].Attachments
+	farm := Notebooks[testUser]["English"][1].Attachments
+	if len(hamlet) != 1 || len(farm) != 1 || hamlet[0].SHA256 != farm[0].SHA256 {
+		t.Fatalf("attachments were not added: got %v and %v", hamlet, farm)
+	}
+	if hamlet[0].Filename != "act1.txt" || hamlet[0].Size != 12 || hamlet[0].ContentType != "text/plain; charset=utf-8" {
+		t.Errorf("unexpected attachment metadata: got %v", hamlet[0])
+	}
+
+	// Download part of the attachment
+	req, err := http.NewRequest("GET", "/downloadAttachment/English/1/"+hamlet[0].Id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", "bytes=0-2")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, withTestUser(req))
+
+	if status := rr.Code; status != http.StatusPartialContent {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusPartialContent)
+	}
+	if rr.Body.String() != "Who" {
+		t.Errorf("handler returned unexpected body: got %v want %v",
+			rr.Body.String(), "Who")
+	}
+
+	// The blob is only collected once no note references it
+	for _, attachment := range []struct{ noteId, id string }{{"1", hamlet[0].Id}, {"2", farm[0].Id}} {
+		req, err = http.NewRequest("DELETE", "/deleteAttachment/English/"+attachment.noteId+"/"+attachment.id, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, withTestUser(req))
+		if status := rr.Code; status != http.StatusOK {
+			t.Errorf("handler returned wrong status code: got %v want %v",
+				status, http.StatusOK)
+		}
+
+		removed, _, err := Blobs.collect(referencedBlobs(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stillReferenced := attachment.noteId == "1"
+		if stillReferenced != Blobs.exists(hamlet[0].SHA256) || (stillReferenced && removed != 0) {
+			t.Errorf("unexpected garbage collection after deleting from note %v: removed %v", attachment.noteId, removed)
+		}
+	}
+}
+
+func Test_ConcurrentAttachments(t *testing.T) {
+	var err error
+	if Blobs, err = newBlobStore(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	Quotas = Quota{MaxAttachmentBytes: 24}
+	defer func() { Quotas = Quota{} }()
+	RateLimits = newRateLimiter()
+	Notebooks = map[string]map[string][]Note{"ophelia": {"Work": {Note{Id: "1", Title: "Flowers", Body: "rosemary"}}}}
+	router := newRouter()
+	withTestAccounts(t, router, "ophelia")
+
+	// uploads streamed at the same time get their own ids and share the quota
+	codes := make(chan int, 4)
+	var writers []*io.PipeWriter
+	var bodies [][]byte
+	for i := 0; i < 4; i++ {
+		req := newUploadRequest(t, "/addAttachments/Work/1", "act"+strconv.Itoa(i)+".txt", fmt.Sprintf("Who's there%d", i))
+		req.SetBasicAuth("ophelia", testPassword)
+		body, _ := io.ReadAll(req.Body)
+		reader, writer := io.Pipe()
+		req.Body = reader
+		writers, bodies = append(writers, writer), append(bodies, body)
+		go func() {
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			codes <- rr.Code
+		}()
+		// returns once the handler is streaming the upload
+		writer.Write(body[:1])
+	}
+	for i, writer := range writers {
+		go func(writer *io.PipeWriter, body []byte) {
+			writer.Write(body[1:])
+			writer.Close()
+		}(writer, bodies[i])
+	}
+	statuses := map[int]int{}
+	for range writers {
+		statuses[<-codes]++
+	}
+	if statuses[http.StatusOK] != 2 || statuses[http.StatusRequestEntityTooLarge] != 2 {
+		t.Errorf("concurrent uploads returned unexpected status codes: got %v", statuses)
+	}
+	ids := map[string]bool{}
+	for _, attachment := range Notebooks["ophelia"]["Work"][0].Attachments {
+		ids[attachment.Id] = true
+	}
+	if len(ids) != 2 {
+		t.Errorf("concurrent uploads were not added with distinct ids: got %v", Notebooks["ophelia"]["Work"][0].Attachments)
+	}
+}
+
+func Test_ResumableUpload(t *testing.T) {
+	var err error
+	if Blobs, err = newBlobStore(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	if Uploads, err = newUploadStore(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	Notebooks = map[string]map[string][]Note{testUser: {}}
+	Notebooks[testUser]["English"] = []Note{
+		Note{Id: "1", Title: "Hamlet", Body: "This is Hamlet", Tags: []string{"Classics", "Shakespeare"}, Created: "HamletCreated", LastModified: "HamletModified"},
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/uploads", createUpload).Methods("POST")
+	router.HandleFunc("/uploads/{uploadId}", uploadProgress).Methods("HEAD")
+	router.HandleFunc("/uploads/{uploadId}", patchUpload).Methods("PATCH")
+	router.HandleFunc("/attachUpload/{title}/{noteId}/{uploadId}", attachUpload).Methods("POST")
+
+	contents := "To be, or not to be, that is the question"
+
+	// create: filename "hamlet.log", filetype "text/plain"
+	req, err := http.NewRequest("POST", "/uploads", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Upload-Length", "41")
+	req.Header.Set("Upload-Metadata", "filename aGFtbGV0LmxvZw==,filetype dGV4dC9wbGFpbg==")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, withTestUser(req))
+	if status := rr.Code; status != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v",
+			status, http.StatusCreated)
+	}
+	location := rr.Header().Get("Location")
+
+	patchFrom := func(offset string, body io.Reader, checksum string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("PATCH", location, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", offset)
+		if checksum != "" {
+			req.Header.Set("Upload-Checksum", "sha256 "+checksum)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, withTestUser(req))
+		return rr
+	}
+	patch := func(offset string, chunk string, checksum string) *httptest.ResponseRecorder {
+		return patchFrom(offset, strings.NewReader(chunk), checksum)
+	}
+	progress := func() string {
+		req, err := http.NewRequest("HEAD", location, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, withTestUser(req))
+		return rr.Header().Get("Upload-Offset") + " of " + rr.Header().Get("Upload-Length")
+	}
+
+	if rr = patch("0", contents[:20], ""); rr.Code != http.StatusNoContent || rr.Header().Get("Upload-Offset") != "20" {
+		t.Fatalf("first chunk was not accepted: got %v offset %v", rr.Code, rr.Header().Get("Upload-Offset"))
+	}
+	// resending from a stale offset conflicts
+	if rr = patch("0", contents[:20], ""); rr.Code != http.StatusConflict {
+		t.Errorf("stale offset was accepted: got %v want %v", rr.Code, http.StatusConflict)
+	}
+	// a corrupted chunk is rejected and discarded
+	if rr = patch("20", contents[20:], "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="); rr.Code != 460 {
+		t.Errorf("corrupted chunk was accepted: got %v want %v", rr.Code, 460)
+	}
+
+	if got := progress(); got != "20 of 41" {
+		t.Errorf("unexpected upload progress: got %v", got)
+	}
+
+	// while a slow chunk is written the progress is reported, other chunks wait their turn
+	body, bodyWriter := io.Pipe()
+	written := make(chan *httptest.ResponseRecorder)
+	go func() { written <- patchFrom("20", body, "") }()
+	bodyWriter.Write([]byte(contents[20:30]))
+	if got := progress(); got != "20 of 41" {
+		t.Errorf("unexpected upload progress while writing: got %v", got)
+	}
+	if rr = patch("20", contents[20:], ""); rr.Code != http.StatusLocked {
+		t.Errorf("concurrent chunk was accepted: got %v want %v", rr.Code, http.StatusLocked)
+	}
+	bodyWriter.Write([]byte(contents[30:]))
+	bodyWriter.Close()
+	if rr = <-written; rr.Code != http.StatusNoContent || rr.Header().Get("Upload-Offset") != "41" {
+		t.Fatalf("last chunk was not accepted: got %v offset %v", rr.Code, rr.Header().Get("Upload-Offset"))
+	}
+
+	attach := func(sum string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "/attachUpload/English/1/"+strings.TrimPrefix(location, "/uploads/"), strings.NewReader(`{"SHA256": "`+sum+`"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, withTestUser(req))
+		return rr
+	}
+
+	if rr = attach("0000000000000000000000000000000000000000000000000000000000000000"); rr.Code != http.StatusInternalServerError {
+		t.Errorf("upload with wrong checksum was attached: got %v", rr.Code)
+	}
+
+	sum := fmt.Sprintf("%x", sha256.Sum256([]byte(contents)))
+	if rr = attach(sum); rr.Code != http.StatusOK {
+		t.Fatalf("upload was not attached: got %v: %v", rr.Code, rr.Body.String())
+	}
+
+	attachments := Notebooks[testUser]["English"][0].Attachments
+	if len(attachments) != 1 || attachments[0].Filename != "hamlet.log" || attachments[0].ContentType != "text/plain" || attachments[0].Size != 41 || !Blobs.exists(sum) {
+		t.Errorf("unexpected attachment: got %v", attachments)
+	}
+}
+
+func Test_UploadExpiry(t *testing.T) {
+	dir := t.TempDir()
+	// files of an earlier run cannot be resumed
+	os.WriteFile(filepath.Join(dir, "0123abcd"), []byte("To be"), 0644)
+	var err error
+	if Uploads, err = newUploadStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("upload files of an earlier run were kept: %v", entries)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/uploads", createUpload).Methods("POST")
+	router.HandleFunc("/uploads/{uploadId}", uploadProgress).Methods("HEAD")
+
+	req, err := http.NewRequest("POST", "/uploads", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Upload-Length", "41")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, withTestUser(req))
+	expires, err := http.ParseTime(rr.Header().Get("Upload-Expires"))
+	if rr.Code != http.StatusCreated || err != nil || expires.Sub(time.Now()) < 23*time.Hour {
+		t.Fatalf("upload was created with unexpected expiry: got %v %v", rr.Code, rr.Header().Get("Upload-Expires"))
+	}
+	id := strings.TrimPrefix(rr.Header().Get("Location"), "/uploads/")
+
+	if removed := Uploads.expire(time.Now()); removed != 0 {
+		t.Errorf("fresh upload was deleted")
+	}
+	if removed := Uploads.expire(expires.Add(time.Second)); removed != 1 {
+		t.Errorf("expired upload was not deleted")
+	}
+	if _, err := os.Stat(Uploads.path(id)); !os.IsNotExist(err) {
+		t.Errorf("file of the expired upload was kept: %v", err)
+	}
+	req, err = http.NewRequest("HEAD", "/uploads/"+id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, withTestUser(req))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expired upload was found: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+func Test_AttachmentThumbnail(t *testing.T) {
+	var err error
+	if Blobs, err = newBlobStore(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	Notebooks = map[string]map[string][]Note{testUser: {}}
+	Notebooks[testUser]["English"] = []Note{
+		Note{Id: "1", Title: "Hamlet", Body: "This is Hamlet", Tags: []string{"Classics", "Shakespeare"}, Created: "HamletCreated", LastModified: "HamletModified"},
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, 300, 150))
+	for x := 0; x < 300; x++ {
+		img.Set(x, x%150, color.RGBA{R: 200, A: 255})
+	}
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, img); err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/addAttachments/{title}/{noteId}", addAttachments)
+	router.HandleFunc("/attachmentThumbnail/{title}/{noteId}/{attachmentId}", attachmentThumbnail)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, withTestUser(newUploadRequest(t, "/addAttachments/English/1", "castle", encoded.String())))
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %v",
+			status, http.StatusOK, rr.Body.String())
+	}
+
+	// The type is sniffed even without a file extension
+	attachment := Notebooks[testUser]["English"][0].Attachments[0]
+	if attachment.ContentType != "image/png" || attachment.Width != 300 || attachment.Height != 150 || len(attachment.Thumbnails) != len(thumbnailSizes) {
+		t.Fatalf("unexpected attachment metadata: got %+v", attachment)
+	}
+
+	req, err := http.NewRequest("GET", "/attachmentThumbnail/English/1/"+attachment.Id+"?size=small", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, withTestUser(req))
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	thumbnail, err := png.Decode(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := thumbnail.Bounds().Size(); size.X != 64 || size.Y != 32 {
+		t.Errorf("thumbnail has wrong size: got %v want 64x32", size)
+	}
+}
+
+func Test_Authentication(t *testing.T) {
+	Notebooks = make(map[string]map[string][]Note)
+	serve := withTestAccounts(t, newRouter())
+
+	// healthcheck and registration are public, everything else needs credentials
+	if rr := serve("", "GET", "/healthcheck", ""); rr.Code != http.StatusOK {
+		t.Errorf("healthcheck returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	rr := serve("", "GET", "/listNotebooks", "")
+	if rr.Code != http.StatusUnauthorized || rr.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("listNotebooks without credentials returned wrong status code: got %v want %v", rr.Code, http.StatusUnauthorized)
+	}
+	expected := "{\"Status\":401,\"Error\":\"unauthorized: credentials required\",\"RequestId\":\"" + rr.Header().Get("X-Request-ID") + "\"}\n"
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
+	}
+
+	if rr := serve("", "POST", "/createUser", `{"Username": "ophelia", "Password": "get thee to a nunnery"}`); rr.Code != http.StatusCreated {
+		t.Fatalf("createUser returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+	if rr := serve("", "POST", "/createUser", `{"Username": "ophelia", "Password": "something else"}`); rr.Code != http.StatusConflict {
+		t.Errorf("duplicate createUser returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+	}
+	if rr := serve("", "GET", "/listNotebooks", "", func(req *http.Request) { req.SetBasicAuth("ophelia", "wrong password") }); rr.Code != http.StatusUnauthorized {
+		t.Errorf("wrong password returned wrong status code: got %v want %v", rr.Code, http.StatusUnauthorized)
+	}
+	if rr := serve("ophelia", "GET", "/listNotebooks", ""); rr.Code != http.StatusOK {
+		t.Errorf("password authentication returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	// a read only key can list but not create
+	rr = serve("ophelia", "POST", "/createApiKey", `{"Name": "reader", "Scopes": ["read"]}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("createApiKey returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+	var created struct {
+		Id  string
+		Key string
+	}
+	json.Unmarshal(rr.Body.Bytes(), &created)
+	bearer := func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+created.Key) }
+
+	if rr := serve("", "GET", "/listNotebooks", "", bearer); rr.Code != http.StatusOK {
+		t.Errorf("read with read key returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if rr := serve("", "POST", "/createNotebook/Math", "", bearer); rr.Code != http.StatusForbidden {
+		t.Errorf("write with read key returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+	if rr := serve("", "GET", "/listApiKeys", "", bearer); rr.Code != http.StatusForbidden {
+		t.Errorf("listApiKeys with read key returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+
+	// a key can't create a broader key, also when leaving out the scopes
+	createKey := func(body string, username string, setAuth ...func(*http.Request)) (NewAPIKey, int) {
+		rr := serve(username, "POST", "/createApiKey", body, setAuth...)
+		var key NewAPIKey
+		json.Unmarshal(rr.Body.Bytes(), &key)
+		return key, rr.Code
+	}
+	keysOnly, _ := createKey(`{"Name": "key manager", "Scopes": ["keys"]}`, "ophelia")
+	if _, status := createKey(`{"Name": "default"}`, "", func(req *http.Request) { req.Header.Set("X-API-Key", keysOnly.Key) }); status != http.StatusForbidden {
+		t.Errorf("createApiKey without scopes by a keys key returned wrong status code: got %v want %v", status, http.StatusForbidden)
+	}
+	manager, _ := createKey(`{"Name": "key manager", "Scopes": ["write", "keys"]}`, "ophelia")
+	withManager := func(req *http.Request) { req.Header.Set("X-API-Key", manager.Key) }
+	if _, status := createKey(`{"Name": "reader", "Scopes": ["read"]}`, "", withManager); status != http.StatusForbidden {
+		t.Errorf("createApiKey with broader scopes returned wrong status code: got %v want %v", status, http.StatusForbidden)
+	}
+	if derived, status := createKey(`{"Name": "default"}`, "", withManager); status != http.StatusCreated || !isSubset(derived.Scopes, manager.Scopes) || len(derived.Scopes) != 2 {
+		t.Errorf("createApiKey without scopes by a key returned unexpected key: got %v %v", status, derived.Scopes)
+	}
+
+	// secrets are never listed and revoked keys stop working
+	rr = serve("ophelia", "GET", "/listApiKeys", "")
+	if strings.Contains(rr.Body.String(), created.Key) || !strings.Contains(rr.Body.String(), created.Id) {
+		t.Errorf("listApiKeys returned unexpected body: got %v", rr.Body.String())
+	}
+	if rr := serve("ophelia", "DELETE", "/revokeApiKey/"+created.Id, ""); rr.Code != http.StatusOK {
+		t.Errorf("revokeApiKey returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if rr := serve("", "GET", "/listNotebooks", "", bearer); rr.Code != http.StatusUnauthorized {
+		t.Errorf("revoked key returned wrong status code: got %v want %v", rr.Code, http.StatusUnauthorized)
+	}
+}
+
+func Test_Sessions(t *testing.T) {
+	Accounts = newAccountStore()
+	RevokedTokens = newRevocationList()
+	SigningKeys = newKeyRing()
+	oldKey, err := randomKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	SigningKeys.add(oldKey, true)
+
+	if _, err := Accounts.createUser("horatio", "good night sweet prince"); err != nil {
+		t.Fatal(err)
+	}
+	Notebooks = make(map[string]map[string][]Note)
+	router := newRouter()
+
+	serve := func(method string, url string, body string, token string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	tokens := func(rr *httptest.ResponseRecorder) SessionTokens {
+		var tokens SessionTokens
+		if err := json.Unmarshal(rr.Body.Bytes(), &tokens); err != nil {
+			t.Fatal(err)
+		}
+		return tokens
+	}
+
+	if rr := serve("POST", "/login", `{"Username": "horatio", "Password": "wrong password"}`, ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("login with wrong password returned wrong status code: got %v want %v", rr.Code, http.StatusUnauthorized)
+	}
+	rr := serve("POST", "/login", `{"Username": "horatio", "Password": "good night sweet prince"}`, "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("login returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	first := tokens(rr)
+
+	if rr := serve("GET", "/listNotebooks", "", first.AccessToken); rr.Code != http.StatusOK {
+		t.Errorf("access token was rejected: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if rr := serve("GET", "/listNotebooks", "", first.RefreshToken); rr.Code != http.StatusUnauthorized {
+		t.Errorf("refresh token was accepted as access token: got %v want %v", rr.Code, http.StatusUnauthorized)
+	}
+
+	// rotating in a new key keeps tokens signed by the old one valid
+	newKey, err := randomKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	SigningKeys.add(newKey, true)
+
+	rr = serve("POST", "/refresh", `{"RefreshToken": "`+first.RefreshToken+`"}`, "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("refresh returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	second := tokens(rr)
+	if rr := serve("POST", "/refresh", `{"RefreshToken": "`+first.RefreshToken+`"}`, ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("used refresh token was accepted: got %v want %v", rr.Code, http.StatusUnauthorized)
+	}
+
+	// tokens signed by a key that is no longer in the ring are rejected
+	SigningKeys = newKeyRing()
+	SigningKeys.add(newKey, true)
+	if rr := serve("GET", "/listNotebooks", "", first.AccessToken); rr.Code != http.StatusUnauthorized {
+		t.Errorf("token of a removed key was accepted: got %v want %v", rr.Code, http.StatusUnauthorized)
+	}
+
+	if rr := serve("POST", "/logout", `{"RefreshToken": "`+second.RefreshToken+`"}`, second.AccessToken); rr.Code != http.StatusNoContent {
+		t.Errorf("logout returned wrong status code: got %v want %v", rr.Code, http.StatusNoContent)
+	}
+	if rr := serve("GET", "/listNotebooks", "", second.AccessToken); rr.Code != http.StatusUnauthorized {
+		t.Errorf("logged out access token was accepted: got %v want %v", rr.Code, http.StatusUnauthorized)
+	}
+	if rr := serve("POST", "/refresh", `{"RefreshToken": "`+second.RefreshToken+`"}`, ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("logged out refresh token was accepted: got %v want %v", rr.Code, http.StatusUnauthorized)
+	}
+}
+
+func Test_NotebookIsolation(t *testing.T) {
+	Notebooks = make(map[string]map[string][]Note)
+	rebuildIndexes()
+	serve := withTestAccounts(t, newRouter(), "ophelia", "laertes")
+
+	// both users can have a notebook with the same title
+	for _, username := range []string{"ophelia", "laertes"} {
+		if rr := serve(username, "POST", "/createNotebook/Work", ""); rr.Code != http.StatusOK {
+			t.Fatalf("createNotebook returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+	}
+	rr := serve("ophelia", "POST", "/createNote/Work", `{"Title": "Flowers", "Body": "There's rosemary", "Tags": ["Herbs"]}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("createNote returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	var notes []Note
+	json.Unmarshal(rr.Body.Bytes(), &notes)
+	note := notes[0]
+
+	// laertes sees an empty notebook and none of the notes or tags of ophelia
+	if rr := serve("laertes", "GET", "/listNotes/Work", ""); rr.Body.String() != "null\n" {
+		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), "null")
+	}
+	expected := "[]\n"
+	if rr := serve("laertes", "GET", "/readNote/Work/"+note.Id, ""); rr.Code == http.StatusOK {
+		t.Errorf("readNote of another user returned wrong status code: got %v", rr.Code)
+	}
+	if rr := serve("laertes", "GET", "/autocompleteTags?prefix=h", ""); rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
+	}
+	if rr := serve("laertes", "DELETE", "/deleteNote/Work/"+note.Id, ""); rr.Code == http.StatusOK {
+		t.Errorf("deleteNote of another user returned wrong status code: got %v", rr.Code)
+	}
+
+	if rr := serve("ophelia", "GET", "/readNote/Work/"+note.Id, ""); rr.Code != http.StatusOK {
+		t.Errorf("readNote returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if len(Notebooks["ophelia"]["Work"]) != 1 || len(Notebooks["laertes"]["Work"]) != 0 {
+		t.Errorf("notes ended up in the wrong notebooks: %v", Notebooks)
+	}
+}
+
+func Test_NotebookSharing(t *testing.T) {
+	Shares = newShareStore()
+	PublicLinks = newPublicLinkStore(nil)
+	Notebooks = make(map[string]map[string][]Note)
+	rebuildIndexes()
+	serve := withTestAccounts(t, newRouter(), "ophelia", "laertes", "polonius")
+
+	serve("ophelia", "POST", "/createNotebook/Work", "")
+	rr := serve("ophelia", "POST", "/createNote/Work", `{"Title": "Flowers", "Body": "There's rosemary", "Tags": ["Herbs"]}`)
+	var notes []Note
+	json.Unmarshal(rr.Body.Bytes(), &notes)
+	noteUrl := "/Work/" + notes[0].Id + "?owner=ophelia"
+
+	if rr := serve("ophelia", "POST", "/shareNotebook/Work", `{"Username": "laertes", "Role": "viewer"}`); rr.Code != http.StatusCreated {
+		t.Fatalf("shareNotebook returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+	if rr := serve("ophelia", "POST", "/shareNotebook/Work", `{"Username": "laertes", "Role": "editor"}`); rr.Code != http.StatusConflict {
+		t.Errorf("duplicate shareNotebook returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+	}
+	if rr := serve("ophelia", "POST", "/shareNotebook/Work", `{"Username": "laertes", "Role": "owner"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("shareNotebook with owner role returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+	if rr := serve("laertes", "POST", "/shareNotebook/Work?owner=ophelia", `{"Username": "polonius", "Role": "viewer"}`); rr.Code != http.StatusForbidden {
+		t.Errorf("shareNotebook by a viewer returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+
+	// viewers read but neither comment nor change, strangers get nothing
+	if rr := serve("laertes", "GET", "/readNote"+noteUrl, ""); rr.Code != http.StatusOK {
+		t.Errorf("readNote by a viewer returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if rr := serve("polonius", "GET", "/readNote"+noteUrl, ""); rr.Code != http.StatusForbidden {
+		t.Errorf("readNote by a stranger returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+	if rr := serve("laertes", "POST", "/addComment"+noteUrl, `{"Body": "Remember"}`); rr.Code != http.StatusForbidden {
+		t.Errorf("addComment by a viewer returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+	if rr := serve("laertes", "DELETE", "/deleteNote"+noteUrl, ""); rr.Code != http.StatusForbidden {
+		t.Errorf("deleteNote by a viewer returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+
+	// commenters comment, editors also change
+	if rr := serve("ophelia", "UPDATE", "/updateShare/Work/laertes", `{"Role": "commenter"}`); rr.Code != http.StatusOK {
+		t.Errorf("updateShare returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if rr := serve("laertes", "POST", "/addComment"+noteUrl, `{"Body": "Remember"}`); rr.Code != http.StatusCreated {
+		t.Errorf("addComment by a commenter returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+	if rr := serve("laertes", "UPDATE", "/updateNote"+noteUrl, `{"Title": "Rue", "Body": "For you", "Tags": []}`); rr.Code != http.StatusForbidden {
+		t.Errorf("updateNote by a commenter returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+	serve("ophelia", "UPDATE", "/updateShare/Work/laertes", `{"Role": "editor"}`)
+	if rr := serve("laertes", "UPDATE", "/updateNote"+noteUrl, `{"Title": "Rue", "Body": "For you", "Tags": []}`); rr.Code != http.StatusOK {
+		t.Errorf("updateNote by an editor returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	note := Notebooks["ophelia"]["Work"][0]
+	if note.Title != "Rue" || len(note.Comments) != 1 || note.Comments[0].Author != "laertes" {
+		t.Errorf("shared note was not changed as expected: %v", note)
+	}
+
+	rr = serve("laertes", "GET", "/sharedWithMe", "")
+	var grants []ShareGrant
+	json.Unmarshal(rr.Body.Bytes(), &grants)
+	if len(grants) != 1 || grants[0].Owner != "ophelia" || grants[0].Notebook != "Work" || grants[0].Role != RoleEditor {
+		t.Errorf("sharedWithMe returned unexpected body: got %v", rr.Body.String())
+	}
+
+	if rr := serve("ophelia", "DELETE", "/revokeShare/Work/laertes", ""); rr.Code != http.StatusOK {
+		t.Errorf("revokeShare returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if rr := serve("laertes", "GET", "/readNote"+noteUrl, ""); rr.Code != http.StatusForbidden {
+		t.Errorf("readNote after revokeShare returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+
+	// a notebook created again with the same title starts private
+	serve("ophelia", "POST", "/shareNotebook/Work", `{"Username": "polonius", "Role": "viewer"}`)
+	var link PublicLink
+	json.Unmarshal(serve("ophelia", "POST", "/createPublicLink/Work", `{}`).Body.Bytes(), &link)
+	if rr := serve("", "GET", link.Url, ""); rr.Code != http.StatusOK {
+		t.Fatalf("public link returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	serve("ophelia", "POST", "/createNotebook/Work", "")
+	if rr := serve("polonius", "GET", "/numberOfNotes/Work?owner=ophelia", ""); rr.Code != http.StatusForbidden {
+		t.Errorf("numberOfNotes of a replaced notebook returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+	if rr := serve("", "GET", link.Url, ""); rr.Code != http.StatusNotFound {
+		t.Errorf("public link of a replaced notebook returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+func Test_PublicLinks(t *testing.T) {
+	PublicLinks = newPublicLinkStore(nil)
+	Notebooks = make(map[string]map[string][]Note)
+	Notebooks["ophelia"] = map[string][]Note{"Work": {
+		Note{Id: "1", Title: "Flowers", Body: "There's *rosemary*", Format: FormatMarkdown, Tags: []string{"Herbs"},
+			Comments: []Comment{{Id: "0", Author: "laertes", Body: "private"}}},
+	}}
+	rebuildIndexes()
+	serve := withTestAccounts(t, newRouter(), "ophelia")
+	createLink := func(body string) PublicLink {
+		rr := serve("ophelia", "POST", "/createPublicLink/Work", body)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("createPublicLink returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+		}
+		var link PublicLink
+		json.Unmarshal(rr.Body.Bytes(), &link)
+		return link
+	}
+
+	// a note link works without an account and hides comments
+	noteLink := createLink(`{"NoteId": "1"}`)
+	rr := serve("", "GET", noteLink.Url, "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("public note link returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if !strings.Contains(rr.Body.String(), "Flowers") || strings.Contains(rr.Body.String(), "private") {
+		t.Errorf("public note link returned unexpected body: got %v", rr.Body.String())
+	}
+	if rr := serve("", "GET", noteLink.Url, "", func(req *http.Request) { req.Header.Set("Accept", "text/html") }); !strings.Contains(rr.Body.String(), "<em>rosemary</em>") {
+		t.Errorf("public note link returned unexpected body: got %v", rr.Body.String())
+	}
+
+	// tampered links and links that can't be edited into other notes
+	if rr := serve("", "GET", noteLink.Url+"x", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("tampered link returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+
+	notebookLink := createLink(`{"Password": "remember me"}`)
+	if rr := serve("", "GET", notebookLink.Url, ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("public link without password returned wrong status code: got %v want %v", rr.Code, http.StatusUnauthorized)
+	}
+	withPassword := func(req *http.Request) { req.Header.Set("X-Link-Password", "remember me") }
+	rr = serve("", "GET", notebookLink.Url, "", withPassword)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"Title":"Work"`) {
+		t.Errorf("public notebook link returned unexpected response: got %v %v", rr.Code, rr.Body.String())
+	}
+
+	// expired and revoked links stop working
+	expiringLink := createLink(`{"NoteId": "1", "ExpiresIn": 60}`)
+	PublicLinks.links[expiringLink.Id].expires = time.Now().Add(-time.Second)
+	if rr := serve("", "GET", expiringLink.Url, ""); rr.Code != http.StatusGone {
+		t.Errorf("expired link returned wrong status code: got %v want %v", rr.Code, http.StatusGone)
+	}
+	if rr := serve("ophelia", "DELETE", "/revokePublicLink/"+noteLink.Id, ""); rr.Code != http.StatusOK {
+		t.Errorf("revokePublicLink returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if rr := serve("", "GET", noteLink.Url, ""); rr.Code != http.StatusNotFound {
+		t.Errorf("revoked link returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+
+	var links []PublicLink
+	json.Unmarshal(serve("ophelia", "GET", "/listPublicLinks/Work", "").Body.Bytes(), &links)
+	counts := make(map[string]int)
+	for _, link := range links {
+		counts[link.Id] = link.AccessCount
+	}
+	if len(links) != 3 || counts[noteLink.Id] != 2 || counts[notebookLink.Id] != 1 || counts[expiringLink.Id] != 0 {
+		t.Errorf("listPublicLinks returned unexpected access counts: got %v", counts)
+	}
+
+	// a link revoked while its password is compared is not served
+	opened := make(chan error)
+	go func() {
+		_, err := PublicLinks.open(strings.TrimPrefix(notebookLink.Url, publicLinkPath), "remember me")
+		opened <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	PublicLinks.revoke("ophelia", notebookLink.Id)
+	if err := <-opened; err != errPublicLinkNotFound {
+		t.Errorf("link revoked while opening it was served: got %v", err)
+	}
+}
+
+func Test_AuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	var err error
+	Audit, err = openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Notebooks = make(map[string]map[string][]Note)
+	Admins = parseAdmins("horatio")
+	serveAs := withTestAccounts(t, newRouter(), "ophelia", "horatio")
+	serve := func(username string, method string, url string, body string) *httptest.ResponseRecorder {
+		return serveAs(username, method, url, body, func(req *http.Request) {
+			req.Header.Set("X-Request-ID", "req-"+method+url)
+			req.RemoteAddr = "192.0.2.1:1234"
+		})
+	}
+
+	serve("ophelia", "POST", "/createNotebook/Work", "")
+	serve("ophelia", "POST", "/createNote/Work", `{"Title": "Flowers", "Body": "There's rosemary", "Tags": []}`)
+	noteId := Notebooks["ophelia"]["Work"][0].Id
+	serve("ophelia", "UPDATE", "/updateNote/Work/"+noteId, `{"Title": "Flowers", "Body": "And pansies", "Tags": []}`)
+	serve("ophelia", "DELETE", "/deleteNote/Work/"+noteId, "")
+	// reads are not audited
+	serve("ophelia", "GET", "/listNotes/Work", "")
+
+	if rr := serve("ophelia", "GET", "/auditLog", ""); rr.Code != http.StatusForbidden {
+		t.Errorf("auditLog by a non admin returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+
+	rr := serve("horatio", "GET", "/auditLog?actor=ophelia&noteId="+noteId, "")
+	var events []AuditEvent
+	json.Unmarshal(rr.Body.Bytes(), &events)
+	if len(events) != 3 {
+		t.Fatalf("auditLog returned unexpected body: got %v", rr.Body.String())
+	}
+	created, updated, deleted := events[0], events[1], events[2]
+	if created.Action != AuditNoteCreate || updated.Action != AuditNoteUpdate || deleted.Action != AuditNoteDelete {
+		t.Errorf("auditLog returned unexpected actions: %v %v %v", created.Action, updated.Action, deleted.Action)
+	}
+	if created.BeforeHash != "" || created.AfterHash != updated.BeforeHash || updated.AfterHash != deleted.BeforeHash || deleted.AfterHash != "" {
+		t.Errorf("auditLog returned unexpected hashes: %v", events)
+	}
+	if created.Owner != "ophelia" || created.Notebook != "Work" || created.RequestId != "req-POST/createNote/Work" || created.ClientIP != "192.0.2.1" {
+		t.Errorf("auditLog returned unexpected event: %v", created)
+	}
+
+	// collecting blobs is an admin task as well
+	if Blobs, err = newBlobStore(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	if rr := serve("ophelia", "POST", "/collectBlobs", ""); rr.Code != http.StatusForbidden {
+		t.Errorf("collectBlobs by a non admin returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+	if rr := serve("horatio", "POST", "/collectBlobs", ""); rr.Code != http.StatusOK {
+		t.Errorf("collectBlobs by an admin returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	rr = serve("horatio", "GET", "/auditLog?format=jsonl&action="+AuditNotebookCreate, "")
+	if rr.Header().Get("Content-Type") != "application/x-ndjson" || strings.Count(rr.Body.String(), "\n") != 1 {
+		t.Errorf("auditLog export returned unexpected body: got %v", rr.Body.String())
+	}
+
+	// the health check notices when the open file can no longer be written
+	if err := checkAuditLog(context.Background()); err != nil {
+		t.Errorf("audit log check failed: %v", err)
+	}
+	Audit.file.Close()
+	if err := checkAuditLog(context.Background()); err == nil {
+		t.Errorf("audit log check passed with a closed file")
+	}
+	serve("ophelia", "POST", "/createNotebook/Home", "")
+	if err := Audit.writable(); err == nil || !strings.Contains(err.Error(), "last write failed") {
+		t.Errorf("audit log check did not report the failed write: %v", err)
+	}
+
+	// the log survives restarts and edits to it are detected
+	reopened, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reopened.events) != len(Audit.events) {
+		t.Errorf("reopened audit log has %v events, want %v", len(reopened.events), len(Audit.events))
+	}
+	reopened.file.Close()
+
+	contents, _ := os.ReadFile(path)
+	os.WriteFile(path, []byte(strings.Replace(string(contents), `"Actor":"ophelia"`, `"Actor":"horatio"`, 1)), 0600)
+	if _, err := openAuditLog(path); err == nil {
+		t.Errorf("tampered audit log was opened without error")
+	}
+	Audit = &auditLog{}
+}
+
+func Test_RateLimit(t *testing.T) {
+	RateLimits = newRateLimiter()
+	defer func() { RateLimits = newRateLimiter() }()
+	Notebooks = map[string]map[string][]Note{testUser: {"English": {}}}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/listNotes/{title}", listNotes)
+	router.HandleFunc("/login", login)
+	router.Use(rateLimit)
+	serve := func(url string, client string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", url, strings.NewReader(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = client + ":1234"
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, withTestUser(req))
+		return rr
+	}
+
+	// the bucket of a user is emptied by its burst
+	for i := 0; i < DefaultRateLimit.Burst; i++ {
+		rr := serve("/listNotes/English", "192.0.2.1")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("request %v returned wrong status code: got %v want %v", i, rr.Code, http.StatusOK)
+		}
+		if rr.Header().Get("RateLimit-Limit") != fmt.Sprint(DefaultRateLimit.Burst) {
+			t.Errorf("request %v returned wrong RateLimit-Limit: got %v", i, rr.Header().Get("RateLimit-Limit"))
+		}
+	}
+	rr := serve("/listNotes/English", "192.0.2.1")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusTooManyRequests)
+	}
+	if rr.Header().Get("Retry-After") != "1" || rr.Header().Get("RateLimit-Remaining") != "0" {
+		t.Errorf("handler returned unexpected headers: got %v", rr.Header())
+	}
+
+	// the user is limited from every address, routes with their own limit have their own bucket
+	if rr := serve("/listNotes/English", "192.0.2.2"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusTooManyRequests)
+	}
+	if rr := serve("/login", "192.0.2.1"); rr.Header().Get("RateLimit-Limit") != fmt.Sprint(RouteRateLimits["/login"].Burst) {
+		t.Errorf("login returned wrong RateLimit-Limit: got %v", rr.Header().Get("RateLimit-Limit"))
+	}
+
+	// buckets refill over time
+	now := time.Now()
+	key := "user:" + testUser + " *"
+	if result := RateLimits.take(key, DefaultRateLimit, now.Add(time.Second)); !result.Allowed || result.Remaining < int(DefaultRateLimit.Rate)-2 {
+		t.Errorf("bucket did not refill: got %+v", result)
+	}
+
+	// buckets are only dropped once they would be full again
+	refilled := now.Add(time.Duration(float64(FailedAuthRateLimit.Burst)/FailedAuthRateLimit.Rate) * time.Second)
+	RateLimits.take("failedAuth ip:192.0.2.9", FailedAuthRateLimit, now)
+	RateLimits.sweep(refilled.Add(-time.Second))
+	if RateLimits.buckets["failedAuth ip:192.0.2.9"] == nil {
+		t.Errorf("bucket was dropped before it refilled")
+	}
+	RateLimits.sweep(refilled)
+	if RateLimits.buckets["failedAuth ip:192.0.2.9"] != nil {
+		t.Errorf("refilled bucket was kept")
+	}
+
+	// guessing from one address is limited before the password is checked, guesses from
+	// other addresses don't lock the user out
+	logins := mux.NewRouter()
+	logins.HandleFunc("/login", login)
+	serveLogin := withTestAccounts(t, logins, "ophelia")
+	guess := func(client string, password string) *httptest.ResponseRecorder {
+		return serveLogin("", "POST", "/login", `{"Username": "ophelia", "Password": "`+password+`"}`, func(req *http.Request) { req.RemoteAddr = client + ":1234" })
+	}
+	for i := 0; i < FailedAuthRateLimit.Burst; i++ {
+		if rr := guess("198.51.100.1", "nymph"); rr.Code != http.StatusUnauthorized {
+			t.Fatalf("guess %v returned wrong status code: got %v want %v", i, rr.Code, http.StatusUnauthorized)
+		}
+	}
+	if rr := guess("198.51.100.1", testPassword); rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") == "" {
+		t.Errorf("login after too many guesses returned wrong status code: got %v want %v", rr.Code, http.StatusTooManyRequests)
+	}
+	for i := 2; i < 2+FailedAuthRateLimit.Burst; i++ {
+		guess("198.51.100."+strconv.Itoa(i), "nymph")
+	}
+	if rr := guess("198.51.100.99", testPassword); rr.Code != http.StatusOK {
+		t.Errorf("login after guesses from other addresses returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+}
+
+func Test_Quotas(t *testing.T) {
+	Quotas = Quota{MaxNotes: 2, MaxBodyBytes: 16, MaxAttachmentBytes: 10}
+	defer func() { Quotas = Quota{} }()
+	Notebooks = map[string]map[string][]Note{testUser: {"English": {
+		Note{Id: "1", Title: "Hamlet", Body: "To be", Tags: []string{}},
+	}}}
+	dir, err := os.MkdirTemp("", "blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if Blobs, err = newBlobStore(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/createNote/{title}", createNote)
+	router.HandleFunc("/addAttachments/{title}/{noteId}", addAttachments)
+	router.HandleFunc("/quota", showQuota)
+	serve := func(url string, body *bytes.Buffer, contentType string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", url, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", contentType)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, withTestUser(req))
+		return rr
+	}
+	attach := func(contents string) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, _ := writer.CreateFormFile("file", "notes.txt")
+		part.Write([]byte(contents))
+		writer.Close()
+		return serve("/addAttachments/English/1", body, writer.FormDataContentType())
+	}
+
+	if rr := serve("/createNote/English", bytes.NewBufferString(`{"Title": "Long", "Body": "Something is rotten", "Tags": []}`), "application/json"); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("createNote returned wrong status code for a long body: got %v want %v", rr.Code, http.StatusRequestEntityTooLarge)
+	}
+	if rr := serve("/createNote/English", bytes.NewBufferString(`{"Title": "Ghost", "Body": "Remember me", "Tags": []}`), "application/json"); rr.Code != http.StatusOK {
+		t.Errorf("createNote returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if rr := serve("/createNote/English", bytes.NewBufferString(`{"Title": "Yorick", "Body": "Alas", "Tags": []}`), "application/json"); rr.Code != http.StatusForbidden {
+		t.Errorf("createNote returned wrong status code over the note quota: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+
+	if rr := attach("12345678"); rr.Code != http.StatusOK {
+		t.Fatalf("addAttachments returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if rr := attach("12345"); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("addAttachments returned wrong status code over the attachment quota: got %v want %v", rr.Code, http.StatusRequestEntityTooLarge)
+	}
+	if rr := attach("12"); rr.Code != http.StatusOK {
+		t.Errorf("addAttachments returned wrong status code for the rest of the quota: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	req, _ := http.NewRequest("GET", "/quota", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, withTestUser(req))
+	expected := `{"Limits":{"MaxNotes":2,"MaxBodyBytes":16,"MaxAttachmentBytes":10},"Usage":{"Notes":2,"AttachmentBytes":10}}`
+	if strings.TrimSpace(rr.Body.String()) != expected {
+		t.Errorf("quota returned unexpected body: got %v want %v", rr.Body.String(), expected)
+	}
+}
+
+func Test_Config(t *testing.T) {
+	dir := t.TempDir()
+	yamlPath := filepath.Join(dir, "nevernote.yaml")
+	os.WriteFile(yamlPath, []byte("listen: \":6000\"\ntimeouts:\n  write: 45s\nlimits:\n  max_notes: 100\nauth:\n  link_key: c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0\n  admins: [horatio]\n"), 0600)
+	env := map[string]string{
+		"NEVERNOTE_CONFIG":    yamlPath,
+		"NEVERNOTE_MAX_NOTES": "200",
+		"NEVERNOTE_LOG_LEVEL": "debug",
+	}
+
+	// flags override the environment, which overrides the file
+	config, printConfig, err := loadConfig([]string{"-max-notes", "300", "-print-config"}, func(name string) string { return env[name] }, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !printConfig || config.Listen != ":6000" || config.Limits.MaxNotes != 300 || config.Log.Level != "debug" ||
+		time.Duration(config.Timeouts.Write) != 45*time.Second || config.Timeouts.Idle != defaultConfig().Timeouts.Idle ||
+		len(config.Auth.Admins) != 1 || config.Auth.Admins[0] != "horatio" {
+		t.Errorf("loadConfig returned unexpected config: got %+v", config)
+	}
+
+	// secrets are redacted when printed
+	var printed bytes.Buffer
+	writeConfig(&printed, config)
+	if strings.Contains(printed.String(), "c2VjcmV0") || !strings.Contains(printed.String(), "link_key: '[redacted]'") || !strings.Contains(printed.String(), "write: 45s") {
+		t.Errorf("writeConfig returned unexpected output: got %v", printed.String())
+	}
+
+	tomlPath := filepath.Join(dir, "nevernote.toml")
+	os.WriteFile(tomlPath, []byte("[storage]\npath = \"/var/lib/nevernote\"\n[features]\nuploads = false\n"), 0600)
+	config, _, err = loadConfig([]string{"-config", tomlPath}, func(string) string { return "" }, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Storage.Path != "/var/lib/nevernote" || config.Features.Uploads || !config.Features.Sharing {
+		t.Errorf("loadConfig returned unexpected config: got %+v", config)
+	}
+
+	// every problem is reported, unknown settings are errors
+	_, _, err = loadConfig([]string{"-listen", "nowhere", "-log-level", "loud", "-tls-cert", "cert.pem"}, func(string) string { return "" }, io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "listen:") || !strings.Contains(err.Error(), "log.level:") || !strings.Contains(err.Error(), "need both cert_file and key_file") {
+		t.Errorf("loadConfig returned unexpected error: got %v", err)
+	}
+	os.WriteFile(yamlPath, []byte("listen: \":6000\"\nlisten_port: 6000\n"), 0600)
+	if _, _, err = loadConfig([]string{"-config", yamlPath}, func(string) string { return "" }, io.Discard); err == nil || !strings.Contains(err.Error(), "listen_port") {
+		t.Errorf("loadConfig returned unexpected error for an unknown setting: got %v", err)
+	}
+	if _, _, err = loadConfig(nil, func(name string) string { return map[string]string{"NEVERNOTE_RATE_LIMIT": "fast"}[name] }, io.Discard); err == nil || !strings.Contains(err.Error(), "NEVERNOTE_RATE_LIMIT") {
+		t.Errorf("loadConfig returned unexpected error for a bad environment variable: got %v", err)
+	}
+}
+
+func Test_RequestBodyLimit(t *testing.T) {
+	Settings.Limits.MaxRequestBytes = 64
+	defer func() { Settings = defaultConfig() }()
+	Notebooks = map[string]map[string][]Note{testUser: {"English": {}}}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/createNote/{title}", createNote)
+	router.HandleFunc("/addAttachments/{title}/{noteId}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	router.Use(limitRequestBodies)
+	serve := func(url string, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, withTestUser(req))
+		return rr
+	}
+
+	if rr := serve("/createNote/English", `{"Title": "Hamlet", "Body": "To be", "Tags": []}`); rr.Code != http.StatusOK {
+		t.Errorf("createNote returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if rr := serve("/createNote/English", `{"Title": "Hamlet", "Body": "`+strings.Repeat("To be or not to be", 4)+`", "Tags": []}`); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("createNote returned wrong status code for a large body: got %v want %v", rr.Code, http.StatusRequestEntityTooLarge)
+	}
+	// attachments are streamed and limited by the quota instead
+	if rr := serve("/addAttachments/English/1", strings.Repeat("x", 128)); rr.Code != http.StatusNoContent {
+		t.Errorf("addAttachments returned wrong status code: got %v want %v", rr.Code, http.StatusNoContent)
+	}
+}
+
+func Test_GracefulShutdown(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan bool)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, "done")
+	})}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() { stopped <- runServer(ctx, server, listener, 5*time.Second) }()
+
+	// a request in progress when the server is stopped still gets its response
+	responses := make(chan string)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String() + "/slow")
+		if err != nil {
+			responses <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		responses <- string(body)
+	}()
+	<-started
+	cancel()
+
+	if body := <-responses; body != "done" {
+		t.Errorf("request in progress was not finished: got %v", body)
+	}
+	if err := <-stopped; err != nil {
+		t.Errorf("runServer returned unexpected error: %v", err)
+	}
+	if _, err := http.Get("http://" + listener.Addr().String() + "/slow"); err == nil {
+		t.Errorf("server still accepts requests after shutdown")
+	}
+	Readiness.set(StateReady)
+}
+
+func Test_CloseStores(t *testing.T) {
+	dir := t.TempDir()
+	var err error
+	if Audit, err = openAuditLog(filepath.Join(dir, auditPath)); err != nil {
+		t.Fatal(err)
+	}
+	if Blobs, err = newBlobStore(filepath.Join(dir, blobDir)); err != nil {
+		t.Fatal(err)
+	}
+	if Uploads, err = newUploadStore(filepath.Join(dir, uploadDir)); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		Audit = &auditLog{}
+		shutdownTracing = func(context.Context) error { return nil }
+	}()
+	u, err := Uploads.create(testUser, 41, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, blobDir, ".upload-123"), []byte("To be"), 0644)
+	flushed := false
+	shutdownTracing = func(context.Context) error {
+		flushed = true
+		return nil
+	}
+
+	closeStores()
+	if Audit.file != nil {
+		t.Errorf("audit log was not closed")
+	}
+	if _, err := os.Stat(Uploads.path(u.Id)); !os.IsNotExist(err) {
+		t.Errorf("file of the upload in progress was kept: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, blobDir, ".upload-123")); !os.IsNotExist(err) {
+		t.Errorf("temporary blob file was kept: %v", err)
+	}
+	if !flushed {
+		t.Errorf("spans were not exported")
+	}
+}
+
+func Test_TransferDeadlines(t *testing.T) {
+	Settings.Timeouts.Stream = Duration(5 * time.Second)
+	defer func() { Settings = defaultConfig() }()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := mux.NewRouter()
+	readBody := func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		io.WriteString(w, string(body))
+	}
+	router.HandleFunc("/uploads/{uploadId}", readBody)
+	router.HandleFunc("/createNote/{title}", readBody)
+	router.Use(extendTransferDeadlines)
+	server := &http.Server{Handler: router, ReadTimeout: 100 * time.Millisecond}
+	go server.Serve(listener)
+	defer server.Close()
+
+	// a body arriving slower than timeouts.read is only read in full on transfer routes
+	send := func(url string) string {
+		body, bodyWriter := io.Pipe()
+		go func() {
+			bodyWriter.Write([]byte("To be"))
+			time.Sleep(300 * time.Millisecond)
+			bodyWriter.Write([]byte(", or not to be"))
+			bodyWriter.Close()
+		}()
+		resp, err := http.Post("http://"+listener.Addr().String()+url, "application/octet-stream", body)
+		if err != nil {
+			return err.Error()
+		}
+		defer resp.Body.Close()
+		received, _ := io.ReadAll(resp.Body)
+		return strconv.Itoa(resp.StatusCode) + " " + string(received)
+	}
+	if got := send("/uploads/1"); got != "200 To be, or not to be" {
+		t.Errorf("slow upload was cut off: got %v", got)
+	}
+	if got := send("/createNote/Work"); strings.HasPrefix(got, "200") {
+		t.Errorf("slow request on another route was read in full: got %v", got)
+	}
+}
+
+// writeTestCertificate writes a PEM certificate and key signed by parent (self-signed when parent is nil)
+func writeTestCertificate(t *testing.T, dir string, name string, template *x509.Certificate, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, signerKey := template, interface{}(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	os.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0600)
+	os.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600)
+	certificate, _ := tls.X509KeyPair(certPEM, keyPEM)
+	certificate.Leaf, _ = x509.ParseCertificate(der)
+	return certificate
+}
+
+func Test_TLS(t *testing.T) {
+	Notebooks = make(map[string]map[string][]Note)
+	router := newRouter()
+	withTestAccounts(t, router, "ophelia")
+
+	dir := t.TempDir()
+	now := time.Now()
+	ca := writeTestCertificate(t, dir, "ca", &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "Nevernote CA"},
+		NotBefore: now.Add(-time.Hour), NotAfter: now.Add(time.Hour), IsCA: true, BasicConstraintsValid: true,
+		KeyUsage: x509.KeyUsageCertSign}, nil)
+	serverCertificate := func(serial int64) {
+		writeTestCertificate(t, dir, "server", &x509.Certificate{SerialNumber: big.NewInt(serial), Subject: pkix.Name{CommonName: "localhost"},
+			NotBefore: now.Add(-time.Hour), NotAfter: now.Add(time.Hour), IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}, &ca)
+	}
+	serverCertificate(2)
+	client := writeTestCertificate(t, dir, "client", &x509.Certificate{SerialNumber: big.NewInt(3), Subject: pkix.Name{CommonName: "ophelia"},
+		NotBefore: now.Add(-time.Hour), NotAfter: now.Add(time.Hour), ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}, &ca)
+
+	config := TLSConfig{CertFile: filepath.Join(dir, "server.pem"), KeyFile: filepath.Join(dir, "server.key"),
+		MinVersion: "1.2", ClientAuth: "request", ClientCAFile: filepath.Join(dir, "ca.pem")}
+	reloader, err := newCertReloader(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: router, TLSConfig: reloader.tlsConfig()}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() { stopped <- runServer(ctx, server, listener, time.Second) }()
+	defer func() {
+		cancel()
+		<-stopped
+		Readiness.set(StateReady)
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	get := func(certificates []tls.Certificate) (*http.Response, error) {
+		httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certificates}}}
+		return httpClient.Get("https://" + listener.Addr().String() + "/listNotebooks")
+	}
+
+	// a client certificate authenticates as the user of its common name
+	resp, err := get([]tls.Certificate{client})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.TLS.PeerCertificates[0].SerialNumber.Int64() != 2 {
+		t.Errorf("client certificate request returned wrong status code: got %v want %v", resp.StatusCode, http.StatusOK)
+	}
+	resp, err = get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("request without credentials returned wrong status code: got %v want %v", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	// a replaced certificate is served without restarting
+	serverCertificate(4)
+	if !reloader.changed() {
+		t.Errorf("reloader did not notice the replaced certificate")
+	}
+	if err := reloader.reload(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if serial := resp.TLS.PeerCertificates[0].SerialNumber.Int64(); serial != 4 {
+		t.Errorf("server returned the old certificate after reloading: got serial %v want 4", serial)
+	}
+
+	// a broken certificate keeps the old one
+	os.WriteFile(config.CertFile, []byte("garbage"), 0600)
+	if err := reloader.reload(); err == nil {
+		t.Errorf("reload accepted an invalid certificate")
+	}
+	if reloader.certificate.Leaf.SerialNumber.Int64() != 4 {
+		t.Errorf("reloader dropped the old certificate")
+	}
+}
+
+func Test_HealthChecks(t *testing.T) {
+	HealthChecks = &healthRegistry{}
+	defer func() {
+		HealthChecks = &healthRegistry{}
+		Readiness.set(StateReady)
+	}()
+	Settings.Storage.Path = t.TempDir()
+	defer func() { Settings = defaultConfig() }()
+	Readiness.set(StateReady)
+	router := newRouter()
+
+	serve := func(url string) (*httptest.ResponseRecorder, HealthReport) {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		var report HealthReport
+		json.Unmarshal(rr.Body.Bytes(), &report)
+		return rr, report
+	}
+
+	HealthChecks.register("storage", 0, checkStorage)
+	HealthChecks.register("indexes", 0, checkIndexes)
+	rebuildIndexes()
+	rr, report := serve("/readyz")
+	if rr.Code != http.StatusOK || report.Status != "ok" || len(report.Checks) != 2 || report.Checks[0].Name != "storage" {
+		t.Errorf("readyz returned unexpected report: got %v %v", rr.Code, rr.Body.String())
+	}
+
+	// a failing or hanging check makes the server unready, but not dead
+	HealthChecks.register("wal", 0, func(ctx context.Context) error { return errors.New("read-only file system") })
+	HealthChecks.register("slow", 50*time.Millisecond, func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	})
+	rr, report = serve("/readyz")
+	if rr.Code != http.StatusServiceUnavailable || report.Status != "unavailable" || len(report.Checks) != 4 ||
+		report.Checks[2].Error != "read-only file system" || report.Checks[3].Error != "timed out after 50ms" {
+		t.Errorf("readyz returned unexpected report: got %v %v", rr.Code, rr.Body.String())
+	}
+	if rr, _ := serve("/livez"); rr.Code != http.StatusOK {
+		t.Errorf("livez returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	// while starting only the health routes not using the stores answer
+	Readiness.set(StateStarting)
+	storesLoading.Store(true)
+	if rr, report := serve("/readyz"); rr.Code != http.StatusServiceUnavailable || report.State != StateStarting {
+		t.Errorf("readyz returned unexpected report while starting: got %v %v", rr.Code, rr.Body.String())
+	}
+	if rr, _ := serve("/livez"); rr.Code != http.StatusOK {
+		t.Errorf("livez returned wrong status code while starting: got %v want %v", rr.Code, http.StatusOK)
+	}
+	for _, url := range []string{"/listNotebooks", "/metrics"} {
+		if rr, _ := serve(url); rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") == "" {
+			t.Errorf("%v returned wrong status code while starting: got %v want %v", url, rr.Code, http.StatusServiceUnavailable)
+		}
+	}
+	storesLoading.Store(false)
+	Readiness.set(StateDraining)
+	if rr, report := serve("/readyz"); rr.Code != http.StatusServiceUnavailable || report.State != StateDraining {
+		t.Errorf("readyz returned unexpected report while draining: got %v %v", rr.Code, rr.Body.String())
+	}
+}
+
+func Test_Metrics(t *testing.T) {
+	Notebooks = map[string]map[string][]Note{"ophelia": {"Work": {
+		Note{Id: "1", Title: "Flowers", Body: "rosemary", Tags: []string{"Herbs"}},
+		Note{Id: "2", Title: "Songs", Body: "[[Flowers]]", Tags: []string{"Herbs", "Music"}},
+	}}}
+	rebuildIndexes()
+	httpRequests.Reset()
+	httpRequestDuration.Reset()
+	serve := withTestAccounts(t, newRouter(), "ophelia")
+	serve("ophelia", "GET", "/readNote/Work/1", "")
+	serve("ophelia", "GET", "/readNote/Work/2", "")
+	serve("ophelia", "GET", "/readNote/Work/3", "")
+
+	rr := serve("ophelia", "GET", "/metrics", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("metrics returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	// requests are labelled with the route template, not the URL
+	for _, expected := range []string{
+		`nevernote_http_requests_total{method="GET",route="/readNote/{title}/{noteId}",status="200"} 2`,
+		`nevernote_http_requests_total{method="GET",route="/readNote/{title}/{noteId}",status="500"} 1`,
+		`nevernote_http_request_duration_seconds_count{method="GET",route="/readNote/{title}/{noteId}"} 3`,
+		`nevernote_http_requests_in_flight 1`,
+		`nevernote_notebooks 1`,
+		`nevernote_notes 2`,
+		`nevernote_note_body_bytes 19`,
+		`nevernote_index_tags 2`,
+		`nevernote_index_links 1`,
+	} {
+		if !strings.Contains(rr.Body.String(), expected) {
+			t.Errorf("metrics is missing %v", expected)
+		}
+	}
+	if strings.Contains(rr.Body.String(), "/readNote/Work/1") {
+		t.Errorf("metrics contains a raw URL")
+	}
+
+	// scrapes count the notebooks while requests change them
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			serve("ophelia", "POST", "/createNotebook/Songs"+strconv.Itoa(i), "")
+		}(i)
+		go func() {
+			defer wg.Done()
+			serve("ophelia", "GET", "/metrics", "")
+		}()
+	}
+	wg.Wait()
+	if rr := serve("ophelia", "GET", "/metrics", ""); !strings.Contains(rr.Body.String(), "nevernote_notebooks 21") {
+		t.Errorf("metrics did not count the created notebooks")
+	}
+}
+
+func Test_Logging(t *testing.T) {
+	Notebooks = map[string]map[string][]Note{"ophelia": {"Work": {Note{Id: "1", Title: "Flowers", Body: "rosemary"}}}}
+	var logs bytes.Buffer
+	Logger = newLogger(LogConfig{Level: "info", Format: "json"}, &logs)
+	defer setupLogging(defaultConfig().Log)
+	serveAs := withTestAccounts(t, newRouter(), "ophelia")
+	serve := func(url string, id string) *httptest.ResponseRecorder {
+		return serveAs("ophelia", "GET", url, "", func(req *http.Request) {
+			if id != "" {
+				req.Header.Set("X-Request-ID", id)
+			}
+		})
+	}
+
+	// the request id sent by the client is kept
+	rr := serve("/readNote/Work/1", "rosemary-1")
+	if rr.Code != http.StatusOK || rr.Header().Get("X-Request-ID") != "rosemary-1" {
+		t.Fatalf("readNote returned wrong status code or request id: got %v %q", rr.Code, rr.Header().Get("X-Request-ID"))
+	}
+	var line map[string]interface{}
+	if err := json.Unmarshal(logs.Bytes(), &line); err != nil {
+		t.Fatalf("access log is not a JSON line: %v %q", err, logs.String())
+	}
+	expected := map[string]interface{}{
+		"level":      "INFO",
+		"msg":        "request",
+		"method":     "GET",
+		"route":      "/readNote/{title}/{noteId}",
+		"path":       "/readNote/Work/1",
+		"status":     float64(200),
+		"bytes":      float64(rr.Body.Len()),
+		"user":       "ophelia",
+		"request_id": "rosemary-1",
+	}
+	for key, value := range expected {
+		if line[key] != value {
+			t.Errorf("access log has wrong %v: got %v want %v", key, line[key], value)
+		}
+	}
+	if _, found := line["duration_ms"]; !found {
+		t.Errorf("access log has no duration_ms")
+	}
+
+	// errors carry the generated request id in the body and are logged as errors
+	logs.Reset()
+	rr = serve("/readNote/Work/2", "")
+	var body ErrorResponse
+	if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.RequestId == "" || body.RequestId != rr.Header().Get("X-Request-ID") {
+		t.Errorf("error body has wrong request id: got %q want %q", body.RequestId, rr.Header().Get("X-Request-ID"))
+	}
+	line = nil
+	if err := json.Unmarshal(logs.Bytes(), &line); err != nil {
+		t.Fatalf("access log is not a JSON line: %v %q", err, logs.String())
+	}
+	if line["level"] != "ERROR" || line["request_id"] != body.RequestId {
+		t.Errorf("access log of a failed request has wrong level or request id: got %v %v", line["level"], line["request_id"])
+	}
+
+	// the text format and the level come from the configuration
+	logs.Reset()
+	logger := newLogger(LogConfig{Level: "warn", Format: "text"}, &logs)
+	logger.Info("hidden")
+	logger.Warn("shown", "user", "ophelia")
+	if output := logs.String(); strings.Contains(output, "hidden") || !strings.Contains(output, "msg=shown user=ophelia") {
+		t.Errorf("text logger wrote unexpected output: %q", output)
+	}
+
+	if _, _, err := loadConfig([]string{"-log-format", "xml"}, func(string) string { return "" }, io.Discard); err == nil {
+		t.Errorf("loadConfig accepted log format xml")
+	}
+}
+
+func Test_Tracing(t *testing.T) {
+	Notebooks = map[string]map[string][]Note{"ophelia": {"Work": {}}}
+	rebuildIndexes()
+	exporter := tracetest.NewInMemoryExporter()
+	provider := newTracerProvider(TracingConfig{ServiceName: "nevernote", SampleRatio: 1}, exporter)
+	defer func(previous trace.Tracer) { tracer = previous }(tracer)
+	tracer = provider.Tracer(tracerName)
+	var logs bytes.Buffer
+	Logger = newLogger(LogConfig{Level: "info", Format: "json"}, &logs)
+	defer setupLogging(defaultConfig().Log)
+	serve := withTestAccounts(t, newRouter(), "ophelia")
+
+	// the trace of the client is continued
+	rr := serve("ophelia", "POST", "/createNote/Work", `{"Title": "Flowers", "Body": "rosemary", "Tags": ["Herbs"]}`, func(req *http.Request) {
+		req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929b0e0e4736-00f067aa0ba902b7-01")
+	})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("createNote returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if err := provider.ForceFlush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	server, found := spans["POST /createNote/{title}"]
+	if !found {
+		t.Fatalf("no span for the request, got %v", exporter.GetSpans())
+	}
+	if server.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929b0e0e4736" || server.Parent.SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("request span does not continue the traceparent: got trace %v parent %v", server.SpanContext.TraceID(), server.Parent.SpanID())
+	}
+	if server.SpanKind != trace.SpanKindServer {
+		t.Errorf("request span has wrong kind: got %v", server.SpanKind)
+	}
+	// store operations and index updates are children of the request
+	for _, name := range []string{"store.notebooks", "index.add", "store.audit.append"} {
+		span, found := spans[name]
+		if !found {
+			t.Errorf("no %v span", name)
+			continue
+		}
+		if span.Parent.SpanID() != server.SpanContext.SpanID() {
+			t.Errorf("%v span is not a child of the request span", name)
+		}
+	}
+	if !strings.Contains(logs.String(), `"trace_id":"4bf92f3577b34da6a3ce929b0e0e4736"`) {
+		t.Errorf("access log has no trace id: %v", logs.String())
+	}
+
+	// failed requests are marked as errors
+	exporter.Reset()
+	serve("ophelia", "GET", "/readNote/Work/404", "")
+	provider.ForceFlush(context.Background())
+	if spans := exporter.GetSpans(); len(spans) == 0 || spans[len(spans)-1].Status.Code != codes.Error {
+		t.Errorf("span of a failed request is not marked as an error: %v", spans)
+	}
+
+	// without an endpoint tracing is a no-op
+	shutdown, err := setupTracing(context.Background(), TracingConfig{ServiceName: "nevernote", SampleRatio: 1})
+	if err != nil || shutdown(context.Background()) != nil {
+		t.Errorf("setupTracing without an endpoint failed: %v", err)
+	}
+	if _, _, err := loadConfig([]string{"-tracing-endpoint", "localhost:4318"}, func(string) string { return "" }, io.Discard); err == nil {
+		t.Errorf("loadConfig accepted a tracing endpoint without a scheme")
+	}
+}
+
+func Test_OpenAPI(t *testing.T) {
+	Settings = defaultConfig()
+	Notebooks = map[string]map[string][]Note{"ophelia": {"Work": {}}}
+	rebuildIndexes()
+	router := newRouter()
+
+	// the document covers every route
+	if missing := undocumentedRoutes(router); len(missing) > 0 {
+		t.Errorf("routes missing from apiOperations: %v", missing)
+	}
+	ids := map[string]string{}
+	for key, operation := range apiOperations {
+		if previous, found := ids[operation.Id]; found {
+			t.Errorf("operation id %v is used by %v and %v", operation.Id, previous, key)
+		}
+		ids[operation.Id] = key
+	}
+
+	serve := withTestAccounts(t, router, "ophelia")
+
+	// served without credentials
+	rr := serve("", "GET", "/openapi.json", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("openapi.json returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	var document struct {
+		OpenAPI    string                                       `json:"openapi"`
+		Paths      map[string]map[string]map[string]interface{} `json:"paths"`
+		Components struct {
+			Schemas map[string]Schema `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &document); err != nil {
+		t.Fatal(err)
+	}
+	if document.OpenAPI != "3.1.0" {
+		t.Errorf("openapi.json has wrong version: got %v", document.OpenAPI)
+	}
+	if _, found := document.Paths["/createNote/{title}"]["post"]["requestBody"]; !found {
+		t.Errorf("createNote has no request body: %v", document.Paths["/createNote/{title}"])
+	}
+	if _, found := document.Paths["/updateNote/{title}/{noteId}"]["put"]; !found {
+		t.Errorf("updateNote is not documented as PUT: %v", document.Paths["/updateNote/{title}/{noteId}"])
+	}
+	if security, found := document.Paths["/login"]["post"]["security"]; !found || len(security.([]interface{})) != 0 {
+		t.Errorf("login is not documented as public: %v", document.Paths["/login"]["post"])
+	}
+	if document.Paths["/healthcheck"]["get"]["deprecated"] != true {
+		t.Errorf("healthcheck is not documented as deprecated: %v", document.Paths["/healthcheck"]["get"])
+	}
+	note := document.Components.Schemas["Note"]
+	if note.Properties["Tags"] == nil || note.Properties["Tags"].Type != "array" || !isSubset([]string{"Id", "Title", "Body", "Tags"}, note.Required) {
+		t.Errorf("Note schema is wrong: %+v", note)
+	}
+	if _, found := document.Components.Schemas["NewAPIKey"].Properties["Scopes"]; !found {
+		t.Errorf("NewAPIKey schema is missing the fields of APIKey: %+v", document.Components.Schemas["NewAPIKey"])
+	}
+
+	if rr := serve("", "GET", "/docs", ""); rr.Code != http.StatusOK || !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/html") || !strings.Contains(rr.Body.String(), "openapi.json") {
+		t.Errorf("docs returned wrong status code or page: got %v %v", rr.Code, rr.Header().Get("Content-Type"))
+	}
+
+	// bodies are validated before the handler runs, every bad field is reported
+	rr = serve("ophelia", "POST", "/createNote/Work", `{"Title": "", "Tags": "Herbs", "Format": "rtf"}`)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("createNote with a bad body returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+	var response ErrorResponse
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	expected := []FieldError{
+		{Field: "Body", Message: "is required"},
+		{Field: "Format", Message: `must be one of "", "plain", "markdown", "html"`},
+		{Field: "Tags", Message: "must be an array"},
+		{Field: "Title", Message: "must not be empty"},
+	}
+	if fmt.Sprint(response.Details) != fmt.Sprint(expected) || response.RequestId == "" {
+		t.Errorf("createNote with a bad body returned wrong details: got %+v want %+v", response, expected)
+	}
+	if len(Notebooks["ophelia"]["Work"]) != 0 {
+		t.Errorf("note with a bad body was saved: %v", Notebooks["ophelia"]["Work"])
+	}
+
+	rr = serve("ophelia", "POST", "/createNote/Work", `{"Title": "Flowers", "Body": "rosemary", "Tags": ["Herbs", 3]}`)
+	response = ErrorResponse{}
+	json.NewDecoder(rr.Body).Decode(&response)
+	if rr.Code != http.StatusBadRequest || len(response.Details) != 1 || response.Details[0].Field != "Tags[1]" {
+		t.Errorf("createNote with a number tag returned wrong status code or details: got %v %+v", rr.Code, response.Details)
+	}
+	if rr := serve("ophelia", "POST", "/createNote/Work", `{"Title": `); rr.Code != http.StatusBadRequest {
+		t.Errorf("createNote with invalid JSON returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+	if rr := serve("ophelia", "POST", "/createPublicLink/Work", `{"ExpiresIn": 1.5}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("createPublicLink with a fractional ExpiresIn returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+	rr = serve("", "POST", "/createUser", `{"Username": "lord hamlet", "Password": "words, words, words"}`)
+	response = ErrorResponse{}
+	json.NewDecoder(rr.Body).Decode(&response)
+	if rr.Code != http.StatusBadRequest || len(response.Details) != 1 || response.Details[0].Message != `must match ^[^\s/:]+$` {
+		t.Errorf("createUser with a space in the username returned wrong status code or details: got %v %+v", rr.Code, response.Details)
+	}
+
+	// valid bodies reach the handler, PUT works like UPDATE
+	if rr := serve("ophelia", "POST", "/createNote/Work", `{"Title": "Flowers", "Body": "rosemary", "Tags": ["Herbs"]}`); rr.Code != http.StatusOK {
+		t.Fatalf("createNote returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	id := Notebooks["ophelia"]["Work"][0].Id
+	if rr := serve("ophelia", "PUT", "/updateNote/Work/"+id, `{"Title": "Flowers", "Body": "rue", "Tags": ["Herbs"]}`); rr.Code != http.StatusOK || Notebooks["ophelia"]["Work"][0].Body != "rue" {
+		t.Errorf("updateNote with PUT returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if rr := serve("ophelia", "POST", "/logout", ""); rr.Code == http.StatusBadRequest {
+		t.Errorf("logout without a body failed validation: %v", rr.Body.String())
+	}
+}
+
+func Test_Client(t *testing.T) {
+	Settings = defaultConfig()
+	PublicLinks = newPublicLinkStore(nil)
+	var err error
+	if Blobs, err = newBlobStore(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	if Uploads, err = newUploadStore(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	Notebooks = make(map[string]map[string][]Note)
+	rebuildIndexes()
+	router := newRouter()
+	withTestAccounts(t, router, "ophelia", "laertes")
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	ctx := context.Background()
+	ophelia := client.New(server.URL, client.WithBasicAuth("ophelia", testPassword))
+
+	// titles are escaped in paths
+	if _, err := ophelia.CreateNotebook(ctx, "Work Notes"); err != nil {
+		t.Fatal(err)
+	}
+	note, err := ophelia.CreateNote(ctx, "Work Notes", client.NoteInput{Title: "Flowers", Body: "There's *rosemary*", Format: client.FormatMarkdown, Tags: []string{"Herbs"}})
+	if err != nil || note.Id == "" || note.Title != "Flowers" {
+		t.Fatalf("CreateNote returned unexpected note: got %+v %v", note, err)
+	}
+	if _, err := ophelia.CreateNote(ctx, "Work Notes", client.NoteInput{Title: "Pansies", Body: "for thoughts", Tags: []string{"Flowers"}}); err != nil {
+		t.Fatal(err)
+	}
+	note, err = ophelia.UpdateNote(ctx, "Work Notes", note.Id, client.NoteInput{Title: "Flowers", Body: "There's *rue* for you", Format: client.FormatMarkdown, Tags: []string{"Herbs"}}, false)
+	if err != nil || note.Body != "There's *rue* for you" {
+		t.Errorf("UpdateNote returned unexpected note: got %+v %v", note, err)
+	}
+	if notes, err := ophelia.ListNotes(ctx, "Work Notes", "Herbs"); err != nil || len(notes) != 1 || notes[0].Id != note.Id {
+		t.Errorf("ListNotes returned unexpected notes: got %+v %v", notes, err)
+	}
+	if matches, err := ophelia.SearchNotes(ctx, client.SearchQuery{Text: "THOUGHTS"}); err != nil || len(matches) != 1 || matches[0].Notebook != "Work Notes" || matches[0].Title != "Pansies" {
+		t.Errorf("SearchNotes returned unexpected matches: got %+v %v", matches, err)
+	}
+	if suggestions, err := ophelia.AutocompleteTags(ctx, "he", client.TagQuery{}); err != nil || len(suggestions) != 1 || suggestions[0].Tag != "Herbs" {
+		t.Errorf("AutocompleteTags returned unexpected suggestions: got %+v %v", suggestions, err)
+	}
+	if html, err := ophelia.ReadNoteAs(ctx, "Work Notes", note.Id, "text/html"); err != nil || !strings.Contains(html, "<em>rue</em>") {
+		t.Errorf("ReadNoteAs returned unexpected HTML: got %v %v", html, err)
+	}
+
+	// errors of the server can be told apart
+	if _, err := ophelia.ReadNote(ctx, "Work Notes", "404"); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("ReadNote of a missing note returned wrong error: got %v", err)
+	}
+	_, err = ophelia.CreateNote(ctx, "Work Notes", client.NoteInput{Body: "no title", Tags: []string{}})
+	var serverError *client.Error
+	if !errors.Is(err, client.ErrValidation) || !errors.As(err, &serverError) || len(serverError.Details) != 1 || serverError.Details[0].Field != "Title" || serverError.RequestId == "" {
+		t.Errorf("CreateNote without a title returned wrong error: got %v", err)
+	}
+	stranger := client.New(server.URL, client.WithBasicAuth("ophelia", "wrong"))
+	if _, err := stranger.ListNotebooks(ctx); !errors.Is(err, client.ErrUnauthorized) {
+		t.Errorf("ListNotebooks with a wrong password returned wrong error: got %v", err)
+	}
+
+	// resumable uploads, in several chunks
+	contents := strings.Repeat("To be, or not to be. ", client.DefaultChunkSize/10)
+	note, err = ophelia.UploadAttachment(ctx, "Work Notes", note.Id, "soliloquy.txt", "text/plain", strings.NewReader(contents))
+	if err != nil || len(note.Attachments) != 1 || note.Attachments[0].Filename != "soliloquy.txt" {
+		t.Fatalf("UploadAttachment returned unexpected note: got %+v %v", note.Attachments, err)
+	}
+	download, err := ophelia.DownloadAttachment(ctx, "Work Notes", note.Id, note.Attachments[0].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloaded, _ := io.ReadAll(download)
+	download.Close()
+	if string(downloaded) != contents {
+		t.Errorf("DownloadAttachment returned %v bytes, want %v", len(downloaded), len(contents))
+	}
+
+	// shared notebooks and public links
+	if _, err := ophelia.ShareNotebook(ctx, "Work Notes", "laertes", client.RoleViewer); err != nil {
+		t.Fatal(err)
+	}
+	laertes := client.New(server.URL, client.WithBasicAuth("laertes", testPassword)).ForOwner("ophelia")
+	if count, err := laertes.NumberOfNotes(ctx, "Work Notes"); err != nil || count != 2 {
+		t.Errorf("NumberOfNotes of a shared notebook returned unexpected count: got %v %v", count, err)
+	}
+	if err := laertes.DeleteNote(ctx, "Work Notes", note.Id); !errors.Is(err, client.ErrForbidden) {
+		t.Errorf("DeleteNote by a viewer returned wrong error: got %v", err)
+	}
+	link, err := ophelia.CreatePublicLink(ctx, "Work Notes", client.PublicLinkInput{Password: "remember me"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	anonymous := client.New(server.URL)
+	token := link.Url[strings.LastIndex(link.Url, "/")+1:]
+	if _, err := anonymous.ReadPublicLink(ctx, token, ""); !errors.Is(err, client.ErrUnauthorized) {
+		t.Errorf("ReadPublicLink without a password returned wrong error: got %v", err)
+	}
+	if content, err := anonymous.ReadPublicLink(ctx, token, "remember me"); err != nil || content.Notebook == nil || len(content.Notebook.Notes) != 2 {
+		t.Errorf("ReadPublicLink returned unexpected content: got %+v %v", content, err)
+	}
+}
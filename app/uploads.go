@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Resumable uploads follow the tus protocol (https://tus.io/protocols/resumable-upload)
+// with the creation, expiration, termination and checksum extensions. A finished upload
+// is moved into the blob store and attached to a note with attachUpload.
+
+const tusVersion = "1.0.0"
+
+type upload struct {
+	mu       sync.Mutex
+	Id       string
+	Owner    string
+	Length   int64
+	Offset   int64
+	Metadata map[string]string
+	Created  time.Time
+	// set while a PATCH request writes the file, which it does without holding mu
+	writing bool
+}
+
+type uploadStore struct {
+	dir     string
+	mu      sync.Mutex
+	uploads map[string]*upload
+}
+
+// Uploads holds the resumable uploads in progress
+var Uploads *uploadStore
+
+// uploads are kept in this directory of the storage path
+const uploadDir = "uploads"
+
+// how often uploads older than timeouts.upload are looked for
+const uploadSweepInterval = time.Minute
+
+var errUploadNotFound = errors.New("upload does not exist")
+
+func newUploadStore(dir string) (*uploadStore, error) {
+	/**
+	Function: newUploadStore
+	Description: Open the upload directory, removing the files of an earlier run. Uploads
+	             in progress are only kept in memory so nothing can resume them
+	*/
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return nil, err
+		}
+	}
+	return &uploadStore{dir: dir, uploads: make(map[string]*upload)}, nil
+}
+
+func (store *uploadStore) path(id string) string {
+	return filepath.Join(store.dir, id)
+}
+
+func (store *uploadStore) create(owner string, length int64, metadata map[string]string) (*upload, error) {
+	/**
+	Function: create
+	Description: Start a new upload of length bytes for a user
+	*/
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	u := &upload{
+		Id:       hex.EncodeToString(random),
+		Owner:    owner,
+		Length:   length,
+		Metadata: metadata,
+		Created:  time.Now(),
+	}
+
+	file, err := os.Create(store.path(u.Id))
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+
+	store.mu.Lock()
+	store.uploads[u.Id] = u
+	store.mu.Unlock()
+	return u, nil
+}
+
+func (store *uploadStore) get(owner string, id string) (*upload, error) {
+	/**
+	Function: get
+	Description: An upload in progress, uploads of other users do not exist
+	*/
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	u := store.uploads[id]
+	if u == nil || u.Owner != owner || u.expired(time.Now()) {
+		return nil, errUploadNotFound
+	}
+	return u, nil
+}
+
+func (u *upload) expires() (time.Time, bool) {
+	/**
+	Function: expires
+	Description: When the upload is deleted if it is not finished and attached, never
+	             when timeouts.upload is 0
+	*/
+	if Settings.Timeouts.Upload <= 0 {
+		return time.Time{}, false
+	}
+	return u.Created.Add(time.Duration(Settings.Timeouts.Upload)), true
+}
+
+func (u *upload) expired(now time.Time) bool {
+	expires, ok := u.expires()
+	return ok && !now.Before(expires)
+}
+
+func (store *uploadStore) expire(now time.Time) int {
+	/**
+	Function: expire
+	Description: Delete the uploads older than timeouts.upload and their files, except
+	             while a chunk is being written. Returns how many were deleted
+	*/
+	store.mu.Lock()
+	var expired []*upload
+	for _, u := range store.uploads {
+		if u.expired(now) {
+			expired = append(expired, u)
+		}
+	}
+	store.mu.Unlock()
+
+	removed := 0
+	for _, u := range expired {
+		u.mu.Lock()
+		if !u.writing {
+			store.remove(u.Id)
+			removed++
+		}
+		u.mu.Unlock()
+	}
+	return removed
+}
+
+func (store *uploadStore) sweep(ctx context.Context) {
+	/**
+	Function: sweep
+	Description: Delete expired uploads every uploadSweepInterval until ctx is done
+	*/
+	ticker := time.NewTicker(uploadSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if removed := store.expire(now); removed > 0 {
+				Logger.Info("deleted expired uploads", "count", removed)
+			}
+		}
+	}
+}
+
+func setUploadExpires(w http.ResponseWriter, u *upload) {
+	if expires, ok := u.expires(); ok {
+		w.Header().Set("Upload-Expires", expires.UTC().Format(http.TimeFormat))
+	}
+}
+
+func (store *uploadStore) close() error {
+	/**
+	Function: close
+	Description: Delete the files of the uploads in progress, they are only known in memory
+	             and cannot be resumed after a restart
+	*/
+	store.mu.Lock()
+	uploads := store.uploads
+	store.uploads = make(map[string]*upload)
+	store.mu.Unlock()
+
+	var err error
+	for id := range uploads {
+		if removeErr := os.Remove(store.path(id)); removeErr != nil && !os.IsNotExist(removeErr) {
+			err = removeErr
+		}
+	}
+	return err
+}
+
+func (store *uploadStore) remove(id string) {
+	store.mu.Lock()
+	delete(store.uploads, id)
+	store.mu.Unlock()
+	os.Remove(store.path(id))
+}
+
+func parseUploadMetadata(header string) (map[string]string, error) {
+	/**
+	Function: parseUploadMetadata
+	Description: Decode an Upload-Metadata header of comma separated "key base64(value)" pairs
+	*/
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, errors.New("invalid Upload-Metadata value for \"" + key + "\"")
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+func tusError(w http.ResponseWriter, err string, code int) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	returnStatusError(w, code, err)
+}
+
+func uploadOptions(w http.ResponseWriter, r *http.Request) {
+	/**
+	Function: uploadOptions
+	Description: Describe the supported resumable upload protocol
+	*/
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", "creation,expiration,termination,checksum")
+	w.Header().Set("Tus-Checksum-Algorithm", "sha256")
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(Settings.Limits.MaxUploadBytes, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func createUpload(w http.ResponseWriter, r *http.Request) {
+	/**
+	Function: createUpload
+	Description: Start a resumable upload, the Location header is where chunks are sent
+	*/
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		tusError(w, "Need Upload-Length to create upload", http.StatusBadRequest)
+		return
+	}
+	if length > Settings.Limits.MaxUploadBytes {
+		tusError(w, "Upload-Length exceeds "+strconv.FormatInt(Settings.Limits.MaxUploadBytes, 10)+" bytes", http.StatusRequestEntityTooLarge)
+		return
+	}
+	notebooksMu.RLock()
+	remaining := remainingAttachmentBytes(requestUsername(r))
+	notebooksMu.RUnlock()
+	if remaining >= 0 && length > remaining {
+		w.Header().Set("Tus-Resumable", tusVersion)
+		returnAttachmentQuotaExceeded(w)
+		return
+	}
+	metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		tusError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	principal, _ := currentPrincipal(r)
+	u, err := Uploads.create(principal.User.Username, length, metadata)
+	if err != nil {
+		tusError(w, "Could not create upload: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Location", "/uploads/"+u.Id)
+	w.Header().Set("Upload-Offset", "0")
+	setUploadExpires(w, u)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func uploadProgress(w http.ResponseWriter, r *http.Request) {
+	/**
+	Function: uploadProgress
+	Description: Report how many bytes of an upload have been received
+	*/
+	principal, _ := currentPrincipal(r)
+	u, err := Uploads.get(principal.User.Username, mux.Vars(r)["uploadId"])
+	if err != nil {
+		tusError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	setUploadExpires(w, u)
+	w.WriteHeader(http.StatusOK)
+}
+
+func patchUpload(w http.ResponseWriter, r *http.Request) {
+	/**
+	Function: patchUpload
+	Description: Append a chunk to an upload at the offset given in Upload-Offset
+	*/
+	principal, _ := currentPrincipal(r)
+	u, err := Uploads.get(principal.User.Username, mux.Vars(r)["uploadId"])
+	if err != nil {
+		tusError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		tusError(w, "Need Content-Type application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		tusError(w, "Need Upload-Offset to patch upload", http.StatusBadRequest)
+		return
+	}
+
+	// checksum extension: "Upload-Checksum: sha256 <base64 digest>" of this chunk
+	var expectedChecksum []byte
+	if header := r.Header.Get("Upload-Checksum"); header != "" {
+		algorithm, encoded, _ := strings.Cut(header, " ")
+		if algorithm != "sha256" {
+			tusError(w, "Unsupported checksum algorithm \""+algorithm+"\"", http.StatusBadRequest)
+			return
+		}
+		expectedChecksum, err = base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			tusError(w, "Invalid Upload-Checksum", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// reserve the upload, the chunk is written without holding u.mu so HEAD
+	// requests can report the progress meanwhile
+	u.mu.Lock()
+	if offset != u.Offset {
+		u.mu.Unlock()
+		tusError(w, "Upload-Offset "+strconv.FormatInt(offset, 10)+" does not match current offset "+strconv.FormatInt(u.Offset, 10), http.StatusConflict)
+		return
+	}
+	if u.writing {
+		u.mu.Unlock()
+		tusError(w, "Upload is being written by another request", http.StatusLocked)
+		return
+	}
+	u.writing = true
+	u.mu.Unlock()
+
+	written, sum, err := writeUploadChunk(r, u, offset)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.writing = false
+	if written < 0 {
+		tusError(w, "Could not open upload: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if expectedChecksum != nil && (err != nil || !bytes.Equal(sum, expectedChecksum)) {
+		// a chunk that cannot be verified is discarded as a whole
+		os.Truncate(Uploads.path(u.Id), offset)
+		if err != nil {
+			tusError(w, "Could not write upload: "+err.Error(), http.StatusInternalServerError)
+		} else {
+			tusError(w, "Checksum mismatch", 460)
+		}
+		return
+	}
+	u.Offset += written
+	if err != nil {
+		tusError(w, "Could not write upload: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	setUploadExpires(w, u)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeUploadChunk(r *http.Request, u *upload, offset int64) (int64, []byte, error) {
+	/**
+	Function: writeUploadChunk
+	Description: Write the request body to the upload file at offset, returning the bytes
+	             written and their sha256, -1 bytes when the file could not be opened
+	*/
+	file, err := os.OpenFile(Uploads.path(u.Id), os.O_WRONLY, 0644)
+	if err != nil {
+		return -1, nil, err
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return -1, nil, err
+	}
+
+	// never accept more than the declared length, keep whatever arrived
+	// before a dropped connection so the client can resume from there
+	hash := sha256.New()
+	_, span := startSpan(r.Context(), "uploads.write", attribute.String("nevernote.upload_id", u.Id), attribute.Int64("nevernote.upload_offset", offset))
+	written, err := io.Copy(io.MultiWriter(file, hash), io.LimitReader(r.Body, u.Length-offset))
+	span.SetAttributes(attribute.Int64("nevernote.upload_written", written))
+	endSpan(span, err)
+	return written, hash.Sum(nil), err
+}
+
+func deleteUpload(w http.ResponseWriter, r *http.Request) {
+	/**
+	Function: deleteUpload
+	Description: Abandon an upload and discard the chunks received so far
+	*/
+	principal, _ := currentPrincipal(r)
+	u, err := Uploads.get(principal.User.Username, mux.Vars(r)["uploadId"])
+	if err != nil {
+		tusError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.writing {
+		tusError(w, "Upload is being written by another request", http.StatusLocked)
+		return
+	}
+	Uploads.remove(u.Id)
+
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func attachUpload(w http.ResponseWriter, r *http.Request) {
+	/**
+	Function: attachUpload
+	Description: Verify the checksum of a finished upload and attach it to a note (based on id)
+	*/
+	vars := mux.Vars(r)
+	title := vars["title"]
+	noteId := vars["noteId"]
+	uploadId := vars["uploadId"]
+
+	reqBody, _ := ioutil.ReadAll(r.Body)
+	var request struct {
+		SHA256 string `json:"SHA256"`
+	}
+	json.Unmarshal(reqBody, &request)
+	if request.SHA256 == "" {
+		returnError(w, "Need SHA256 to attach upload")
+		return
+	}
+
+	// the notebooks are only locked before and after the upload is hashed
+	owner, remaining, ok := attachmentTarget(w, r, title, noteId)
+	if !ok {
+		return
+	}
+
+	u, err := Uploads.get(requestUsername(r), uploadId)
+	if err != nil {
+		returnError(w, "Upload with id \""+uploadId+"\" does not exist")
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.Offset != u.Length {
+		returnError(w, "Upload with id \""+uploadId+"\" is incomplete, received "+strconv.FormatInt(u.Offset, 10)+" of "+strconv.FormatInt(u.Length, 10)+" bytes")
+		return
+	}
+	// the upload counts against the owner of the notebook it is attached to
+	if remaining >= 0 && u.Length > remaining {
+		returnAttachmentQuotaExceeded(w)
+		return
+	}
+
+	sum, err := Blobs.adopt(r.Context(), Uploads.path(u.Id), strings.ToLower(request.SHA256))
+	if err != nil {
+		returnError(w, "Could not attach upload \""+uploadId+"\": "+err.Error())
+		return
+	}
+	Uploads.remove(u.Id)
+
+	filename := u.Id
+	if u.Metadata["filename"] != "" {
+		filename = filepath.Base(u.Metadata["filename"])
+	}
+	attachment := newAttachment(r.Context(), filename, u.Metadata["filetype"], sum, u.Length)
+
+	// the notebook may have changed while the upload was hashed
+	notebooksMu.Lock()
+	defer notebooksMu.Unlock()
+	notebooks := Notebooks[owner]
+	i, found := findNoteIndex(notebooks, title, noteId)
+	if !found {
+		returnError(w, "Note with id \""+noteId+"\" does not exist")
+		return
+	}
+	if !fitsAttachmentQuota(owner, attachment.Size) {
+		returnAttachmentQuotaExceeded(w)
+		return
+	}
+	attachment.Id = nextAttachmentId()
+	note := &notebooks[title][i]
+	before := *note
+	note.Attachments = append(note.Attachments, attachment)
+	note.LastModified = time.Now().Format("2006.01.02 15:04:05")
+	audit(r, AuditEvent{Action: AuditAttachmentAdd, Owner: owner, Notebook: title, NoteId: noteId, Target: attachment.Id}, before, *note)
+
+	json.NewEncoder(w).Encode(note)
+}